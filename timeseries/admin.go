@@ -0,0 +1,598 @@
+package timeseries
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/ajgb/go-opsview/timeseries/influxql"
+	"github.com/influxdata/influxdb/client/v2"
+	"github.com/julienschmidt/httprouter"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	REWRITE_WINDOW     = DAY
+	REWRITE_BATCH_SIZE = 5000
+)
+
+// AdminRequest selects host, service of the host or metric of the service,
+// To is the new name used when renaming
+type AdminRequest struct {
+	Type    string `json:"type"`
+	Host    string `json:"host"`
+	Service string `json:"service"`
+	Metric  string `json:"metric"`
+	To      string `json:"to,omitempty"`
+	Merge   bool   `json:"merge,omitempty"`
+}
+
+type seriesSelector struct {
+	measurement string
+	tags        map[string]string
+}
+
+func (this *AdminRequest) Validate(rename bool) error {
+	switch this.Type {
+	case "host":
+		this.Service, this.Metric = "", ""
+	case "service":
+		this.Metric = ""
+		if this.Service == "" {
+			return errors.New("Missing service")
+		}
+	case "metric":
+		if this.Service == "" || this.Metric == "" {
+			return errors.New("Missing service or metric")
+		}
+	default:
+		return errors.New(fmt.Sprintf("Invalid type: %s", this.Type))
+	}
+	if this.Host == "" {
+		return errors.New("Missing host")
+	}
+	if rename && this.To == "" {
+		return errors.New("Missing new name")
+	}
+
+	return nil
+}
+
+func (this *AdminRequest) String() string {
+	name := this.Host
+	if this.Type != "host" {
+		name += "::" + this.Service
+	}
+	if this.Type == "metric" {
+		name += "::" + this.Metric
+	}
+	if this.To != "" {
+		return fmt.Sprintf("%s %s -> %s", this.Type, name, this.To)
+	}
+
+	return fmt.Sprintf("%s %s", this.Type, name)
+}
+
+func (this *AdminRequest) source() seriesSelector {
+	selector := seriesSelector{measurement: this.Host, tags: make(map[string]string)}
+	if this.Service != "" {
+		selector.tags["service"] = this.Service
+	}
+	if this.Metric != "" {
+		selector.tags["metric"] = this.Metric
+	}
+
+	return selector
+}
+
+func (this *AdminRequest) target() seriesSelector {
+	selector := this.source()
+	switch this.Type {
+	case "host":
+		selector.measurement = this.To
+	case "service":
+		selector.tags["service"] = this.To
+	case "metric":
+		selector.tags["metric"] = this.To
+	}
+
+	return selector
+}
+
+func (this *AdminRequest) renamed() AdminRequest {
+	target := *this
+	switch this.Type {
+	case "host":
+		target.Host = this.To
+	case "service":
+		target.Service = this.To
+	case "metric":
+		target.Metric = this.To
+	}
+	target.To = ""
+
+	return target
+}
+
+func (this seriesSelector) where() string {
+	keys := make([]string, 0, len(this.tags))
+	for k := range this.tags {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	conditions := make([]string, 0, len(keys))
+	for _, k := range keys {
+		conditions = append(conditions, influxql.Eq(k, this.tags[k]))
+	}
+
+	return strings.Join(conditions, " AND ")
+}
+
+func (this seriesSelector) whereTime(start, end int64) string {
+	conditions := fmt.Sprintf("time >= %ds AND time < %ds", start, end)
+	if len(this.tags) > 0 {
+		return this.where() + " AND " + conditions
+	}
+
+	return conditions
+}
+
+func (this *SQLMetadataStore) MetadataExists(req AdminRequest) (bool, error) {
+	query := "SELECT COUNT(*) FROM uoms WHERE host = ?"
+	args := []interface{}{req.Host}
+	if req.Service != "" {
+		query += " AND service = ?"
+		args = append(args, req.Service)
+	}
+	if req.Metric != "" {
+		query += " AND metric = ?"
+		args = append(args, req.Metric)
+	}
+
+	var count int
+	err := this.db.QueryRow(query, args...).Scan(&count)
+
+	return count > 0, err
+}
+
+func (this *SQLMetadataStore) RenameMetadata(req AdminRequest) error {
+	tx, err := this.db.Begin()
+	if err != nil {
+		return err
+	}
+
+	switch req.Type {
+	case "host":
+		if err = tx.UpdateOrReplace("uoms", uomsKeys, "host", req.To, "host = ?", req.Host); err == nil {
+			err = tx.UpdateOrReplace("host_attributes", hostAttributesKeys, "host", req.To, "host = ?", req.Host)
+		}
+		if err == nil {
+			_, err = tx.Exec("UPDATE uoms_history SET host = ? WHERE host = ?", req.To, req.Host)
+		}
+	case "service":
+		if err = tx.UpdateOrReplace("uoms", uomsKeys, "service", req.To, "host = ? AND service = ?", req.Host, req.Service); err == nil {
+			_, err = tx.Exec("UPDATE uoms_history SET service = ? WHERE host = ? AND service = ?", req.To, req.Host, req.Service)
+		}
+	case "metric":
+		if err = tx.UpdateOrReplace("uoms", uomsKeys, "metric", req.To, "host = ? AND service = ? AND metric = ?", req.Host, req.Service, req.Metric); err == nil {
+			_, err = tx.Exec("UPDATE uoms_history SET metric = ? WHERE host = ? AND service = ? AND metric = ?", req.To, req.Host, req.Service, req.Metric)
+		}
+	}
+	if err == nil {
+		err = tx.bumpVersion()
+	}
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func (this *SQLMetadataStore) DeleteMetadata(req AdminRequest) error {
+	tx, err := this.db.Begin()
+	if err != nil {
+		return err
+	}
+
+	switch req.Type {
+	case "host":
+		if _, err = tx.Exec("DELETE FROM uoms WHERE host = ?", req.Host); err == nil {
+			_, err = tx.Exec("DELETE FROM host_attributes WHERE host = ?", req.Host)
+		}
+		if err == nil {
+			_, err = tx.Exec("DELETE FROM uoms_history WHERE host = ?", req.Host)
+		}
+	case "service":
+		if _, err = tx.Exec("DELETE FROM uoms WHERE host = ? AND service = ?", req.Host, req.Service); err == nil {
+			_, err = tx.Exec("DELETE FROM uoms_history WHERE host = ? AND service = ?", req.Host, req.Service)
+		}
+	case "metric":
+		if _, err = tx.Exec("DELETE FROM uoms WHERE host = ? AND service = ? AND metric = ?", req.Host, req.Service, req.Metric); err == nil {
+			_, err = tx.Exec("DELETE FROM uoms_history WHERE host = ? AND service = ? AND metric = ?", req.Host, req.Service, req.Metric)
+		}
+	}
+	if err == nil {
+		err = tx.bumpVersion()
+	}
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func influxQuery(db client.Client, database, command string) ([]client.Result, error) {
+	response, err := db.Query(client.Query{
+		Command:   command,
+		Database:  database,
+		Precision: "s",
+	})
+	if err != nil {
+		return nil, err
+	}
+	if err := response.Error(); err != nil {
+		return nil, err
+	}
+
+	return response.Results, nil
+}
+
+func (this *TimeseriesTenant) retentionPolicies(db client.Client) ([]string, error) {
+	results, err := influxQuery(db, this.config.InfluxDB.Database, "SHOW RETENTION POLICIES ON "+influxql.QuoteIdent(this.config.InfluxDB.Database))
+	if err != nil {
+		return nil, err
+	}
+
+	rps := make([]string, 0)
+	for _, result := range results {
+		for _, series := range result.Series {
+			for _, row := range series.Values {
+				if name, ok := row[0].(string); ok {
+					rps = append(rps, name)
+				}
+			}
+		}
+	}
+
+	return rps, nil
+}
+
+// seriesTimeRange returns time of the first and the last point of the series
+func (this *TimeseriesTenant) seriesTimeRange(db client.Client, from string, selector seriesSelector) (int64, int64, bool, error) {
+	first := influxql.Select("FIRST(value)").From(from)
+	last := influxql.Select("LAST(value)").From(from)
+	if len(selector.tags) > 0 {
+		first.Where(selector.where())
+		last.Where(selector.where())
+	}
+	command := influxql.Join(first, last)
+
+	results, err := influxQuery(db, this.config.InfluxDB.Database, command)
+	if err != nil {
+		return 0, 0, false, err
+	}
+
+	var times [2]int64
+	for i := range times {
+		if len(results) != 2 || len(results[i].Series) == 0 || len(results[i].Series[0].Values) == 0 {
+			return 0, 0, false, nil
+		}
+		ts, err := results[i].Series[0].Values[0][0].(json.Number).Int64()
+		if err != nil {
+			return 0, 0, false, err
+		}
+		times[i] = ts
+	}
+
+	return times[0], times[1], true, nil
+}
+
+// valueFieldType returns type of the value field of the measurement, points
+// are rewritten with the same type
+func (this *TimeseriesTenant) valueFieldType(db client.Client, from string) (string, error) {
+	results, err := influxQuery(db, this.config.InfluxDB.Database, "SHOW FIELD KEYS FROM "+from)
+	if err != nil {
+		return "", err
+	}
+
+	for _, result := range results {
+		for _, series := range result.Series {
+			for _, row := range series.Values {
+				if len(row) == 2 && row[0] == "value" {
+					if fieldType, ok := row[1].(string); ok {
+						return fieldType, nil
+					}
+				}
+			}
+		}
+	}
+
+	return "float", nil
+}
+
+func rewrittenValue(v interface{}, fieldType string) (interface{}, bool) {
+	switch fieldType {
+	case "integer":
+		if n, ok := v.(json.Number); ok {
+			i, err := n.Int64()
+			return i, err == nil
+		}
+		return nil, false
+	case "string":
+		s, ok := v.(string)
+		return s, ok
+	case "boolean":
+		b, ok := v.(bool)
+		return b, ok
+	}
+
+	return seriesValue(v)
+}
+
+// rewriteSeries copies points of source series to target series in every
+// retention policy, window by window, skipping points up to the time already
+// copied. Copying stops between windows once stop is closed. Returns time of
+// the last copied point of each retention policy.
+func (this *TimeseriesTenant) rewriteSeries(db client.Client, source, target seriesSelector, copied map[string]int64, stop <-chan struct{}, progress func(done, total int)) (map[string]int64, error) {
+	rps, err := this.retentionPolicies(db)
+	if err != nil {
+		return nil, err
+	}
+
+	type rpRange struct {
+		rp         string
+		fieldType  string
+		start, end int64
+	}
+	ranges := make([]rpRange, 0, len(rps))
+	total := 0
+	for _, rp := range rps {
+		from := influxql.Measurement(this.config.InfluxDB.Database, rp, source.measurement)
+		start, end, ok, err := this.seriesTimeRange(db, from, source)
+		if err != nil {
+			return nil, err
+		}
+		if last, seen := copied[rp]; seen && start <= last {
+			start = last + 1
+		}
+		if ok && start <= end {
+			fieldType, err := this.valueFieldType(db, from)
+			if err != nil {
+				return nil, err
+			}
+			ranges = append(ranges, rpRange{rp, fieldType, start, end})
+			total += int((end-start)/REWRITE_WINDOW) + 1
+		}
+	}
+
+	last := make(map[string]int64, len(copied)+len(ranges))
+	for rp, ts := range copied {
+		last[rp] = ts
+	}
+	done := 0
+	for _, r := range ranges {
+		from := influxql.Measurement(this.config.InfluxDB.Database, r.rp, source.measurement)
+		for start := r.start; start <= r.end; start += REWRITE_WINDOW {
+			select {
+			case <-stop:
+				return nil, errJobStopped
+			default:
+			}
+			command := influxql.Select("*").From(from).Where(source.whereTime(start, start+REWRITE_WINDOW)).String()
+			results, err := influxQuery(db, this.config.InfluxDB.Database, command)
+			if err != nil {
+				return nil, err
+			}
+			if err := this.writeRewrittenPoints(db, r.rp, r.fieldType, results, target); err != nil {
+				return nil, err
+			}
+
+			done++
+			progress(done, total)
+		}
+		last[r.rp] = r.end
+	}
+
+	return last, nil
+}
+
+func (this *TimeseriesTenant) writeRewrittenPoints(db client.Client, rp, fieldType string, results []client.Result, target seriesSelector) error {
+	newBatch := func() (client.BatchPoints, error) {
+		return client.NewBatchPoints(client.BatchPointsConfig{
+			Database:        this.config.InfluxDB.Database,
+			RetentionPolicy: rp,
+			Precision:       "s",
+		})
+	}
+	bp, err := newBatch()
+	if err != nil {
+		return err
+	}
+
+	for _, result := range results {
+		for _, series := range result.Series {
+			for _, row := range series.Values {
+				var ts int64
+				var value interface{}
+				tags := make(map[string]string)
+
+				for i, column := range series.Columns {
+					switch column {
+					case "time":
+						ts, _ = row[i].(json.Number).Int64()
+					case "value":
+						if v, ok := rewrittenValue(row[i], fieldType); ok {
+							value = v
+						}
+					default:
+						if v, ok := row[i].(string); ok && v != "" {
+							tags[column] = v
+						}
+					}
+				}
+				if value == nil {
+					continue
+				}
+				for k, v := range target.tags {
+					tags[k] = v
+				}
+
+				pt, err := client.NewPoint(target.measurement, tags, map[string]interface{}{"value": value}, time.Unix(ts, 0))
+				if err != nil {
+					return err
+				}
+				bp.AddPoint(pt)
+
+				if len(bp.Points()) >= REWRITE_BATCH_SIZE {
+					if err := db.Write(bp); err != nil {
+						return err
+					}
+					if bp, err = newBatch(); err != nil {
+						return err
+					}
+				}
+			}
+		}
+	}
+
+	if len(bp.Points()) > 0 {
+		return db.Write(bp)
+	}
+
+	return nil
+}
+
+func (this *TimeseriesTenant) dropSelectedSeries(db client.Client, selector seriesSelector) error {
+	command := "DROP SERIES FROM " + influxql.QuoteIdent(selector.measurement)
+	if len(selector.tags) > 0 {
+		command += " WHERE " + selector.where()
+	}
+	_, err := influxQuery(db, this.config.InfluxDB.Database, command)
+
+	return err
+}
+
+// Rename copies the data, renames the metadata and drops the old series. It
+// stops only while the data is copied the first time, points already copied
+// to a new target are dropped then.
+func (this *TimeseriesTenant) Rename(req AdminRequest, stop <-chan struct{}, progress func(done, total int)) error {
+	db, err := this.NewInfluxDBClient()
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	copied, err := this.rewriteSeries(db, req.source(), req.target(), nil, stop, progress)
+	if err == errJobStopped {
+		if !req.Merge {
+			if err := this.dropSelectedSeries(db, req.target()); err != nil {
+				return errors.New(fmt.Sprintf("Stopped by shutdown, failed to drop copied series: %s", err))
+			}
+		}
+		return err
+	}
+	if err != nil {
+		return errors.New(fmt.Sprintf("Failed to copy data: %s", err))
+	}
+	if err := this.store.RenameMetadata(req); err != nil {
+		return errors.New(fmt.Sprintf("Failed to update metadata: %s", err))
+	}
+	// points written to the old series while it was copied
+	if _, err := this.rewriteSeries(db, req.source(), req.target(), copied, nil, func(done, total int) {}); err != nil {
+		return errors.New(fmt.Sprintf("Failed to copy data: %s", err))
+	}
+	if err := this.dropSelectedSeries(db, req.source()); err != nil {
+		return errors.New(fmt.Sprintf("Failed to drop old series: %s", err))
+	}
+
+	return nil
+}
+
+func (this *TimeseriesTenant) Delete(req AdminRequest, progress func(done, total int)) error {
+	db, err := this.NewInfluxDBClient()
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	if err := this.dropSelectedSeries(db, req.source()); err != nil {
+		return errors.New(fmt.Sprintf("Failed to drop series: %s", err))
+	}
+	progress(1, 2)
+	if err := this.store.DeleteMetadata(req); err != nil {
+		return errors.New(fmt.Sprintf("Failed to delete metadata: %s", err))
+	}
+
+	return nil
+}
+
+func (this *TimeseriesServer) decodeAdminRequest(w http.ResponseWriter, r *http.Request, tenant *TimeseriesTenant, rename bool) (*AdminRequest, bool) {
+	defer r.Body.Close()
+
+	var req AdminRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		this.sendHTTPError(w, http.StatusBadRequest, "Failed to decode request: %s", err)
+		return nil, false
+	}
+	if err := req.Validate(rename); err != nil {
+		this.sendHTTPError(w, http.StatusBadRequest, "Invalid request: %s", err)
+		return nil, false
+	}
+
+	exists, err := tenant.store.MetadataExists(req)
+	if err != nil {
+		this.sendHTTPError(w, http.StatusInternalServerError, "Failed to query metadata information: %s", err)
+		return nil, false
+	}
+	if !exists {
+		this.sendHTTPError(w, http.StatusNotFound, "Unknown %s", req.String())
+		return nil, false
+	}
+
+	return &req, true
+}
+
+func (this *TimeseriesServer) RenameHandler(w http.ResponseWriter, r *http.Request, ps httprouter.Params, tenant *TimeseriesTenant) {
+	req, ok := this.decodeAdminRequest(w, r, tenant, true)
+	if !ok {
+		return
+	}
+
+	exists, err := tenant.store.MetadataExists(req.renamed())
+	if err != nil {
+		this.sendHTTPError(w, http.StatusInternalServerError, "Failed to query metadata information: %s", err)
+		return
+	}
+	if exists && !req.Merge {
+		this.sendHTTPError(w, http.StatusConflict, "Target %s already exists, use merge to combine them", req.To)
+		return
+	}
+
+	job := tenant.jobs.Submit("rename", req.String(), func(stop <-chan struct{}, progress func(done, total int)) error {
+		defer tenant.forgetQueryResults(*req, req.renamed())
+		return tenant.Rename(*req, stop, progress)
+	})
+	w.WriteHeader(http.StatusAccepted)
+	this.sendJSON(w, job)
+}
+
+func (this *TimeseriesServer) DeleteHandler(w http.ResponseWriter, r *http.Request, ps httprouter.Params, tenant *TimeseriesTenant) {
+	req, ok := this.decodeAdminRequest(w, r, tenant, false)
+	if !ok {
+		return
+	}
+	req.To = ""
+
+	// dropping the series and the metadata is short, it finishes on stop
+	job := tenant.jobs.Submit("delete", req.String(), func(stop <-chan struct{}, progress func(done, total int)) error {
+		defer tenant.forgetQueryResults(*req)
+		return tenant.Delete(*req, progress)
+	})
+	w.WriteHeader(http.StatusAccepted)
+	this.sendJSON(w, job)
+}
@@ -0,0 +1,224 @@
+package timeseries
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/influxdata/influxdb/client/v2"
+	"github.com/influxdata/influxdb/models"
+	"io/ioutil"
+	"log/syslog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestAdminRequestSelectors(t *testing.T) {
+	req := AdminRequest{Type: "service", Host: "h1", Service: `Disk 'C:'`, Metric: "ignored", To: "Disk C"}
+	if err := req.Validate(true); err != nil {
+		t.Fatal(err)
+	}
+
+	source, target := req.source(), req.target()
+	if source.measurement != "h1" || source.where() != `"service" = 'Disk \'C:\''` {
+		t.Errorf("Unexpected source %+v (%s)", source, source.where())
+	}
+	if target.measurement != "h1" || target.where() != `"service" = 'Disk C'` {
+		t.Errorf("Unexpected target %+v (%s)", target, target.where())
+	}
+	if renamed := req.renamed(); renamed.Service != "Disk C" || renamed.To != "" {
+		t.Errorf("Unexpected renamed request %+v", renamed)
+	}
+
+	if err := (&AdminRequest{Type: "metric", Host: "h1", Service: "CPU"}).Validate(false); err == nil {
+		t.Errorf("Expected error for missing metric")
+	}
+}
+
+func TestRenameMetadata(t *testing.T) {
+	tenant, cleanup := newTestTenant(t)
+	defer cleanup()
+
+	if err := tenant.updateMetadata([][5]string{
+		{"old", "CPU", "load1", "GAUGE", ""},
+		{"old", "Disk", "/", "GAUGE", "MB"},
+		{"new", "CPU", "load1", "GAUGE", ""},
+	}, time.Now().Unix()); err != nil {
+		t.Fatal(err)
+	}
+
+	req := AdminRequest{Type: "host", Host: "old", To: "new", Merge: true}
+	if exists, err := tenant.store.MetadataExists(req.renamed()); err != nil || !exists {
+		t.Errorf("Expected target host to exist (%v)", err)
+	}
+	if err := tenant.store.RenameMetadata(req); err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := tenant.ListMetadata()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(data) != 2 || data[0][0] != "new" || data[1][0] != "new" {
+		t.Errorf("Unexpected metadata after merge %v", data)
+	}
+
+	if err := tenant.store.DeleteMetadata(AdminRequest{Type: "metric", Host: "new", Service: "Disk", Metric: "/"}); err != nil {
+		t.Fatal(err)
+	}
+	if exists, _ := tenant.store.MetadataExists(AdminRequest{Type: "service", Host: "new", Service: "Disk"}); exists {
+		t.Errorf("Expected deleted metric to be gone")
+	}
+}
+
+// renameInfluxDB fakes InfluxDB of a rename of host old with integer
+// values, a point is written to the old series while it is copied
+type renameInfluxDB struct {
+	*httptest.Server
+	lock            sync.Mutex
+	queries, writes []string
+}
+
+func newRenameInfluxDB() *renameInfluxDB {
+	influxdb := &renameInfluxDB{}
+	last := 1500000100
+	influxdb.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		influxdb.lock.Lock()
+		defer influxdb.lock.Unlock()
+
+		if r.URL.Path == "/write" {
+			body, _ := ioutil.ReadAll(r.Body)
+			influxdb.writes = append(influxdb.writes, strings.TrimSpace(string(body)))
+			last = 1500000200
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+
+		command := r.FormValue("q")
+		influxdb.queries = append(influxdb.queries, command)
+		var response client.Response
+		for _, statement := range strings.Split(command, "; ") {
+			var result client.Result
+			switch {
+			case strings.HasPrefix(statement, "SHOW RETENTION POLICIES"):
+				result.Series = []models.Row{{Columns: []string{"name"}, Values: [][]interface{}{{"autogen"}}}}
+			case strings.HasPrefix(statement, "SHOW FIELD KEYS"):
+				result.Series = []models.Row{{Name: "old", Columns: []string{"fieldKey", "fieldType"}, Values: [][]interface{}{{"value", "integer"}}}}
+			case strings.HasPrefix(statement, "SELECT FIRST(value)"):
+				result.Series = []models.Row{{Name: "old", Columns: []string{"time", "first"}, Values: [][]interface{}{{1500000000, 1}}}}
+			case strings.HasPrefix(statement, "SELECT LAST(value)"):
+				result.Series = []models.Row{{Name: "old", Columns: []string{"time", "last"}, Values: [][]interface{}{{last, 1}}}}
+			case strings.HasPrefix(statement, "SELECT *"):
+				result.Series = []models.Row{{Name: "old", Columns: []string{"time", "metric", "service", "value"}, Values: [][]interface{}{{last, "load1", "CPU", 2}}}}
+			}
+			response.Results = append(response.Results, result)
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(response)
+	}))
+
+	return influxdb
+}
+
+func TestRenameStatements(t *testing.T) {
+	tenant, cleanup := newTestTenant(t)
+	defer cleanup()
+
+	if err := tenant.updateMetadata([][5]string{{"old", "CPU", "load1", "GAUGE", ""}}, time.Now().Unix()); err != nil {
+		t.Fatal(err)
+	}
+
+	influxdb := newRenameInfluxDB()
+	defer influxdb.Close()
+	tenant.config.InfluxDB.Server = influxdb.URL
+	tenant.config.InfluxDB.Database = "opsview"
+
+	if err := tenant.Rename(AdminRequest{Type: "host", Host: "old", To: "new"}, nil, func(done, total int) {}); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []string{
+		`SHOW RETENTION POLICIES ON "opsview"`,
+		`SELECT FIRST(value) FROM "opsview"."autogen"."old"; SELECT LAST(value) FROM "opsview"."autogen"."old"`,
+		`SHOW FIELD KEYS FROM "opsview"."autogen"."old"`,
+		`SELECT * FROM "opsview"."autogen"."old" WHERE time >= 1500000000s AND time < 1500086400s`,
+		// copied again from the last copied point
+		`SHOW RETENTION POLICIES ON "opsview"`,
+		`SELECT FIRST(value) FROM "opsview"."autogen"."old"; SELECT LAST(value) FROM "opsview"."autogen"."old"`,
+		`SHOW FIELD KEYS FROM "opsview"."autogen"."old"`,
+		`SELECT * FROM "opsview"."autogen"."old" WHERE time >= 1500000101s AND time < 1500086501s`,
+		`DROP SERIES FROM "old"`,
+	}
+	if len(influxdb.queries) != len(expected) {
+		t.Fatalf("Unexpected statements:\n%s", strings.Join(influxdb.queries, "\n"))
+	}
+	for i := range expected {
+		if influxdb.queries[i] != expected[i] {
+			t.Errorf("Statement %d: expected %s got %s", i, expected[i], influxdb.queries[i])
+		}
+	}
+	// integer values stay integer
+	if len(influxdb.writes) != 2 || influxdb.writes[0] != "new,metric=load1,service=CPU value=2i 1500000100" || influxdb.writes[1] != "new,metric=load1,service=CPU value=2i 1500000200" {
+		t.Errorf("Unexpected writes: %v", influxdb.writes)
+	}
+
+	if data, _ := tenant.ListMetadata(); len(data) != 1 || data[0][0] != "new" {
+		t.Errorf("Unexpected metadata after rename %v", data)
+	}
+}
+
+func TestRenameStopped(t *testing.T) {
+	tenant, cleanup := newTestTenant(t)
+	defer cleanup()
+
+	if err := tenant.updateMetadata([][5]string{{"old", "CPU", "load1", "GAUGE", ""}}, time.Now().Unix()); err != nil {
+		t.Fatal(err)
+	}
+
+	influxdb := newRenameInfluxDB()
+	defer influxdb.Close()
+	tenant.config.InfluxDB.Server = influxdb.URL
+	tenant.config.InfluxDB.Database = "opsview"
+
+	stop := make(chan struct{})
+	close(stop)
+	if err := tenant.Rename(AdminRequest{Type: "host", Host: "old", To: "new"}, stop, func(done, total int) {}); err != errJobStopped {
+		t.Fatalf("Expected rename to be stopped, got %v", err)
+	}
+	// the old series is kept and the copy of the new one dropped
+	if last := influxdb.queries[len(influxdb.queries)-1]; last != `DROP SERIES FROM "new"` || len(influxdb.writes) != 0 {
+		t.Errorf("Unexpected statements %v and writes %v", influxdb.queries, influxdb.writes)
+	}
+	if data, _ := tenant.ListMetadata(); len(data) != 1 || data[0][0] != "old" {
+		t.Errorf("Unexpected metadata after stopped rename %v", data)
+	}
+}
+
+func TestJobManagerStop(t *testing.T) {
+	tenant := NewTenant(&TimeseriesTenantConfig{Name: "test"}, &TimeseriesLogger{logLevel: syslog.LOG_EMERG})
+
+	started := make(chan struct{})
+	running := tenant.jobs.Submit("rename", "running", func(stop <-chan struct{}, progress func(done, total int)) error {
+		close(started)
+		<-stop
+		return errJobStopped
+	})
+	<-started
+	pending := tenant.jobs.Submit("rename", "pending", func(stop <-chan struct{}, progress func(done, total int)) error {
+		t.Error("Pending job started after stop")
+		return nil
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := tenant.stopWorkers(ctx); err != nil {
+		t.Fatal(err)
+	}
+	for _, id := range []int64{running.ID, pending.ID} {
+		if job, _ := tenant.jobs.Get(id); job.Status != JOB_FAILED || job.Error != errJobStopped.Error() || job.Finished == 0 {
+			t.Errorf("Unexpected job after stop %+v", job)
+		}
+	}
+}
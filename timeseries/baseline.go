@@ -0,0 +1,147 @@
+package timeseries
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"net/url"
+	"strconv"
+)
+
+const (
+	BASELINE_PERIODS     = 4
+	BASELINE_MAX_PERIODS = 12
+	// width of the band in standard deviations of the history
+	BASELINE_WIDTH = 2.0
+)
+
+var baselinePeriods = map[string]int64{
+	"day":  DAY,
+	"week": WEEK,
+}
+
+type baselineParams struct {
+	period  int64
+	periods int
+	width   float64
+}
+
+// QueryResultBaseline holds [time, mean, lower, upper] of the same slots in
+// previous periods and [time, value] of points outside of the band
+type QueryResultBaseline struct {
+	Period    int64            `json:"period"`
+	Periods   int              `json:"periods"`
+	Data      [][4]interface{} `json:"data"`
+	Anomalies [][2]interface{} `json:"anomalies"`
+}
+
+func parseBaselineParams(query url.Values) (*baselineParams, error) {
+	name := query.Get("baseline")
+	if name == "" {
+		return nil, nil
+	}
+	period, ok := baselinePeriods[name]
+	if !ok {
+		return nil, errors.New(fmt.Sprintf("Invalid parameter baseline: %s", name))
+	}
+
+	params := &baselineParams{
+		period:  period,
+		periods: BASELINE_PERIODS,
+		width:   BASELINE_WIDTH,
+	}
+	if v := query.Get("baseline_periods"); v != "" {
+		if i, err := strconv.Atoi(v); err != nil || i < 2 || i > BASELINE_MAX_PERIODS {
+			return nil, errors.New(fmt.Sprintf("Invalid parameter: baseline_periods"))
+		} else {
+			params.periods = i
+		}
+	}
+	if v := query.Get("baseline_width"); v != "" {
+		if f, err := strconv.ParseFloat(v, 64); err != nil || f <= 0 {
+			return nil, errors.New(fmt.Sprintf("Invalid parameter: baseline_width"))
+		} else {
+			params.width = f
+		}
+	}
+
+	return params, nil
+}
+
+// AddBaseline plans queries of the HSM in previous periods, the slots of the
+// requested range are shifted by whole periods so they match current ones
+func (this *queryBatch) AddBaseline(hsm QueryParamsHSM, params *baselineParams) ([]*hsmQuery, error) {
+	history := make([]*hsmQuery, params.periods)
+	for k := range history {
+		shift := int64(k+1) * params.period
+		var err error
+		if history[k], err = this.AddRange(hsm, this.qsParams.startEpoch-shift, this.qsParams.endEpoch-shift); err != nil {
+			return nil, err
+		}
+	}
+
+	return history, nil
+}
+
+// at least two values of previous periods are needed for the band, periods
+// not divisible by the slot are matched to the nearest slot
+func baselineSeries(params *baselineParams, result *QueryResultData, history []*QueryResultData, slot int64) *QueryResultBaseline {
+	baseline := &QueryResultBaseline{
+		Period:    params.period,
+		Periods:   len(history),
+		Data:      make([][4]interface{}, 0, len(result.Data)),
+		Anomalies: make([][2]interface{}, 0),
+	}
+	if len(result.Data) == 0 {
+		return baseline
+	}
+	first, _ := result.Data[0][0].(int64)
+	if slot < 1 {
+		slot = 1
+	}
+
+	slots := make(map[int64][]float64)
+	for k, past := range history {
+		shift := int64(k+1) * params.period
+		for _, row := range past.Data {
+			ts, ok := row[0].(int64)
+			v, isValue := seriesValue(row[1])
+			if !ok || !isValue {
+				continue
+			}
+			n := int64(math.Floor(float64(ts+shift-first)/float64(slot) + 0.5))
+			slots[n] = append(slots[n], v)
+		}
+	}
+
+	for _, row := range result.Data {
+		ts, ok := row[0].(int64)
+		if !ok {
+			continue
+		}
+		values := slots[(ts-first)/slot]
+		if len(values) < 2 {
+			baseline.Data = append(baseline.Data, [4]interface{}{ts, nil, nil, nil})
+			continue
+		}
+
+		var sum float64
+		for _, v := range values {
+			sum += v
+		}
+		mean := sum / float64(len(values))
+		var variance float64
+		for _, v := range values {
+			variance += (v - mean) * (v - mean)
+		}
+		band := params.width * math.Sqrt(variance/float64(len(values)-1))
+		lower, upper := mean-band, mean+band
+		baseline.Data = append(baseline.Data, [4]interface{}{ts, mean, lower, upper})
+
+		if v, ok := seriesValue(row[1]); ok && (v < lower || v > upper) {
+			baseline.Anomalies = append(baseline.Anomalies, [2]interface{}{ts, row[1]})
+		}
+	}
+
+	return baseline
+}
@@ -0,0 +1,118 @@
+package timeseries
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestBaselineSeries(t *testing.T) {
+	result := &QueryResultData{
+		Data: [][2]interface{}{{int64(1000), json.Number("10")}, {int64(1100), json.Number("50")}, {int64(1200), nil}},
+	}
+	history := []*QueryResultData{
+		{Data: [][2]interface{}{{int64(1000 - DAY), json.Number("9")}, {int64(1100 - DAY), json.Number("10")}, {int64(1200 - DAY), json.Number("1")}}},
+		{Data: [][2]interface{}{{int64(1000 - 2*DAY), json.Number("10")}, {int64(1100 - 2*DAY), json.Number("10")}, {int64(1200 - 2*DAY), nil}}},
+		// matched to the nearest slot
+		{Data: [][2]interface{}{{int64(1030 - 3*DAY), json.Number("11")}, {int64(1130 - 3*DAY), json.Number("10")}}},
+	}
+
+	params := &baselineParams{period: DAY, periods: 3, width: 2}
+	baseline := baselineSeries(params, result, history, 100)
+	expected := [][4]interface{}{
+		{int64(1000), 10.0, 8.0, 12.0},
+		{int64(1100), 10.0, 10.0, 10.0},
+		{int64(1200), nil, nil, nil},
+	}
+	if len(baseline.Data) != len(expected) {
+		t.Fatalf("Unexpected baseline: %v", baseline.Data)
+	}
+	for i := range expected {
+		if baseline.Data[i] != expected[i] {
+			t.Errorf("Slot %d: expected %v got %v", i, expected[i], baseline.Data[i])
+		}
+	}
+	if len(baseline.Anomalies) != 1 || baseline.Anomalies[0][0] != int64(1100) {
+		t.Errorf("Unexpected anomalies: %v", baseline.Anomalies)
+	}
+}
+
+func TestQueryHandlerBaseline(t *testing.T) {
+	tenant, cleanup := newTestTenant(t)
+	defer cleanup()
+
+	if err := tenant.updateMetadata([][5]string{{"h1", "Interface", "in", "GAUGE", ""}}, time.Now().Unix()-10*DAY); err != nil {
+		t.Fatal(err)
+	}
+
+	const start = 1500000000
+	fake := newFakeInfluxDB(nil)
+	fake.rangeRows = func(from int64) [][]interface{} {
+		if k := (start - from) / DAY; k > 0 {
+			return [][]interface{}{{from, 10 + k}, {from + 600, 20}}
+		}
+		return [][]interface{}{{from, 12}, {from + 600, 100}}
+	}
+	defer fake.Close()
+	server := newTestQueryServer(tenant, fake.URL)
+
+	query := func(params string) (int, map[string]QueryResultData) {
+		w := httptest.NewRecorder()
+		server.QueryHandler(w, httptest.NewRequest("GET", "/query?start=1500000000&end=1500000600&fixed_time_slot=600&hsm=h1::Interface::in&"+params, nil), nil, tenant)
+
+		var results map[string]QueryResultData
+		if w.Code == 200 {
+			if err := json.Unmarshal(w.Body.Bytes(), &results); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return w.Code, results
+	}
+
+	code, results := query("baseline=day&baseline_periods=3")
+	if code != 200 {
+		t.Fatalf("Unexpected response %d", code)
+	}
+	result := results["h1::Interface::in"]
+	if len(result.Data) != 2 || result.Data[1][1] != 100.0 {
+		t.Errorf("Unexpected data: %v", result.Data)
+	}
+	baseline := result.Baseline
+	if baseline == nil || baseline.Period != DAY || baseline.Periods != 3 || len(baseline.Data) != 2 {
+		t.Fatalf("Unexpected baseline: %+v", baseline)
+	}
+	if row := baseline.Data[0]; row[1] != 12.0 || row[2] != 10.0 || row[3] != 14.0 {
+		t.Errorf("Unexpected band: %v", row)
+	}
+	if len(baseline.Anomalies) != 1 || baseline.Anomalies[0][0] != float64(start+600) {
+		t.Errorf("Unexpected anomalies: %v", baseline.Anomalies)
+	}
+
+	// previous periods are queried in the same request
+	requests := fake.Requests()
+	if len(requests) != 1 || strings.Count(requests[0], "GROUP BY time(600s)") != 4 {
+		t.Errorf("Unexpected requests: %v", requests)
+	}
+
+	// previous periods are cached apart from the current range
+	tenant.queryCache = NewQueryCache(time.Minute, 1000)
+	query("baseline=day&baseline_periods=3")
+	if _, results := query("baseline=day&baseline_periods=3"); results["h1::Interface::in"].Baseline.Data[0][1] != 12.0 {
+		t.Errorf("Unexpected cached baseline: %+v", results["h1::Interface::in"].Baseline)
+	}
+	if n := len(fake.Requests()); n != 2 {
+		t.Errorf("Expected cached baseline, got %d requests", n)
+	}
+	if entries, _ := tenant.queryCache.Len(); entries != 4 {
+		t.Errorf("Expected 4 cached ranges, got %d", entries)
+	}
+	tenant.queryCache = nil
+
+	for _, params := range []string{"baseline=month", "baseline=day&baseline_periods=1", "baseline=week&baseline_width=0"} {
+		if code, _ := query(params); code != 400 {
+			t.Errorf("%s: expected error, got %d", params, code)
+		}
+	}
+}
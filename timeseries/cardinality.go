@@ -0,0 +1,352 @@
+package timeseries
+
+import (
+	"database/sql"
+	"encoding/json"
+	"github.com/influxdata/influxdb/client/v2"
+	"github.com/julienschmidt/httprouter"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+)
+
+const (
+	CARDINALITY_TOP     = 20
+	CARDINALITY_MAX_TOP = 1000
+	// history returned by default
+	CARDINALITY_HISTORY_PERIOD = 30 * DAY
+	// history older than that is removed when new sample is recorded
+	CARDINALITY_HISTORY_RETENTION = 400 * DAY
+)
+
+type CardinalityEntry struct {
+	Host           string `json:"host"`
+	Service        string `json:"service,omitempty"`
+	Series         int    `json:"series"`
+	InfluxDBSeries int    `json:"influxdb_series,omitempty"`
+}
+
+type CardinalitySample struct {
+	RecordedAt     int64 `json:"recorded_at"`
+	Series         int   `json:"series"`
+	Hosts          int   `json:"hosts"`
+	InfluxDBSeries int   `json:"influxdb_series"`
+}
+
+type CardinalityReport struct {
+	CardinalitySample
+	Services      int                 `json:"services"`
+	InfluxDBError string              `json:"influxdb_error,omitempty"`
+	TopHosts      []CardinalityEntry  `json:"top_hosts"`
+	TopServices   []CardinalityEntry  `json:"top_services"`
+	History       []CardinalitySample `json:"history"`
+}
+
+func (this *SQLMetadataStore) MetadataCardinality() (series, hosts, services int, err error) {
+	err = this.db.QueryRow("SELECT COUNT(*), COUNT(DISTINCT host) FROM uoms").Scan(&series, &hosts)
+	if err != nil {
+		return
+	}
+	err = this.db.QueryRow("SELECT COUNT(*) FROM (SELECT DISTINCT host, service FROM uoms) hs").Scan(&services)
+
+	return
+}
+
+func (this *SQLMetadataStore) TopCardinality(limit int, byService bool) ([]CardinalityEntry, error) {
+	query := "SELECT host, '', COUNT(*) FROM uoms GROUP BY host ORDER BY COUNT(*) DESC, host LIMIT ?"
+	if byService {
+		query = "SELECT host, service, COUNT(*) FROM uoms GROUP BY host, service ORDER BY COUNT(*) DESC, host, service LIMIT ?"
+	}
+	rows, err := this.db.Query(query, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	entries := make([]CardinalityEntry, 0)
+	for rows.Next() {
+		var e CardinalityEntry
+		if err := rows.Scan(&e.Host, &e.Service, &e.Series); err != nil {
+			return nil, err
+		}
+		entries = append(entries, e)
+	}
+
+	return entries, rows.Err()
+}
+
+func numberToInt(v interface{}) (int, bool) {
+	switch n := v.(type) {
+	case json.Number:
+		i, err := n.Int64()
+		return int(i), err == nil
+	case float64:
+		return int(n), true
+	}
+
+	return 0, false
+}
+
+func (this *TimeseriesTenant) influxCardinality(db client.Client) (map[string]int, error) {
+	results, err := influxQuery(db, this.config.InfluxDB.Database, "SHOW SERIES EXACT CARDINALITY")
+	if err != nil {
+		return nil, err
+	}
+
+	hosts := make(map[string]int)
+	for _, result := range results {
+		for _, series := range result.Series {
+			for _, row := range series.Values {
+				if len(row) == 0 {
+					continue
+				}
+				if n, ok := numberToInt(row[0]); ok {
+					hosts[series.Name] += n
+				}
+			}
+		}
+	}
+
+	return hosts, nil
+}
+
+func (this *TimeseriesTenant) influxSeriesCount() (int, map[string]int, error) {
+	db, err := this.InfluxDBClient()
+	if err != nil {
+		return 0, nil, err
+	}
+
+	hosts, err := this.influxCardinality(db)
+	if err != nil {
+		return 0, nil, err
+	}
+	total := 0
+	for _, n := range hosts {
+		total += n
+	}
+
+	return total, hosts, nil
+}
+
+func (this *SQLMetadataStore) CardinalityHistory(since int64) ([]CardinalitySample, error) {
+	rows, err := this.db.Query(`
+        SELECT recorded_at, series, hosts, influxdb_series
+        FROM cardinality_history WHERE recorded_at >= ? ORDER BY recorded_at
+        `, since)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	samples := make([]CardinalitySample, 0)
+	for rows.Next() {
+		var s CardinalitySample
+		if err := rows.Scan(&s.RecordedAt, &s.Series, &s.Hosts, &s.InfluxDBSeries); err != nil {
+			return nil, err
+		}
+		samples = append(samples, s)
+	}
+
+	return samples, rows.Err()
+}
+
+// CardinalityReport counts series in metadata database and, if requested, in
+// InfluxDB; failure to query InfluxDB is reported but does not fail the report
+func (this *TimeseriesTenant) CardinalityReport(top int, historySince int64, withInfluxDB bool) (*CardinalityReport, error) {
+	report := &CardinalityReport{}
+	report.RecordedAt = time.Now().Unix()
+
+	var err error
+	if report.Series, report.Hosts, report.Services, err = this.store.MetadataCardinality(); err != nil {
+		return nil, err
+	}
+	if report.TopHosts, err = this.store.TopCardinality(top, false); err != nil {
+		return nil, err
+	}
+	if report.TopServices, err = this.store.TopCardinality(top, true); err != nil {
+		return nil, err
+	}
+	if report.History, err = this.store.CardinalityHistory(historySince); err != nil {
+		return nil, err
+	}
+
+	if !withInfluxDB {
+		return report, nil
+	}
+
+	total, hosts, err := this.influxSeriesCount()
+	if err != nil {
+		report.InfluxDBError = err.Error()
+		return report, nil
+	}
+	report.InfluxDBSeries = total
+	for i := range report.TopHosts {
+		report.TopHosts[i].InfluxDBSeries = hosts[report.TopHosts[i].Host]
+	}
+
+	// hosts with many series in InfluxDB may have few in metadata database,
+	// e.g. when tags multiply series
+	known := make(map[string]bool, len(report.TopHosts))
+	for _, e := range report.TopHosts {
+		known[e.Host] = true
+	}
+	names := make([]string, 0, len(hosts))
+	for host := range hosts {
+		names = append(names, host)
+	}
+	sort.Slice(names, func(i, j int) bool {
+		if hosts[names[i]] != hosts[names[j]] {
+			return hosts[names[i]] > hosts[names[j]]
+		}
+		return names[i] < names[j]
+	})
+	if len(names) > top {
+		names = names[:top]
+	}
+	for _, host := range names {
+		if known[host] {
+			continue
+		}
+		e := CardinalityEntry{Host: host, InfluxDBSeries: hosts[host]}
+		if e.Series, err = this.store.HostCardinality(host); err != nil {
+			return nil, err
+		}
+		report.TopHosts = append(report.TopHosts, e)
+	}
+
+	return report, nil
+}
+
+func (this *TimeseriesTenant) RecordCardinality() (*CardinalitySample, *CardinalitySample, error) {
+	sample := &CardinalitySample{RecordedAt: time.Now().Unix()}
+
+	var err error
+	if sample.Series, sample.Hosts, _, err = this.store.MetadataCardinality(); err != nil {
+		return nil, nil, err
+	}
+	if sample.InfluxDBSeries, _, err = this.influxSeriesCount(); err != nil {
+		this.log.Warning("Failed to count series of tenant %s in InfluxDB: %s", this.Name(), err)
+	}
+
+	previous, err := this.store.RecordCardinality(sample, sample.RecordedAt-CARDINALITY_HISTORY_RETENTION)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return sample, previous, nil
+}
+
+func (this *SQLMetadataStore) HostCardinality(host string) (int, error) {
+	var series int
+	err := this.db.QueryRow("SELECT COUNT(*) FROM uoms WHERE host = ?", host).Scan(&series)
+
+	return series, err
+}
+
+func (this *SQLMetadataStore) RecordCardinality(sample *CardinalitySample, retainSince int64) (*CardinalitySample, error) {
+	var previous *CardinalitySample
+	last := &CardinalitySample{}
+	err := this.db.QueryRow(`
+        SELECT recorded_at, series, hosts, influxdb_series
+        FROM cardinality_history ORDER BY recorded_at DESC LIMIT 1
+        `).Scan(&last.RecordedAt, &last.Series, &last.Hosts, &last.InfluxDBSeries)
+	if err == nil {
+		previous = last
+	} else if err != sql.ErrNoRows {
+		return nil, err
+	}
+
+	tx, err := this.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	_, err = tx.Exec(tx.dialect.replace("cardinality_history",
+		[]string{"recorded_at", "series", "hosts", "influxdb_series"}, []string{"recorded_at"}, "VALUES (?,?,?,?)"),
+		sample.RecordedAt, sample.Series, sample.Hosts, sample.InfluxDBSeries)
+	if err == nil {
+		_, err = tx.Exec("DELETE FROM cardinality_history WHERE recorded_at < ?", retainSince)
+	}
+	if err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+
+	return previous, tx.Commit()
+}
+
+func cardinalityGrowth(previous, current *CardinalitySample) float64 {
+	growth := func(prev, cur int) float64 {
+		if prev <= 0 {
+			return 0
+		}
+		return float64(cur-prev) * 100 / float64(prev)
+	}
+
+	g := growth(previous.Series, current.Series)
+	if g2 := growth(previous.InfluxDBSeries, current.InfluxDBSeries); g2 > g {
+		g = g2
+	}
+
+	return g
+}
+
+func (this *TimeseriesTenant) runCardinality(config *TimeseriesCardinalityConfig, stop <-chan struct{}) {
+	ticker := time.NewTicker(time.Duration(config.Interval) * time.Second)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+
+		sample, previous, err := this.RecordCardinality()
+		if err != nil {
+			this.log.Error("Failed to record series cardinality of tenant %s: %s", this.Name(), err)
+			continue
+		}
+		this.log.Info("Series cardinality of tenant %s: metadata %d, InfluxDB %d, hosts %d",
+			this.Name(), sample.Series, sample.InfluxDBSeries, sample.Hosts)
+
+		if previous == nil || config.GrowthWarning <= 0 {
+			continue
+		}
+		if growth := cardinalityGrowth(previous, sample); growth > config.GrowthWarning {
+			this.log.Warning("Series cardinality of tenant %s grew by %.1f%% since %s: metadata %d -> %d, InfluxDB %d -> %d",
+				this.Name(), growth, time.Unix(previous.RecordedAt, 0),
+				previous.Series, sample.Series, previous.InfluxDBSeries, sample.InfluxDBSeries)
+		}
+	}
+}
+
+func (this *TimeseriesServer) CardinalityHandler(w http.ResponseWriter, r *http.Request, ps httprouter.Params, tenant *TimeseriesTenant) {
+	query := r.URL.Query()
+
+	top := CARDINALITY_TOP
+	if v := query.Get("top"); v != "" {
+		var err error
+		if top, err = strconv.Atoi(v); err != nil || top < 1 || top > CARDINALITY_MAX_TOP {
+			this.sendHTTPError(w, http.StatusBadRequest, "Failed to parse query: Invalid parameter: top")
+			return
+		}
+	}
+
+	since := time.Now().Unix() - CARDINALITY_HISTORY_PERIOD
+	if v := query.Get("days"); v != "" {
+		days, err := strconv.Atoi(v)
+		if err != nil || days < 0 {
+			this.sendHTTPError(w, http.StatusBadRequest, "Failed to parse query: Invalid parameter: days")
+			return
+		}
+		since = time.Now().Unix() - int64(days)*DAY
+	}
+
+	report, err := tenant.CardinalityReport(top, since, query.Get("influxdb") != "0")
+	if err != nil {
+		this.sendHTTPError(w, http.StatusInternalServerError, "Failed to count series: %s", err)
+		return
+	}
+	this.sendJSON(w, report)
+}
@@ -0,0 +1,76 @@
+package timeseries
+
+import (
+	"encoding/json"
+	"github.com/influxdata/influxdb/client/v2"
+	"github.com/influxdata/influxdb/models"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestCardinalityReport(t *testing.T) {
+	tenant, cleanup := newTestTenant(t)
+	defer cleanup()
+	defer tenant.Close()
+
+	if err := tenant.updateMetadata([][5]string{
+		{"h1", "Disk", "/", "GAUGE", "MB"},
+		{"h1", "Disk", "/var", "GAUGE", "MB"},
+		{"h1", "Processes", "httpd", "GAUGE", ""},
+		{"h1", "Processes", "sshd", "GAUGE", ""},
+		{"h1", "Processes", "crond", "GAUGE", ""},
+		{"h2", "Disk", "/", "GAUGE", "MB"},
+	}, 100); err != nil {
+		t.Fatal(err)
+	}
+
+	report, err := tenant.CardinalityReport(1, 0, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Series != 6 || report.Hosts != 2 || report.Services != 3 {
+		t.Errorf("Unexpected totals %+v", report.CardinalitySample)
+	}
+	if len(report.TopHosts) != 1 || report.TopHosts[0] != (CardinalityEntry{Host: "h1", Series: 5}) {
+		t.Errorf("Unexpected top hosts %+v", report.TopHosts)
+	}
+	if len(report.TopServices) != 1 || report.TopServices[0] != (CardinalityEntry{Host: "h1", Service: "Processes", Series: 3}) {
+		t.Errorf("Unexpected top services %+v", report.TopServices)
+	}
+
+	influxdb := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		response := client.Response{Results: []client.Result{{Series: []models.Row{
+			{Name: "h1", Columns: []string{"count"}, Values: [][]interface{}{{7}}},
+			{Name: "h3", Columns: []string{"count"}, Values: [][]interface{}{{2}}},
+		}}}}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(response)
+	}))
+	defer influxdb.Close()
+	tenant.config.InfluxDB.Server = influxdb.URL
+
+	// the shared InfluxDB client of the tenant is kept open between reports
+	for i := 0; i < 2; i++ {
+		report, err := tenant.CardinalityReport(1, 0, true)
+		if err != nil || report.InfluxDBError != "" || report.InfluxDBSeries != 9 || report.TopHosts[0].InfluxDBSeries != 7 {
+			t.Fatalf("Unexpected report with InfluxDB %+v (%v)", report, err)
+		}
+	}
+	if tenant.influxdb == nil {
+		t.Error("Expected the shared InfluxDB client to be used")
+	}
+
+	if _, err := testMetadataDB(tenant).Exec("INSERT INTO cardinality_history VALUES (?,?,?,?)", time.Now().Unix()-DAY, 4, 2, 0); err != nil {
+		t.Fatal(err)
+	}
+	history, err := tenant.store.CardinalityHistory(0)
+	if err != nil || len(history) != 1 {
+		t.Fatalf("Expected 1 sample got %+v (%v)", history, err)
+	}
+	growth := cardinalityGrowth(&history[0], &CardinalitySample{Series: 6})
+	if growth != 50 {
+		t.Errorf("Expected 50%% growth got %f", growth)
+	}
+}
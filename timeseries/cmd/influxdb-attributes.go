@@ -0,0 +1,38 @@
+package main
+
+import (
+	"flag"
+	"github.com/ajgb/go-opsview/timeseries"
+	"log"
+	"os"
+)
+
+func main() {
+	conf_dir := flag.String("c", "./etc", "default configuration directory")
+	tenant_name := flag.String("t", "", "tenant name")
+	replace := flag.Bool("replace", false, "replace attributes of all hosts")
+	flag.Parse()
+
+	if flag.NArg() != 1 {
+		log.Fatalf("Usage: %s [-c confdir] [-t tenant] [-replace] attributes.json\n", os.Args[0])
+	}
+
+	server := &timeseries.TimeseriesServer{}
+	server.ReadConfig(*conf_dir)
+
+	tenant, err := server.OpenTenant(*tenant_name, "influxdb-attributes")
+	if err != nil {
+		log.Fatalf("Failed to open tenant: %s\n", err)
+	}
+	defer tenant.CloseMetadataDB()
+
+	f, err := os.Open(flag.Arg(0))
+	if err != nil {
+		log.Fatalf("Failed to open attributes file: %s\n", err)
+	}
+	defer f.Close()
+
+	if err := tenant.ImportHostsAttributes(f, *replace); err != nil {
+		log.Fatalf("Failed to import host attributes: %s\n", err)
+	}
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"github.com/ajgb/go-opsview/timeseries"
+	"log"
+	"os"
+	"time"
+)
+
+func main() {
+	conf_dir := flag.String("c", "./etc", "default configuration directory")
+	tenant_name := flag.String("t", "", "tenant name")
+	top := flag.Int("top", timeseries.CARDINALITY_TOP, "number of hosts and services with most series to list")
+	days := flag.Int("days", 30, "days of recorded history to show")
+	record := flag.Bool("record", false, "record current number of series in history")
+	as_json := flag.Bool("json", false, "print report as JSON")
+	flag.Parse()
+
+	if flag.NArg() != 0 || *top < 1 {
+		log.Fatalf("Usage: %s [-c confdir] [-t tenant] [-top n] [-days n] [-record] [-json]\n", os.Args[0])
+	}
+
+	server := &timeseries.TimeseriesServer{}
+	server.ReadConfig(*conf_dir)
+
+	tenant, err := server.OpenTenant(*tenant_name, "influxdb-cardinality")
+	if err != nil {
+		log.Fatalf("Failed to open tenant: %s\n", err)
+	}
+	defer tenant.CloseMetadataDB()
+
+	if *record {
+		if _, _, err := tenant.RecordCardinality(); err != nil {
+			log.Fatalf("Failed to record series cardinality: %s\n", err)
+		}
+	}
+
+	report, err := tenant.CardinalityReport(*top, time.Now().Unix()-int64(*days)*timeseries.DAY, true)
+	if err != nil {
+		log.Fatalf("Failed to count series: %s\n", err)
+	}
+
+	if *as_json {
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		encoder.Encode(report)
+		return
+	}
+
+	fmt.Printf("Series: %d in metadata, %d in InfluxDB\n", report.Series, report.InfluxDBSeries)
+	fmt.Printf("Hosts: %d, services: %d\n", report.Hosts, report.Services)
+	if report.InfluxDBError != "" {
+		fmt.Printf("InfluxDB error: %s\n", report.InfluxDBError)
+	}
+
+	fmt.Printf("\nTop hosts:\n%10s %10s  %s\n", "metadata", "influxdb", "host")
+	for _, e := range report.TopHosts {
+		fmt.Printf("%10d %10d  %s\n", e.Series, e.InfluxDBSeries, e.Host)
+	}
+
+	fmt.Printf("\nTop services:\n%10s  %s\n", "metadata", "host::service")
+	for _, e := range report.TopServices {
+		fmt.Printf("%10d  %s::%s\n", e.Series, e.Host, e.Service)
+	}
+
+	if len(report.History) > 0 {
+		fmt.Printf("\nHistory:\n%-20s %10s %10s %8s\n", "time", "metadata", "influxdb", "hosts")
+		for _, s := range report.History {
+			fmt.Printf("%-20s %10d %10d %8d\n", time.Unix(s.RecordedAt, 0).Format("2006-01-02 15:04:05"), s.Series, s.InfluxDBSeries, s.Hosts)
+		}
+	}
+}
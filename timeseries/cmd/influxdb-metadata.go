@@ -0,0 +1,117 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"github.com/ajgb/go-opsview/timeseries"
+	"io"
+	"log"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+func usage() {
+	fmt.Fprintf(os.Stderr, "Usage: %s export [-c confdir] [-t tenant] [-format json|csv] [filters] [file]\n", os.Args[0])
+	fmt.Fprintf(os.Stderr, "       %s import [-c confdir] [-t tenant] [-format json|csv] [-replace [filters]] [-allow-unknown-uom] file\n", os.Args[0])
+	os.Exit(2)
+}
+
+// format defaults to file extension, json otherwise
+func detectFormat(format, file string) string {
+	if format != "" {
+		return format
+	}
+	if strings.ToLower(filepath.Ext(file)) == ".csv" {
+		return timeseries.METADATA_FORMAT_CSV
+	}
+
+	return timeseries.METADATA_FORMAT_JSON
+}
+
+func main() {
+	if len(os.Args) < 2 || (os.Args[1] != "export" && os.Args[1] != "import") {
+		usage()
+	}
+	command := os.Args[1]
+
+	flags := flag.NewFlagSet(command, flag.ExitOnError)
+	conf_dir := flags.String("c", "./etc", "default configuration directory")
+	tenant_name := flags.String("t", "", "tenant name")
+	format := flags.String("format", "", "file format: json or csv (default by file extension)")
+	replace := flags.Bool("replace", false, "remove metadata matching filters but missing in the file")
+	allow_unknown_uom := flags.Bool("allow-unknown-uom", false, "accept uoms missing in the conversion table")
+	filter_names := []string{"host", "service", "metric", "dstype", "uom"}
+	filter_values := make([]*string, len(filter_names))
+	for i, name := range filter_names {
+		filter_values[i] = flags.String(name, "", name+" filter")
+	}
+	match := flags.String("match", "substring", "host, service and metric filters match: substring, glob or regex")
+	ignore_case := flags.Bool("ignore-case", false, "case insensitive filters")
+	flags.Parse(os.Args[2:])
+
+	if flags.NArg() > 1 || (command == "import" && flags.NArg() != 1) {
+		usage()
+	}
+	filters := url.Values{}
+	for i, name := range filter_names {
+		filters.Set(name, *filter_values[i])
+	}
+	filters.Set("match", *match)
+	if *ignore_case {
+		filters.Set("ignore_case", "1")
+	}
+	filter, err := timeseries.ParseMetadataFilter(filters)
+	if err != nil {
+		log.Fatalf("Invalid filter: %s\n", err)
+	}
+
+	server := &timeseries.TimeseriesServer{}
+	server.ReadConfig(*conf_dir)
+
+	tenant, err := server.OpenTenant(*tenant_name, "influxdb-metadata")
+	if err != nil {
+		log.Fatalf("Failed to open tenant: %s\n", err)
+	}
+	defer tenant.CloseMetadataDB()
+
+	if command == "export" {
+		var w io.Writer = os.Stdout
+		if flags.NArg() == 1 {
+			f, err := os.Create(flags.Arg(0))
+			if err != nil {
+				log.Fatalf("Failed to create metadata file: %s\n", err)
+			}
+			defer f.Close()
+			w = f
+		}
+
+		n, err := tenant.ExportMetadata(w, detectFormat(*format, flags.Arg(0)), filter)
+		if err != nil {
+			log.Fatalf("Failed to export metadata: %s\n", err)
+		}
+		log.Printf("Exported %d entries\n", n)
+		return
+	}
+
+	f, err := os.Open(flags.Arg(0))
+	if err != nil {
+		log.Fatalf("Failed to open metadata file: %s\n", err)
+	}
+	defer f.Close()
+
+	data, err := timeseries.ReadMetadata(f, detectFormat(*format, flags.Arg(0)))
+	if err != nil {
+		log.Fatalf("Failed to read metadata file: %s\n", err)
+	}
+	if err := timeseries.ValidateMetadata(data, *allow_unknown_uom); err != nil {
+		log.Fatalf("%s\n", err)
+	}
+
+	report, err := tenant.ImportMetadata(data, *replace, filter)
+	if err != nil {
+		log.Fatalf("Failed to import metadata: %s\n", err)
+	}
+	log.Printf("Imported %d entries, removed %d\n", report.Imported, report.Removed)
+}
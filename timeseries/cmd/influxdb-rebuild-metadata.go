@@ -0,0 +1,39 @@
+package main
+
+import (
+	"flag"
+	"github.com/ajgb/go-opsview/timeseries"
+	"log"
+	"os"
+)
+
+func main() {
+	conf_dir := flag.String("c", "./etc", "default configuration directory")
+	tenant_name := flag.String("t", "", "tenant name")
+	dry_run := flag.Bool("n", false, "only list metadata which would be added")
+	flag.Parse()
+
+	if flag.NArg() != 0 {
+		log.Fatalf("Usage: %s [-c confdir] [-t tenant] [-n]\n", os.Args[0])
+	}
+
+	server := &timeseries.TimeseriesServer{}
+	server.ReadConfig(*conf_dir)
+
+	tenant, err := server.OpenTenant(*tenant_name, "influxdb-rebuild-metadata")
+	if err != nil {
+		log.Fatalf("Failed to open tenant: %s\n", err)
+	}
+	defer tenant.CloseMetadataDB()
+
+	report, err := tenant.RebuildMetadata(server.MetadataRebuildRules(), *dry_run)
+	if err != nil {
+		log.Fatalf("Failed to rebuild metadata: %s\n", err)
+	}
+
+	for _, i := range report.Entries {
+		log.Printf("%s::%s::%s dstype %s uom %q\n", i[0], i[1], i[2], i[3], i[4])
+	}
+	log.Printf("Series in InfluxDB: %d, already known: %d, added: %d (%d without matching rule)\n",
+		report.Series, report.Existing, report.Added, report.Unmatched)
+}
@@ -2,10 +2,12 @@ package timeseries
 
 import (
 	"errors"
+	"fmt"
 	"github.com/olebedev/config"
 	"io/ioutil"
 	"log"
 	"path"
+	"path/filepath"
 	"strconv"
 )
 
@@ -17,12 +19,61 @@ type TimeseriesInfluxDBConfig struct {
 	RetentionPolicy string
 }
 
+// TimeseriesMetadataRule sets dstype and uom of series matching service and
+// metric glob patterns when metadata is rebuilt from InfluxDB
+type TimeseriesMetadataRule struct {
+	Service string
+	Metric  string
+	Dstype  string
+	Uom     string
+}
+
+type TimeseriesMetadataConfig struct {
+	Driver       string
+	DSN          string
+	RebuildRules []TimeseriesMetadataRule
+}
+
+type TimeseriesTenantConfig struct {
+	Name           string
+	User           string
+	Password       string
+	AdminUser      string
+	AdminPassword  string
+	MetadataDriver string
+	MetadataDB     string
+	InfluxDB       TimeseriesInfluxDBConfig
+}
+
+type TimeseriesQueryCacheConfig struct {
+	TTL       int
+	MaxPoints int
+}
+
+type TimeseriesCardinalityConfig struct {
+	Interval      int
+	GrowthWarning float64
+}
+
+type TimeseriesPurgeConfig struct {
+	UnseenDays int
+	Interval   int
+	Mode       string
+	DropSeries bool
+}
+
 type TimeseriesServerUpdatesConfig struct {
-	Host                 string
-	Ports                []int
-	LogLevel             string
-	LogFacility          string
-	ExpectedResultsCount int
+	Host                  string
+	Ports                 []int
+	LogLevel              string
+	LogFacility           string
+	ExpectedResultsCount  int
+	HostAttributesRefresh int
+	MetadataFlushInterval int
+	MetadataQueueSize     int
+	LastSeenResolution    int
+	Purge                 TimeseriesPurgeConfig
+	Cardinality           TimeseriesCardinalityConfig
 }
 
 type TimeseriesServerQueriesConfig struct {
@@ -35,19 +86,31 @@ type TimeseriesServerQueriesConfig struct {
 	MinTimeSlot        int64
 	FixedTimeSlot      int64
 	CounterMetricsMode string
+	Aggregate          string
+	MetadataRefresh    int
+	BatchSize          int
+	Concurrency        int
+	Cache              TimeseriesQueryCacheConfig
+	MaxPatternMatches  int
+	TopMaxCandidates   int
 }
 
 type TimeseriesServerConfig struct {
-	User     string
-	Password string
-	Updates  TimeseriesServerUpdatesConfig
-	Queries  TimeseriesServerQueriesConfig
+	User            string
+	Password        string
+	AdminUser       string
+	AdminPassword   string
+	ShutdownTimeout int
+	Updates         TimeseriesServerUpdatesConfig
+	Queries         TimeseriesServerQueriesConfig
 }
 
 type TimeseriesConfig struct {
 	DataDir  string
 	Server   TimeseriesServerConfig
 	InfluxDB TimeseriesInfluxDBConfig
+	Metadata TimeseriesMetadataConfig
+	Tenants  []TimeseriesTenantConfig
 }
 
 const (
@@ -75,6 +138,15 @@ func (this *TimeseriesConfig) extractSettings(data *config.Config) (fail error)
 	if v, err := data.String("timeseriesinfluxdb.server.password"); err == nil {
 		this.Server.Password = v
 	}
+	if v, err := data.String("timeseriesinfluxdb.server.admin_user"); err == nil {
+		this.Server.AdminUser = v
+	}
+	if v, err := data.String("timeseriesinfluxdb.server.admin_password"); err == nil {
+		this.Server.AdminPassword = v
+	}
+	if v, err := data.Int("timeseriesinfluxdb.server.shutdown_timeout"); err == nil {
+		this.Server.ShutdownTimeout = v
+	}
 	if v, err := data.String("timeseriesinfluxdb.data_dir"); err == nil {
 		this.DataDir = v
 	}
@@ -93,6 +165,26 @@ func (this *TimeseriesConfig) extractSettings(data *config.Config) (fail error)
 	if v, err := data.String("timeseriesinfluxdb.influxdb.retention_policy"); err == nil {
 		this.InfluxDB.RetentionPolicy = v
 	}
+	if v, err := data.String("timeseriesinfluxdb.metadata.driver"); err == nil && v != "" {
+		this.Metadata.Driver = v
+	}
+	if v, err := data.String("timeseriesinfluxdb.metadata.dsn"); err == nil {
+		this.Metadata.DSN = v
+	}
+	if v, err := data.List("timeseriesinfluxdb.metadata.rebuild_rules"); err == nil {
+		this.Metadata.RebuildRules = make([]TimeseriesMetadataRule, len(v))
+		for i := range v {
+			r, err := data.Get(fmt.Sprintf("timeseriesinfluxdb.metadata.rebuild_rules.%d", i))
+			if err != nil {
+				return err
+			}
+			rule := &this.Metadata.RebuildRules[i]
+			rule.Service, _ = r.String("service")
+			rule.Metric, _ = r.String("metric")
+			rule.Dstype, _ = r.String("dstype")
+			rule.Uom, _ = r.String("uom")
+		}
+	}
 	if v, err := data.String("timeseriesinfluxdb.server.queries.default_parameters.fill_option"); err == nil {
 		if v == "linear" || v == "none" || v == "null" || v == "previous" {
 			this.Server.Queries.FillOption = v
@@ -118,6 +210,11 @@ func (this *TimeseriesConfig) extractSettings(data *config.Config) (fail error)
 			this.Server.Queries.CounterMetricsMode = v
 		}
 	}
+	if v, err := data.String("timeseriesinfluxdb.server.queries.default_parameters.aggregate"); err == nil {
+		if _, err := parseQueryAggregate(v); err == nil {
+			this.Server.Queries.Aggregate = v
+		}
+	}
 	if v, err := data.String("timeseriesinfluxdb.server.updates.logging.loggers.opsview.level"); err == nil {
 		this.Server.Updates.LogLevel = v
 	}
@@ -130,6 +227,38 @@ func (this *TimeseriesConfig) extractSettings(data *config.Config) (fail error)
 	if v, err := data.Int("timeseriesinfluxdb.server.updates.expected_results_count"); err == nil {
 		this.Server.Updates.ExpectedResultsCount = v
 	}
+	if v, err := data.Int("timeseriesinfluxdb.server.updates.host_attributes_refresh"); err == nil {
+		this.Server.Updates.HostAttributesRefresh = v
+	}
+	if v, err := data.Int("timeseriesinfluxdb.server.updates.metadata.flush_interval"); err == nil && v > 0 {
+		this.Server.Updates.MetadataFlushInterval = v
+	}
+	if v, err := data.Int("timeseriesinfluxdb.server.updates.metadata.queue_size"); err == nil && v > 0 {
+		this.Server.Updates.MetadataQueueSize = v
+	}
+	if v, err := data.Int("timeseriesinfluxdb.server.updates.metadata.last_seen_resolution"); err == nil && v > 0 {
+		this.Server.Updates.LastSeenResolution = v
+	}
+	if v, err := data.Int("timeseriesinfluxdb.server.updates.metadata.purge.unseen_days"); err == nil && v >= 0 {
+		this.Server.Updates.Purge.UnseenDays = v
+	}
+	if v, err := data.Int("timeseriesinfluxdb.server.updates.metadata.purge.interval"); err == nil && v > 0 {
+		this.Server.Updates.Purge.Interval = v
+	}
+	if v, err := data.String("timeseriesinfluxdb.server.updates.metadata.purge.mode"); err == nil {
+		if v == PURGE_REPORT || v == PURGE_DELETE || v == PURGE_ARCHIVE {
+			this.Server.Updates.Purge.Mode = v
+		}
+	}
+	if v, err := data.Bool("timeseriesinfluxdb.server.updates.metadata.purge.drop_series"); err == nil {
+		this.Server.Updates.Purge.DropSeries = v
+	}
+	if v, err := data.Int("timeseriesinfluxdb.server.updates.metadata.cardinality.interval"); err == nil && v >= 0 {
+		this.Server.Updates.Cardinality.Interval = v
+	}
+	if v, err := data.Float64("timeseriesinfluxdb.server.updates.metadata.cardinality.growth_warning"); err == nil && v >= 0 {
+		this.Server.Updates.Cardinality.GrowthWarning = v
+	}
 	if v, err := data.List("timeseriesinfluxdb.server.updates.workers"); err == nil {
 		size := len(v)
 		this.Server.Updates.Ports = make([]int, size)
@@ -150,6 +279,163 @@ func (this *TimeseriesConfig) extractSettings(data *config.Config) (fail error)
 	if v, err := data.Int("timeseriesinfluxdb.server.queries.port"); err == nil {
 		this.Server.Queries.Port = v
 	}
+	if v, err := data.Int("timeseriesinfluxdb.server.queries.metadata_refresh"); err == nil && v > 0 {
+		this.Server.Queries.MetadataRefresh = v
+	}
+	if v, err := data.Int("timeseriesinfluxdb.server.queries.batch_size"); err == nil && v > 0 {
+		this.Server.Queries.BatchSize = v
+	}
+	if v, err := data.Int("timeseriesinfluxdb.server.queries.concurrency"); err == nil && v > 0 {
+		this.Server.Queries.Concurrency = v
+	}
+	if v, err := data.Int("timeseriesinfluxdb.server.queries.max_pattern_matches"); err == nil && v > 0 {
+		this.Server.Queries.MaxPatternMatches = v
+	}
+	if v, err := data.Int("timeseriesinfluxdb.server.queries.top_max_candidates"); err == nil && v > 0 {
+		this.Server.Queries.TopMaxCandidates = v
+	}
+	if v, err := data.Int("timeseriesinfluxdb.server.queries.cache.ttl"); err == nil {
+		this.Server.Queries.Cache.TTL = v
+	}
+	if v, err := data.Int("timeseriesinfluxdb.server.queries.cache.max_points"); err == nil {
+		this.Server.Queries.Cache.MaxPoints = v
+	}
+	if v, err := data.List("timeseriesinfluxdb.tenants"); err == nil {
+		this.Tenants = make([]TimeseriesTenantConfig, len(v))
+		for i := range v {
+			t, err := data.Get(fmt.Sprintf("timeseriesinfluxdb.tenants.%d", i))
+			if err != nil {
+				return err
+			}
+			if v, err := t.String("name"); err == nil {
+				this.Tenants[i].Name = v
+			}
+			if v, err := t.String("user"); err == nil {
+				this.Tenants[i].User = v
+			}
+			if v, err := t.String("password"); err == nil {
+				this.Tenants[i].Password = v
+			}
+			if v, err := t.String("admin_user"); err == nil {
+				this.Tenants[i].AdminUser = v
+			}
+			if v, err := t.String("admin_password"); err == nil {
+				this.Tenants[i].AdminPassword = v
+			}
+			if v, err := t.String("metadata_driver"); err == nil {
+				this.Tenants[i].MetadataDriver = v
+			}
+			if v, err := t.String("metadata_db"); err == nil {
+				this.Tenants[i].MetadataDB = v
+			}
+			if v, err := t.String("influxdb.server"); err == nil {
+				this.Tenants[i].InfluxDB.Server = v
+			}
+			if v, err := t.String("influxdb.user"); err == nil {
+				this.Tenants[i].InfluxDB.User = v
+			}
+			if v, err := t.String("influxdb.password"); err == nil {
+				this.Tenants[i].InfluxDB.Password = v
+			}
+			if v, err := t.String("influxdb.database"); err == nil {
+				this.Tenants[i].InfluxDB.Database = v
+			}
+			if v, err := t.String("influxdb.retention_policy"); err == nil {
+				this.Tenants[i].InfluxDB.RetentionPolicy = v
+			}
+		}
+	}
+
+	return nil
+}
+
+// setupTenants fills in tenant settings not given explicitly in the
+// configuration. Without any tenants configured a single "default" tenant is
+// created from the server credentials and the global InfluxDB settings.
+func (this *TimeseriesConfig) setupTenants() error {
+	if len(this.Tenants) == 0 {
+		dsn := this.Metadata.DSN
+		if dsn == "" && (this.Metadata.Driver == "" || this.Metadata.Driver == METADATA_SQLITE) {
+			dsn = SQLITE_DB
+		}
+		this.Tenants = []TimeseriesTenantConfig{
+			TimeseriesTenantConfig{
+				Name:           "default",
+				User:           this.Server.User,
+				Password:       this.Server.Password,
+				AdminUser:      this.Server.AdminUser,
+				AdminPassword:  this.Server.AdminPassword,
+				MetadataDriver: this.Metadata.Driver,
+				MetadataDB:     dsn,
+				InfluxDB:       this.InfluxDB,
+			},
+		}
+	}
+
+	names := make(map[string]bool)
+	users := make(map[string]bool)
+	for i := range this.Tenants {
+		t := &this.Tenants[i]
+
+		if t.Name == "" {
+			return errors.New(fmt.Sprintf("Tenant #%d has no name", i+1))
+		}
+		if names[t.Name] {
+			return errors.New(fmt.Sprintf("Duplicated tenant name: %s", t.Name))
+		}
+		names[t.Name] = true
+
+		if t.User == "" {
+			return errors.New(fmt.Sprintf("Tenant %s has no user", t.Name))
+		}
+		if users[t.User] {
+			return errors.New(fmt.Sprintf("Tenant %s: user %s already assigned to another tenant", t.Name, t.User))
+		}
+		users[t.User] = true
+
+		// admin endpoints are not available to tenant credentials
+		if t.AdminUser != "" {
+			if users[t.AdminUser] {
+				return errors.New(fmt.Sprintf("Tenant %s: admin user %s already assigned to another user", t.Name, t.AdminUser))
+			}
+			users[t.AdminUser] = true
+		}
+
+		if t.MetadataDriver == "" {
+			t.MetadataDriver = this.Metadata.Driver
+		}
+		switch t.MetadataDriver {
+		case "", METADATA_SQLITE:
+			t.MetadataDriver = METADATA_SQLITE
+			if t.MetadataDB == "" {
+				t.MetadataDB = fmt.Sprintf("+%s.metadata.db", t.Name)
+			}
+			if !filepath.IsAbs(t.MetadataDB) {
+				t.MetadataDB = filepath.Join(this.DataDir, t.MetadataDB)
+			}
+		case METADATA_POSTGRES, METADATA_MYSQL:
+			// tenants must not share tables
+			if t.MetadataDB == "" {
+				return errors.New(fmt.Sprintf("Tenant %s: metadata_db is required with %s metadata driver", t.Name, t.MetadataDriver))
+			}
+		default:
+			return errors.New(fmt.Sprintf("Tenant %s: unsupported metadata driver: %s", t.Name, t.MetadataDriver))
+		}
+		// credentials of the global server are not sent to other servers
+		if t.InfluxDB.Server == "" {
+			t.InfluxDB.Server = this.InfluxDB.Server
+			if t.InfluxDB.User == "" && t.InfluxDB.Password == "" {
+				t.InfluxDB.User = this.InfluxDB.User
+				t.InfluxDB.Password = this.InfluxDB.Password
+			}
+		}
+		if t.InfluxDB.Database == "" {
+			t.InfluxDB.Database = t.Name
+		}
+		if t.InfluxDB.RetentionPolicy == "" {
+			t.InfluxDB.RetentionPolicy = this.InfluxDB.RetentionPolicy
+		}
+	}
 
 	return nil
 }
@@ -167,14 +453,29 @@ func ReadConfig(confdir string) *TimeseriesConfig {
 
 	conf := TimeseriesConfig{
 		Server: TimeseriesServerConfig{
-			User:     "opsview",
-			Password: "opsview",
+			User:            "opsview",
+			Password:        "opsview",
+			ShutdownTimeout: 30,
 			Updates: TimeseriesServerUpdatesConfig{
-				Host:                 "127.0.0.1",
-				Ports:                []int{1640, 1641, 1642, 1643},
-				ExpectedResultsCount: 500,
-				LogLevel:             DefaultLogLevel,
-				LogFacility:          DefaultLogFacility,
+				Host:                  "127.0.0.1",
+				Ports:                 []int{1640, 1641, 1642, 1643},
+				ExpectedResultsCount:  500,
+				HostAttributesRefresh: 60,
+				MetadataFlushInterval: 5,
+				MetadataQueueSize:     100000,
+				LastSeenResolution:    3600,
+				Purge: TimeseriesPurgeConfig{
+					UnseenDays: 0,
+					Interval:   DAY,
+					Mode:       PURGE_REPORT,
+					DropSeries: false,
+				},
+				Cardinality: TimeseriesCardinalityConfig{
+					Interval:      HOUR,
+					GrowthWarning: 20,
+				},
+				LogLevel:    DefaultLogLevel,
+				LogFacility: DefaultLogFacility,
 			},
 			Queries: TimeseriesServerQueriesConfig{
 				Host:               "127.0.0.1",
@@ -186,9 +487,22 @@ func ReadConfig(confdir string) *TimeseriesConfig {
 				MinTimeSlot:        0,
 				FixedTimeSlot:      0,
 				CounterMetricsMode: "per_second",
+				Aggregate:          "mean",
+				MetadataRefresh:    10,
+				BatchSize:          QUERY_BATCH_SIZE,
+				Concurrency:        QUERY_CONCURRENCY,
+				MaxPatternMatches:  100,
+				TopMaxCandidates:   1000,
+				Cache: TimeseriesQueryCacheConfig{
+					TTL:       60,
+					MaxPoints: 1000000,
+				},
 			},
 		},
 		DataDir: "/opt/opsview/timeseriesinfluxdb/var/data",
+		Metadata: TimeseriesMetadataConfig{
+			Driver: METADATA_SQLITE,
+		},
 		InfluxDB: TimeseriesInfluxDBConfig{
 			User:            "",
 			Password:        "",
@@ -212,5 +526,9 @@ func ReadConfig(confdir string) *TimeseriesConfig {
 		}
 	}
 
+	if err := conf.setupTenants(); err != nil {
+		log.Fatalf("Invalid tenants configuration: %s\n", err)
+	}
+
 	return &conf
 }
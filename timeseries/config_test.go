@@ -0,0 +1,96 @@
+package timeseries
+
+import (
+	"github.com/olebedev/config"
+	"testing"
+)
+
+func TestSetupTenants(t *testing.T) {
+	data, err := config.ParseYaml(`
+timeseriesinfluxdb:
+    server:
+        user: opsview
+        password: secret
+    data_dir: /var/data
+    influxdb:
+        server: http://127.0.0.1:8086
+        user: influx
+        password: influxpw
+        database: opsview
+        retention_policy: autogen
+    tenants:
+        - name: customer1
+          user: c1
+          password: p1
+          admin_user: c1admin
+          admin_password: a1
+        - name: customer2
+          user: c2
+          password: p2
+          metadata_db: /srv/c2.db
+          influxdb:
+              server: http://10.0.0.2:8086
+              database: c2data
+              retention_policy: weekly
+`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	conf := TimeseriesConfig{}
+	if err := conf.extractSettings(data); err != nil {
+		t.Fatal(err)
+	}
+	if err := conf.setupTenants(); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []TimeseriesTenantConfig{
+		{"customer1", "c1", "p1", "c1admin", "a1", METADATA_SQLITE, "/var/data/+customer1.metadata.db", TimeseriesInfluxDBConfig{"http://127.0.0.1:8086", "influx", "influxpw", "customer1", "autogen"}},
+		{"customer2", "c2", "p2", "", "", METADATA_SQLITE, "/srv/c2.db", TimeseriesInfluxDBConfig{"http://10.0.0.2:8086", "", "", "c2data", "weekly"}},
+	}
+	if len(conf.Tenants) != len(expected) {
+		t.Fatalf("Expected %d tenants got %d", len(expected), len(conf.Tenants))
+	}
+	for i, tenant := range conf.Tenants {
+		if tenant != expected[i] {
+			t.Errorf("Expected %+v got %+v", expected[i], tenant)
+		}
+	}
+
+	conf = TimeseriesConfig{
+		DataDir:  "/var/data",
+		Server:   TimeseriesServerConfig{User: "opsview", Password: "secret"},
+		InfluxDB: TimeseriesInfluxDBConfig{Database: "opsview", RetentionPolicy: "default"},
+	}
+	if err := conf.setupTenants(); err != nil {
+		t.Fatal(err)
+	}
+	if len(conf.Tenants) != 1 || conf.Tenants[0].User != "opsview" || conf.Tenants[0].MetadataDB != "/var/data/"+SQLITE_DB || conf.Tenants[0].InfluxDB.Database != "opsview" {
+		t.Errorf("Unexpected default tenant %+v", conf.Tenants)
+	}
+
+	conf.Tenants = []TimeseriesTenantConfig{{Name: "a", User: "u"}, {Name: "b", User: "u"}}
+	if err := conf.setupTenants(); err == nil {
+		t.Errorf("Expected error for tenants sharing user")
+	}
+
+	conf.Tenants = []TimeseriesTenantConfig{{Name: "a", User: "u", AdminUser: "admin"}, {Name: "b", User: "admin"}}
+	if err := conf.setupTenants(); err == nil {
+		t.Errorf("Expected error for admin user shared with tenant user")
+	}
+
+	conf.Tenants = []TimeseriesTenantConfig{{Name: "a", User: "u", MetadataDriver: METADATA_POSTGRES}}
+	if err := conf.setupTenants(); err == nil {
+		t.Errorf("Expected error for postgres tenant without metadata_db")
+	}
+
+	conf.Tenants = nil
+	conf.Metadata = TimeseriesMetadataConfig{Driver: METADATA_MYSQL, DSN: "ts:secret@tcp(db:3306)/metadata"}
+	if err := conf.setupTenants(); err != nil {
+		t.Fatal(err)
+	}
+	if conf.Tenants[0].MetadataDriver != METADATA_MYSQL || conf.Tenants[0].MetadataDB != conf.Metadata.DSN {
+		t.Errorf("Unexpected default tenant %+v", conf.Tenants[0])
+	}
+}
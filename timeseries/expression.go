@@ -0,0 +1,404 @@
+package timeseries
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// functions aggregating all series of their arguments, HSMs in arguments may
+// be patterns or attribute selectors matching any number of series
+var expressionFunctions = map[string]string{
+	"sum":  "sum",
+	"avg":  "mean",
+	"mean": "mean",
+	"max":  "max",
+	"min":  "min",
+}
+
+// queryExpression is a series derived from results of HSMs referenced in
+// braces, e.g. "usage={h1::Disk::used} / {h1::Disk::size} * 100" or
+// "load=avg({web*::CPU::load1})". In a query string "+" has to be sent as
+// %2B, unescaped it is decoded as a space.
+type queryExpression struct {
+	name string
+	root exprNode
+	refs []QueryParamsHSM
+}
+
+type exprNode interface {
+	eval(series map[string][]*QueryResultData) (exprValue, error)
+}
+
+// exprValue is a series or a constant if series is nil
+type exprValue struct {
+	series *QueryResultData
+	scalar float64
+}
+
+type exprNumber struct {
+	value float64
+}
+
+type exprRef struct {
+	hsm QueryParamsHSM
+}
+
+type exprBinary struct {
+	op          byte
+	left, right exprNode
+}
+
+type exprCall struct {
+	function string
+	args     []exprNode
+}
+
+func (this exprNumber) eval(series map[string][]*QueryResultData) (exprValue, error) {
+	return exprValue{scalar: this.value}, nil
+}
+
+func (this exprRef) eval(series map[string][]*QueryResultData) (exprValue, error) {
+	matched := series[this.hsm.HSM]
+	if len(matched) != 1 {
+		return exprValue{}, errors.New(fmt.Sprintf("%s matches %d series, use sum, avg, min or max", this.hsm.HSM, len(matched)))
+	}
+
+	return exprValue{series: matched[0]}, nil
+}
+
+func (this exprCall) eval(series map[string][]*QueryResultData) (exprValue, error) {
+	args := make([]*QueryResultData, 0, len(this.args))
+	for _, arg := range this.args {
+		if ref, ok := arg.(exprRef); ok {
+			args = append(args, series[ref.hsm.HSM]...)
+			continue
+		}
+		v, err := arg.eval(series)
+		if err != nil {
+			return exprValue{}, err
+		}
+		if v.series == nil {
+			return exprValue{}, errors.New(fmt.Sprintf("Arguments of %s have to be series", this.function))
+		}
+		args = append(args, v.series)
+	}
+	for _, arg := range args {
+		if arg.Uom != args[0].Uom {
+			return exprValue{}, errors.New(fmt.Sprintf("Series of %s have different units: %q and %q", this.function, args[0].Uom, arg.Uom))
+		}
+	}
+
+	return exprValue{series: aggregateSeries(expressionFunctions[this.function], args)}, nil
+}
+
+func (this exprBinary) eval(series map[string][]*QueryResultData) (exprValue, error) {
+	left, err := this.left.eval(series)
+	if err != nil {
+		return exprValue{}, err
+	}
+	right, err := this.right.eval(series)
+	if err != nil {
+		return exprValue{}, err
+	}
+	if left.series == nil && right.series == nil {
+		v, ok := calculate(this.op, left.scalar, right.scalar)
+		if !ok {
+			return exprValue{}, errors.New("Division by zero")
+		}
+		return exprValue{scalar: v}, nil
+	}
+
+	return applyOperator(this.op, left, right), nil
+}
+
+func calculate(op byte, a, b float64) (float64, bool) {
+	switch op {
+	case '+':
+		return a + b, true
+	case '-':
+		return a - b, true
+	case '*':
+		return a * b, true
+	}
+	if b == 0 {
+		return 0, false
+	}
+
+	return a / b, true
+}
+
+// applyOperator combines values of the same slots of at least one series,
+// missing values and division by zero give null
+func applyOperator(op byte, left, right exprValue) exprValue {
+	result := &QueryResultData{Data: make([][2]interface{}, 0)}
+	switch {
+	case right.series == nil:
+		result.Uom = left.series.Uom
+	case left.series == nil:
+		result.Uom = right.series.Uom
+	case (op == '+' || op == '-') && left.series.Uom == right.series.Uom:
+		result.Uom = left.series.Uom
+	}
+
+	timestamps := make([]int64, 0)
+	seen := make(map[int64]bool)
+	values := make([]map[int64]interface{}, 2)
+	for i, operand := range []exprValue{left, right} {
+		if operand.series == nil {
+			continue
+		}
+		values[i] = make(map[int64]interface{}, len(operand.series.Data))
+		for _, row := range operand.series.Data {
+			ts, ok := row[0].(int64)
+			if !ok {
+				continue
+			}
+			values[i][ts] = row[1]
+			if !seen[ts] {
+				seen[ts] = true
+				timestamps = append(timestamps, ts)
+			}
+		}
+	}
+	sort.Slice(timestamps, func(i, j int) bool { return timestamps[i] < timestamps[j] })
+
+	operand := func(i int, v exprValue, ts int64) (float64, bool) {
+		if v.series == nil {
+			return v.scalar, true
+		}
+		return seriesValue(values[i][ts])
+	}
+	for _, ts := range timestamps {
+		a, aok := operand(0, left, ts)
+		b, bok := operand(1, right, ts)
+		var value interface{}
+		if aok && bok {
+			if v, ok := calculate(op, a, b); ok && !math.IsInf(v, 0) && !math.IsNaN(v) {
+				value = v
+			}
+		}
+		result.Data = append(result.Data, [2]interface{}{ts, value})
+	}
+	result.Stats = calculateStats(result.Data)
+
+	return exprValue{series: result}
+}
+
+func (this *queryExpression) Eval(series map[string][]*QueryResultData) (*QueryResultData, error) {
+	v, err := this.root.eval(series)
+	if err != nil {
+		return nil, err
+	}
+	if v.series == nil {
+		return nil, errors.New(fmt.Sprintf("Expression %s does not reference any series", this.name))
+	}
+
+	return v.series, nil
+}
+
+type exprParser struct {
+	input    string
+	pos      int
+	parseHSM func(string) (*QueryParamsHSM, error)
+	refs     []QueryParamsHSM
+	seen     map[string]bool
+}
+
+// parseQueryExpression parses "name=expression" of numbers, HSMs in braces,
+// + - * / operators, parentheses and aggregate functions
+func parseQueryExpression(expr string, parseHSM func(string) (*QueryParamsHSM, error)) (*queryExpression, error) {
+	i := strings.Index(expr, "=")
+	if i < 0 || strings.TrimSpace(expr[:i]) == "" {
+		return nil, errors.New(fmt.Sprintf("%s: expected name=expression", expr))
+	}
+
+	p := &exprParser{input: expr[i+1:], parseHSM: parseHSM, seen: make(map[string]bool)}
+	root, err := p.parseSum()
+	if err == nil && p.skipSpace() {
+		err = errors.New(fmt.Sprintf("unexpected %q at %d", p.input[p.pos], p.pos))
+	}
+	if err != nil {
+		return nil, errors.New(fmt.Sprintf("%s: %s", expr, err))
+	}
+
+	return &queryExpression{name: strings.TrimSpace(expr[:i]), root: root, refs: p.refs}, nil
+}
+
+func (this *exprParser) skipSpace() bool {
+	for this.pos < len(this.input) && this.input[this.pos] == ' ' {
+		this.pos++
+	}
+
+	return this.pos < len(this.input)
+}
+
+func (this *exprParser) accept(c byte) bool {
+	if this.skipSpace() && this.input[this.pos] == c {
+		this.pos++
+		return true
+	}
+
+	return false
+}
+
+func (this *exprParser) expect(c byte) error {
+	if !this.accept(c) {
+		return errors.New(fmt.Sprintf("expected %q at %d", c, this.pos))
+	}
+
+	return nil
+}
+
+func (this *exprParser) parseSum() (exprNode, error) {
+	left, err := this.parseProduct()
+	if err != nil {
+		return nil, err
+	}
+	for this.skipSpace() && (this.input[this.pos] == '+' || this.input[this.pos] == '-') {
+		op := this.input[this.pos]
+		this.pos++
+		right, err := this.parseProduct()
+		if err != nil {
+			return nil, err
+		}
+		left = exprBinary{op: op, left: left, right: right}
+	}
+
+	return left, nil
+}
+
+func (this *exprParser) parseProduct() (exprNode, error) {
+	left, err := this.parseUnary()
+	if err != nil {
+		return nil, err
+	}
+	for this.skipSpace() && (this.input[this.pos] == '*' || this.input[this.pos] == '/') {
+		op := this.input[this.pos]
+		this.pos++
+		right, err := this.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		left = exprBinary{op: op, left: left, right: right}
+	}
+
+	return left, nil
+}
+
+func (this *exprParser) parseUnary() (exprNode, error) {
+	if this.accept('-') {
+		operand, err := this.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		return exprBinary{op: '*', left: exprNumber{-1}, right: operand}, nil
+	}
+
+	return this.parsePrimary()
+}
+
+func (this *exprParser) parsePrimary() (exprNode, error) {
+	if !this.skipSpace() {
+		return nil, errors.New(fmt.Sprintf("unexpected end of expression"))
+	}
+
+	start := this.pos
+	c := this.input[this.pos]
+	switch {
+	case c == '(':
+		this.pos++
+		node, err := this.parseSum()
+		if err != nil {
+			return nil, err
+		}
+		return node, this.expect(')')
+
+	case c == '{':
+		end := strings.IndexByte(this.input[start:], '}')
+		if end < 0 {
+			return nil, errors.New(fmt.Sprintf("unterminated HSM at %d", start))
+		}
+		this.pos += end + 1
+		hsm, err := this.parseHSM(this.input[start+1 : start+end])
+		if err != nil {
+			return nil, err
+		}
+		if hsm == nil {
+			return nil, errors.New(fmt.Sprintf("invalid HSM at %d", start))
+		}
+		if !this.seen[hsm.HSM] {
+			this.seen[hsm.HSM] = true
+			this.refs = append(this.refs, *hsm)
+		}
+		return exprRef{*hsm}, nil
+
+	case c >= '0' && c <= '9' || c == '.':
+		for this.pos < len(this.input) && (this.input[this.pos] >= '0' && this.input[this.pos] <= '9' || this.input[this.pos] == '.') {
+			this.pos++
+		}
+		v, err := strconv.ParseFloat(this.input[start:this.pos], 64)
+		if err != nil {
+			return nil, errors.New(fmt.Sprintf("invalid number at %d", start))
+		}
+		return exprNumber{v}, nil
+
+	case c >= 'a' && c <= 'z':
+		for this.pos < len(this.input) && this.input[this.pos] >= 'a' && this.input[this.pos] <= 'z' {
+			this.pos++
+		}
+		call := exprCall{function: this.input[start:this.pos]}
+		if _, ok := expressionFunctions[call.function]; !ok {
+			return nil, errors.New(fmt.Sprintf("unknown function %s at %d", call.function, start))
+		}
+		if err := this.expect('('); err != nil {
+			return nil, err
+		}
+		for {
+			arg, err := this.parseSum()
+			if err != nil {
+				return nil, err
+			}
+			call.args = append(call.args, arg)
+			if !this.accept(',') {
+				break
+			}
+		}
+		return call, this.expect(')')
+	}
+
+	return nil, errors.New(fmt.Sprintf("unexpected %q at %d", c, start))
+}
+
+// expressionSeries plans queries of all series matching HSM of an expression,
+// the returned function lists them once the batch is run
+func (this *TimeseriesServer) expressionSeries(batch *queryBatch, hsm QueryParamsHSM) (func() []*hsmQuery, error) {
+	matched := []QueryParamsHSM{hsm}
+	switch {
+	case hsm.isAttributeSelector():
+		attribute, err := batch.AddAttribute(hsm)
+		if err != nil {
+			return nil, err
+		}
+		return func() []*hsmQuery { return attribute.queries }, nil
+
+	case hsm.pattern != nil:
+		var err error
+		if matched, err = this.expandPattern(batch, hsm); err != nil {
+			return nil, err
+		}
+	}
+
+	queries := make([]*hsmQuery, len(matched))
+	for i, m := range matched {
+		var err error
+		if queries[i], err = batch.Add(m); err != nil {
+			return nil, err
+		}
+	}
+
+	return func() []*hsmQuery { return queries }, nil
+}
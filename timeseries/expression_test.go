@@ -0,0 +1,161 @@
+package timeseries
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+)
+
+func testParseHSM(hsm string) (*QueryParamsHSM, error) {
+	server := &TimeseriesServer{log: &TimeseriesLogger{}}
+	return server.parseHSM(hsm)
+}
+
+func TestParseQueryExpression(t *testing.T) {
+	expression, err := parseQueryExpression("usage = ({h1::Disk%20C::used} - {h1::Disk%20C::free}) / {h1::Disk%20C::used} * 100", testParseHSM)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expression.name != "usage" || len(expression.refs) != 2 || expression.refs[0].Service != "Disk C" {
+		t.Errorf("Unexpected expression: %+v", expression)
+	}
+
+	series := map[string][]*QueryResultData{
+		"h1::Disk C::used": {{Uom: "B", Data: [][2]interface{}{{int64(100), json.Number("50")}, {int64(200), json.Number("0")}, {int64(300), nil}}}},
+		"h1::Disk C::free": {{Uom: "B", Data: [][2]interface{}{{int64(100), json.Number("10")}, {int64(200), json.Number("5")}}}},
+	}
+	result, err := expression.Eval(series)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []interface{}{80.0, nil, nil}
+	if len(result.Data) != len(expected) || result.Uom != "" {
+		t.Fatalf("Unexpected result: %+v", result)
+	}
+	for i, v := range expected {
+		if result.Data[i][1] != v {
+			t.Errorf("Slot %d: expected %v got %v", i, v, result.Data[i][1])
+		}
+	}
+	if result.Stats == nil || result.Stats.Max != 80.0 {
+		t.Errorf("Unexpected stats: %+v", result.Stats)
+	}
+
+	expression, err = parseQueryExpression("total=sum({web*::CPU::load1}, {db1::CPU::load1}) * -2", testParseHSM)
+	if err != nil {
+		t.Fatal(err)
+	}
+	series = map[string][]*QueryResultData{
+		"web*::CPU::load1": {
+			{Data: [][2]interface{}{{int64(100), json.Number("1")}}},
+			{Data: [][2]interface{}{{int64(100), json.Number("2")}}},
+		},
+		"db1::CPU::load1": {{Data: [][2]interface{}{{int64(100), json.Number("3")}}}},
+	}
+	if result, err := expression.Eval(series); err != nil || len(result.Data) != 1 || result.Data[0][1] != -12.0 {
+		t.Errorf("Unexpected result of sum: %+v %v", result, err)
+	}
+
+	expression, _ = parseQueryExpression("x={web*::CPU::load1} + 1", testParseHSM)
+	if _, err := expression.Eval(series); err == nil {
+		t.Errorf("Expected error for pattern outside of aggregate function")
+	}
+
+	expression, _ = parseQueryExpression("x={db1::CPU::load1} * (1 / (2 - 2))", testParseHSM)
+	if _, err := expression.Eval(series); err == nil {
+		t.Errorf("Expected error for division of constants by zero")
+	}
+
+	for _, expr := range []string{
+		"{h1::CPU::load1}",
+		"x=",
+		"x={h1::CPU::load1",
+		"x={h1::CPU}",
+		"x=({h1::CPU::load1} * 2",
+		"x={h1::CPU::load1} 2",
+		"x=stddev({h1::CPU::load1})",
+		"x=1..2",
+	} {
+		if _, err := parseQueryExpression(expr, testParseHSM); err == nil {
+			t.Errorf("Expected error for %s", expr)
+		}
+	}
+}
+
+func TestQueryHandlerExpression(t *testing.T) {
+	tenant, cleanup := newTestTenant(t)
+	defer cleanup()
+
+	if err := tenant.updateMetadata([][5]string{
+		{"h1", "Disk", "used", "GAUGE", "MB"},
+		{"h1", "Disk", "size", "GAUGE", "MB"},
+		{"h2", "Disk", "used", "GAUGE", "MB"},
+		{"h1", "Disk", "time", "GAUGE", "s"},
+	}, time.Now().Unix()); err != nil {
+		t.Fatal(err)
+	}
+
+	fake := newFakeInfluxDB([][]interface{}{{1500000000, 2}, {1500000300, 4}})
+	defer fake.Close()
+	server := newTestQueryServer(tenant, fake.URL)
+
+	query := func(params string) (int, map[string]QueryResultData) {
+		w := httptest.NewRecorder()
+		server.QueryHandler(w, httptest.NewRequest("GET", "/query?start=1500000000&end=1500003600&"+params, nil), nil, tenant)
+
+		var results map[string]QueryResultData
+		if w.Code == 200 {
+			if err := json.Unmarshal(w.Body.Bytes(), &results); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return w.Code, results
+	}
+
+	code, results := query("hsm=h1::Disk::used" +
+		"&expr=" + url.QueryEscape("usage={h1::Disk::used} / {h1::Disk::size} * 100") +
+		"&expr=" + url.QueryEscape("total=sum({*::Disk::used})"))
+	if code != 200 {
+		t.Fatalf("Unexpected response %d", code)
+	}
+	if r, ok := results["h1::Disk::used"]; !ok || len(r.Data) != 2 {
+		t.Errorf("Unexpected result of HSM: %+v", r)
+	}
+	if r := results["usage"]; len(r.Data) != 2 || r.Data[0][1] != 100.0 || r.Stats == nil {
+		t.Errorf("Unexpected result of usage: %+v", r)
+	}
+	if r := results["total"]; len(r.Data) != 2 || r.Data[1][1] != 8.0 || r.Uom != "bytes" {
+		t.Errorf("Unexpected result of total: %+v", r)
+	}
+	if n := len(fake.Requests()); n != 1 {
+		t.Errorf("Expected one request, got %d", n)
+	}
+
+	if code, _ := query("expr=" + url.QueryEscape("x={*::Disk::used} * 2")); code != 400 {
+		t.Errorf("Expected error for pattern outside of aggregate function, got %d", code)
+	}
+	if code, _ := query("expr=" + url.QueryEscape("x=sum({h1::Disk::used}, {h1::Disk::time})")); code != 400 {
+		t.Errorf("Expected error for series of different units, got %d", code)
+	}
+	// unescaped + is decoded as a space
+	if code, _ := query("expr=x={h1::Disk::used}+{h1::Disk::size}"); code != 400 {
+		t.Errorf("Expected error for unescaped +, got %d", code)
+	}
+	if code, results := query("expr=x={h1::Disk::used}%2B{h1::Disk::size}"); code != 200 || results["x"].Data[0][1] != 4.0 {
+		t.Errorf("Unexpected result of escaped + %d: %+v", code, results)
+	}
+	if code, _ := query("expr=" + url.QueryEscape("x=1 +")); code != 400 {
+		t.Errorf("Expected error for invalid expression, got %d", code)
+	}
+	for _, params := range []string{
+		"hsm=h1::Disk::used&expr=" + url.QueryEscape("h1::Disk::used={h1::Disk::size} * 2"),
+		"expr=" + url.QueryEscape("x={h1::Disk::size}") + "&expr=" + url.QueryEscape("x={h1::Disk::used}"),
+		"hsm=h*::Disk::used&expr=" + url.QueryEscape("h2::Disk::used={h1::Disk::size}"),
+	} {
+		if code, _ := query(params); code != 400 {
+			t.Errorf("Expected error for name of expression already used by %s, got %d", params, code)
+		}
+	}
+}
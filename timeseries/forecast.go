@@ -0,0 +1,316 @@
+package timeseries
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"net/url"
+	"strconv"
+)
+
+const (
+	FORECAST_LINEAR       = "linear"
+	FORECAST_HOLT_WINTERS = "holt_winters"
+	// width of confidence bands in standard deviations, about 95%
+	FORECAST_BAND_WIDTH = 1.96
+)
+
+type forecastParams struct {
+	model     string
+	horizon   int64
+	season    int64
+	threshold *float64
+}
+
+// QueryResultForecast holds projected [time, value, lower, upper] points
+type QueryResultForecast struct {
+	Model         string           `json:"model"`
+	Data          [][4]interface{} `json:"data"`
+	Threshold     *float64         `json:"threshold,omitempty"`
+	ThresholdTime *int64           `json:"threshold_time,omitempty"`
+}
+
+// horizon defaults to length of the range
+func parseForecastParams(query url.Values, qsParams *QueryParams) (*forecastParams, error) {
+	model := query.Get("forecast")
+	if model == "" {
+		return nil, nil
+	}
+	if model != FORECAST_LINEAR && model != FORECAST_HOLT_WINTERS {
+		return nil, errors.New(fmt.Sprintf("Invalid parameter forecast: %s", model))
+	}
+
+	params := &forecastParams{
+		model:   model,
+		horizon: qsParams.endEpoch - qsParams.startEpoch,
+		season:  DAY,
+	}
+	if v := query.Get("forecast_horizon"); v != "" {
+		if i, err := strconv.ParseInt(v, 10, 64); err != nil || i < 1 {
+			return nil, errors.New(fmt.Sprintf("Invalid parameter: forecast_horizon"))
+		} else {
+			params.horizon = i
+		}
+	}
+	if v := query.Get("forecast_season"); v != "" {
+		if i, err := strconv.ParseInt(v, 10, 64); err != nil || i < 1 {
+			return nil, errors.New(fmt.Sprintf("Invalid parameter: forecast_season"))
+		} else {
+			params.season = i
+		}
+	}
+	if v := query.Get("forecast_threshold"); v != "" {
+		if f, err := strconv.ParseFloat(v, 64); err != nil {
+			return nil, errors.New(fmt.Sprintf("Invalid parameter: forecast_threshold"))
+		} else {
+			params.threshold = &f
+		}
+	}
+
+	return params, nil
+}
+
+// forecastModel projects value h seconds after the last point with half
+// width of its confidence band
+type forecastModel interface {
+	project(h int64) (value, band float64)
+}
+
+type linearModel struct {
+	t0, last                 int64
+	intercept, slope         float64
+	n, xmean, sxx, residuals float64
+}
+
+func fitLinear(ts []int64, values []float64) *linearModel {
+	m := &linearModel{t0: ts[0], last: ts[len(ts)-1], n: float64(len(ts))}
+
+	var ymean float64
+	for i := range ts {
+		m.xmean += float64(ts[i] - m.t0)
+		ymean += values[i]
+	}
+	m.xmean /= m.n
+	ymean /= m.n
+
+	var sxy float64
+	for i := range ts {
+		dx := float64(ts[i]-m.t0) - m.xmean
+		m.sxx += dx * dx
+		sxy += dx * (values[i] - ymean)
+	}
+	if m.sxx > 0 {
+		m.slope = sxy / m.sxx
+	}
+	m.intercept = ymean - m.slope*m.xmean
+
+	if len(ts) > 2 {
+		var sse float64
+		for i := range ts {
+			e := values[i] - m.intercept - m.slope*float64(ts[i]-m.t0)
+			sse += e * e
+		}
+		m.residuals = math.Sqrt(sse / (m.n - 2))
+	}
+
+	return m
+}
+
+func (this *linearModel) project(h int64) (float64, float64) {
+	x := float64(this.last + h - this.t0)
+	band := FORECAST_BAND_WIDTH * this.residuals * math.Sqrt(1+1/this.n+(x-this.xmean)*(x-this.xmean)/this.sxx)
+
+	return this.intercept + this.slope*x, band
+}
+
+func (this *linearModel) thresholdTime(threshold float64, horizon int64) *int64 {
+	if this.slope == 0 {
+		return nil
+	}
+	t := this.t0 + int64(math.Floor((threshold-this.intercept)/this.slope+0.5))
+	if t < this.last || t > this.last+horizon {
+		return nil
+	}
+
+	return &t
+}
+
+// additive Holt-Winters, without seasonal component if there is less than two
+// seasons of data
+type holtWintersModel struct {
+	slot         int64
+	level, trend float64
+	seasonal     []float64
+	next         int
+	sigma        float64
+}
+
+var holtWintersGrid = []float64{0.1, 0.2, 0.3, 0.4, 0.5, 0.6, 0.7, 0.8, 0.9}
+
+func fitHoltWinters(ts []int64, values []float64, slot, season int64) *holtWintersModel {
+	// missing slots are filled with the one step forecast
+	n := int((ts[len(ts)-1]-ts[0])/slot) + 1
+	y := make([]float64, n)
+	observed := make([]bool, n)
+	for i := range ts {
+		y[(ts[i]-ts[0])/slot] = values[i]
+		observed[(ts[i]-ts[0])/slot] = true
+	}
+
+	period := int(season / slot)
+	if period < 2 || n < 2*period {
+		period = 0
+	}
+
+	gammas := holtWintersGrid
+	if period == 0 {
+		gammas = []float64{0}
+	}
+
+	var best *holtWintersModel
+	bestSSE := math.Inf(1)
+	for _, alpha := range holtWintersGrid {
+		for _, beta := range holtWintersGrid {
+			for _, gamma := range gammas {
+				m, sse := smoothHoltWinters(y, observed, period, alpha, beta, gamma)
+				if sse < bestSSE {
+					best, bestSSE = m, sse
+				}
+			}
+		}
+	}
+	best.slot = slot
+
+	return best
+}
+
+func smoothHoltWinters(y []float64, observed []bool, period int, alpha, beta, gamma float64) (*holtWintersModel, float64) {
+	m := &holtWintersModel{}
+	start := 1
+	if period > 0 {
+		var first, second float64
+		for i := 0; i < period; i++ {
+			first += y[i]
+			second += y[period+i]
+		}
+		first /= float64(period)
+		second /= float64(period)
+
+		m.trend = (second - first) / float64(period)
+		m.level = first + m.trend*float64(period-1)/2
+		m.seasonal = make([]float64, period)
+		for i := 0; i < period; i++ {
+			offset := m.trend * (float64(i) - float64(period-1)/2)
+			m.seasonal[i] = (y[i] - first - offset + y[period+i] - second - offset) / 2
+		}
+		start = period
+	} else {
+		m.level = y[0]
+		m.trend = y[1] - y[0]
+		m.seasonal = []float64{0}
+	}
+
+	var sse float64
+	var count int
+	for t := start; t < len(y); t++ {
+		s := t % len(m.seasonal)
+		forecast := m.level + m.trend + m.seasonal[s]
+		value := forecast
+		if observed[t] {
+			value = y[t]
+			sse += (value - forecast) * (value - forecast)
+			count++
+		}
+
+		level := alpha*(value-m.seasonal[s]) + (1-alpha)*(m.level+m.trend)
+		m.trend = beta*(level-m.level) + (1-beta)*m.trend
+		if period > 0 {
+			m.seasonal[s] = gamma*(value-level) + (1-gamma)*m.seasonal[s]
+		}
+		m.level = level
+	}
+	m.next = len(y) % len(m.seasonal)
+	if count > 0 {
+		m.sigma = math.Sqrt(sse / float64(count))
+	}
+
+	return m, sse
+}
+
+func (this *holtWintersModel) project(h int64) (float64, float64) {
+	steps := h / this.slot
+	if steps < 1 {
+		steps = 1
+	}
+	s := (this.next + int(steps) - 1) % len(this.seasonal)
+
+	return this.level + float64(steps)*this.trend + this.seasonal[s], FORECAST_BAND_WIDTH * this.sigma * math.Sqrt(float64(steps))
+}
+
+func forecastSeries(params *forecastParams, data [][2]interface{}, slot, dataPoints int64) *QueryResultForecast {
+	result := &QueryResultForecast{
+		Model:     params.model,
+		Data:      make([][4]interface{}, 0),
+		Threshold: params.threshold,
+	}
+
+	ts := make([]int64, 0, len(data))
+	values := make([]float64, 0, len(data))
+	for _, row := range data {
+		t, ok := row[0].(int64)
+		if v, isValue := seriesValue(row[1]); ok && isValue {
+			ts = append(ts, t)
+			values = append(values, v)
+		}
+	}
+	if len(ts) < 2 {
+		return result
+	}
+	if slot < 1 {
+		slot = ts[1] - ts[0]
+	}
+
+	var model forecastModel
+	var linear *linearModel
+	if params.model == FORECAST_LINEAR {
+		linear = fitLinear(ts, values)
+		model = linear
+	} else {
+		model = fitHoltWinters(ts, values, slot, params.season)
+	}
+
+	step := slot
+	if dataPoints > 0 && params.horizon/step > dataPoints {
+		step = int64(math.Ceil(float64(params.horizon)/float64(dataPoints)/float64(slot))) * slot
+	}
+	last := ts[len(ts)-1]
+	for h := step; h <= params.horizon; h += step {
+		value, band := model.project(h)
+		result.Data = append(result.Data, [4]interface{}{last + h, value, value - band, value + band})
+	}
+
+	if params.threshold != nil {
+		if linear != nil {
+			result.ThresholdTime = linear.thresholdTime(*params.threshold, params.horizon)
+		} else {
+			result.ThresholdTime = projectedThresholdTime(model, last, values[len(values)-1], *params.threshold, slot, params.horizon)
+		}
+	}
+
+	return result
+}
+
+func projectedThresholdTime(model forecastModel, last int64, value, threshold float64, slot, horizon int64) *int64 {
+	if value == threshold {
+		return &last
+	}
+	above := value > threshold
+	for h := slot; h <= horizon; h += slot {
+		if v, _ := model.project(h); (v <= threshold) == above {
+			t := last + h
+			return &t
+		}
+	}
+
+	return nil
+}
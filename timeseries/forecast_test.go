@@ -0,0 +1,144 @@
+package timeseries
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+)
+
+func TestForecastLinear(t *testing.T) {
+	// disk growing by 1 per slot with one missing point
+	data := make([][2]interface{}, 0)
+	for ts := int64(1000); ts <= 2000; ts += 100 {
+		var v interface{} = json.Number(fmt.Sprint(10 + (ts-1000)/100))
+		if ts == 1500 {
+			v = nil
+		}
+		data = append(data, [2]interface{}{ts, v})
+	}
+
+	threshold := 30.0
+	params := &forecastParams{model: FORECAST_LINEAR, horizon: 500, threshold: &threshold}
+	forecast := forecastSeries(params, data, 100, 500)
+	if len(forecast.Data) != 5 {
+		t.Fatalf("Expected 5 projected points, got %+v", forecast.Data)
+	}
+	if row := forecast.Data[4]; row[0] != int64(2500) || math.Abs(row[1].(float64)-25) > 1e-9 || math.Abs(row[2].(float64)-25) > 1e-9 {
+		t.Errorf("Unexpected projection: %v", row)
+	}
+	// reached after the horizon
+	if forecast.ThresholdTime != nil {
+		t.Errorf("Threshold not expected to be reached: %d", *forecast.ThresholdTime)
+	}
+	params.horizon = 1000
+	if forecast := forecastSeries(params, data, 100, 500); forecast.ThresholdTime == nil || *forecast.ThresholdTime != 3000 {
+		t.Errorf("Expected threshold reached at 3000, got %v", forecast.ThresholdTime)
+	}
+
+	// trending away from the threshold crossed in the past
+	threshold = 5
+	if forecast := forecastSeries(params, data, 100, 2); len(forecast.Data) != 2 || forecast.ThresholdTime != nil {
+		t.Errorf("Unexpected forecast: %+v", forecast)
+	}
+	falling := make([][2]interface{}, len(data))
+	for i, row := range data {
+		falling[i] = [2]interface{}{row[0], json.Number(fmt.Sprint(100 - i))}
+	}
+	threshold = 120
+	if forecast := forecastSeries(params, falling, 100, 500); forecast.ThresholdTime != nil {
+		t.Errorf("Threshold not expected to be reached: %d", *forecast.ThresholdTime)
+	}
+
+	if forecast := forecastSeries(params, data[:1], 100, 500); len(forecast.Data) != 0 || forecast.ThresholdTime != nil {
+		t.Errorf("Expected empty forecast of one point: %+v", forecast)
+	}
+}
+
+func TestForecastHoltWinters(t *testing.T) {
+	// daily pattern of 24 slots with growing trend and noise
+	data := make([][2]interface{}, 0)
+	value := func(i int64) float64 {
+		return 100 + float64(i)*0.5 + 20*math.Sin(2*math.Pi*float64(i)/24)
+	}
+	for i := int64(0); i < 24*7; i++ {
+		data = append(data, [2]interface{}{i * HOUR, value(i) + float64(i%5-2)})
+	}
+
+	threshold := 250.0
+	params := &forecastParams{model: FORECAST_HOLT_WINTERS, horizon: DAY, season: DAY, threshold: &threshold}
+	forecast := forecastSeries(params, data, HOUR, 500)
+	if len(forecast.Data) != 24 {
+		t.Fatalf("Expected 24 projected points, got %d", len(forecast.Data))
+	}
+	for i, row := range forecast.Data {
+		expected := value(int64(24*7 + i))
+		if lower, upper := row[2].(float64), row[3].(float64); expected < lower || expected > upper {
+			t.Errorf("Slot %d: expected %f within band %v", i, expected, row)
+		}
+	}
+	// daily peak is projected at 6:00 and trough at 18:00
+	if peak, trough := forecast.Data[6][1].(float64), forecast.Data[18][1].(float64); peak-trough < 20 {
+		t.Errorf("Seasonality not projected: %f %f", peak, trough)
+	}
+	if forecast.ThresholdTime != nil {
+		t.Errorf("Threshold not expected to be reached: %d", *forecast.ThresholdTime)
+	}
+
+	// the series exceeds 200 at 3:00
+	threshold = 200
+	forecast = forecastSeries(params, data, HOUR, 500)
+	if forecast.ThresholdTime == nil || *forecast.ThresholdTime < 170*HOUR || *forecast.ThresholdTime > 172*HOUR {
+		t.Errorf("Expected threshold reached at about %d, got %v", 171*HOUR, forecast.ThresholdTime)
+	}
+}
+
+func TestQueryHandlerForecast(t *testing.T) {
+	tenant, cleanup := newTestTenant(t)
+	defer cleanup()
+
+	if err := tenant.updateMetadata([][5]string{{"h1", "Disk", "used", "GAUGE", ""}}, time.Now().Unix()); err != nil {
+		t.Fatal(err)
+	}
+
+	fake := newFakeInfluxDB([][]interface{}{{1500000000, 10}, {1500000600, 20}, {1500001200, 30}})
+	defer fake.Close()
+	server := newTestQueryServer(tenant, fake.URL)
+
+	query := func(params string) (int, map[string]QueryResultData) {
+		w := httptest.NewRecorder()
+		server.QueryHandler(w, httptest.NewRequest("GET", "/query?start=1500000000&end=1500001200&fixed_time_slot=600&hsm=h1::Disk::used&"+params, nil), nil, tenant)
+
+		var results map[string]QueryResultData
+		if w.Code == 200 {
+			if err := json.Unmarshal(w.Body.Bytes(), &results); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return w.Code, results
+	}
+
+	code, results := query("forecast=linear&forecast_horizon=1800&forecast_threshold=" + url.QueryEscape("55"))
+	if code != 200 {
+		t.Fatalf("Unexpected response %d", code)
+	}
+	forecast := results["h1::Disk::used"].Forecast
+	if forecast == nil || forecast.Model != "linear" || len(forecast.Data) != 3 || forecast.Data[2][1] != 60.0 {
+		t.Fatalf("Unexpected forecast: %+v", forecast)
+	}
+	if forecast.ThresholdTime == nil || *forecast.ThresholdTime != 1500002700 {
+		t.Errorf("Unexpected threshold time: %v", forecast.ThresholdTime)
+	}
+
+	if _, results := query(""); results["h1::Disk::used"].Forecast != nil {
+		t.Errorf("Forecast not requested")
+	}
+	for _, params := range []string{"forecast=arima", "forecast=linear&forecast_horizon=0", "forecast=linear&forecast_threshold=x"} {
+		if code, _ := query(params); code != 400 {
+			t.Errorf("%s: expected error, got %d", params, code)
+		}
+	}
+}
@@ -0,0 +1,155 @@
+package timeseries
+
+import (
+	"github.com/julienschmidt/httprouter"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+const (
+	METADATA_CONFLICTS_PERIOD = WEEK
+	METADATA_CONFLICTS_LIMIT  = 1000
+)
+
+type MetadataHistoryEntry struct {
+	Host       string `json:"host"`
+	Service    string `json:"service"`
+	Metric     string `json:"metric"`
+	PrevDstype string `json:"prev_dstype"`
+	PrevUom    string `json:"prev_uom"`
+	Dstype     string `json:"dstype"`
+	Uom        string `json:"uom"`
+	ChangedAt  int64  `json:"changed_at"`
+}
+
+type metadataSegment struct {
+	start, end  int64
+	dstype, uom string
+}
+
+func scanMetadataHistory(rows interface {
+	Next() bool
+	Scan(...interface{}) error
+	Err() error
+}) ([]MetadataHistoryEntry, error) {
+	entries := make([]MetadataHistoryEntry, 0)
+	for rows.Next() {
+		var e MetadataHistoryEntry
+		if err := rows.Scan(&e.Host, &e.Service, &e.Metric, &e.PrevDstype, &e.PrevUom, &e.Dstype, &e.Uom, &e.ChangedAt); err != nil {
+			return nil, err
+		}
+		entries = append(entries, e)
+	}
+
+	return entries, rows.Err()
+}
+
+func (this *SQLMetadataStore) ListMetadataHistory(since int64, limit int) ([]MetadataHistoryEntry, error) {
+	rows, err := this.db.Query(`
+        SELECT host, service, metric, prev_dstype, prev_uom, dstype, uom, changed_at
+        FROM uoms_history WHERE changed_at >= ? ORDER BY changed_at DESC LIMIT ?
+        `, since, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	return scanMetadataHistory(rows)
+}
+
+func (this *SQLMetadataStore) ListAllMetadataHistory() ([]MetadataHistoryEntry, error) {
+	rows, err := this.db.Query(`
+        SELECT host, service, metric, prev_dstype, prev_uom, dstype, uom, changed_at
+        FROM uoms_history ORDER BY changed_at
+        `)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	return scanMetadataHistory(rows)
+}
+
+func (this *SQLMetadataStore) SeriesHistory(host, service, metric string) ([]MetadataHistoryEntry, error) {
+	rows, err := this.db.Query(`
+        SELECT host, service, metric, prev_dstype, prev_uom, dstype, uom, changed_at
+        FROM uoms_history WHERE host = ? AND service = ? AND metric = ? ORDER BY changed_at
+        `, host, service, metric)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	return scanMetadataHistory(rows)
+}
+
+func (this *TimeseriesTenant) metadataChanges(host, service, metric string, start, end int64) ([]MetadataHistoryEntry, error) {
+	var all []MetadataHistoryEntry
+	if this.cache != nil {
+		all = this.cache.History(host, service, metric)
+	} else {
+		var err error
+		if all, err = this.store.SeriesHistory(host, service, metric); err != nil {
+			return nil, err
+		}
+	}
+
+	changes := make([]MetadataHistoryEntry, 0)
+	for _, e := range all {
+		if e.ChangedAt > start && e.ChangedAt <= end {
+			changes = append(changes, e)
+		}
+	}
+
+	return changes, nil
+}
+
+// metadataSegments splits time range into parts with constant dstype and uom,
+// changes have to be sorted and within the range
+func metadataSegments(start, end int64, dstype, uom string, changes []MetadataHistoryEntry) []metadataSegment {
+	if len(changes) == 0 {
+		return []metadataSegment{{start, end, dstype, uom}}
+	}
+
+	segments := make([]metadataSegment, 0, len(changes)+1)
+	segStart := start
+	for _, change := range changes {
+		if change.ChangedAt > segStart {
+			segments = append(segments, metadataSegment{segStart, change.ChangedAt - 1, change.PrevDstype, change.PrevUom})
+		}
+		segStart = change.ChangedAt
+	}
+	segments = append(segments, metadataSegment{segStart, end, dstype, uom})
+
+	return segments
+}
+
+func (this *TimeseriesServer) MetadataConflictsHandler(w http.ResponseWriter, r *http.Request, ps httprouter.Params, tenant *TimeseriesTenant) {
+	query := r.URL.Query()
+
+	since := time.Now().Unix() - METADATA_CONFLICTS_PERIOD
+	if v := query.Get("since"); v != "" {
+		var err error
+		if since, err = strconv.ParseInt(v, 10, 64); err != nil {
+			this.sendHTTPError(w, http.StatusBadRequest, "Failed to parse query: Invalid parameter: since")
+			return
+		}
+	}
+
+	limit := METADATA_CONFLICTS_LIMIT
+	if v := query.Get("limit"); v != "" {
+		var err error
+		if limit, err = strconv.Atoi(v); err != nil || limit < 1 {
+			this.sendHTTPError(w, http.StatusBadRequest, "Failed to parse query: Invalid parameter: limit")
+			return
+		}
+	}
+
+	conflicts, err := tenant.store.ListMetadataHistory(since, limit)
+	if err != nil {
+		this.sendHTTPError(w, http.StatusInternalServerError, "Failed to list metadata conflicts: %s", err)
+		return
+	}
+	this.sendJSON(w, conflicts)
+}
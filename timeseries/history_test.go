@@ -0,0 +1,56 @@
+package timeseries
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestMetadataHistory(t *testing.T) {
+	tenant, cleanup := newTestTenant(t)
+	defer cleanup()
+
+	if err := tenant.updateMetadata([][5]string{{"h1", "Disk", "/", "GAUGE", "MB"}}, 100); err != nil {
+		t.Fatal(err)
+	}
+	if err := tenant.updateMetadata([][5]string{{"h1", "Disk", "/", "GAUGE", "MB"}}, 200); err != nil {
+		t.Fatal(err)
+	}
+	if err := tenant.updateMetadata([][5]string{{"h1", "Disk", "/", "GAUGE", "B"}}, 300); err != nil {
+		t.Fatal(err)
+	}
+
+	history, err := tenant.store.ListMetadataHistory(0, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []MetadataHistoryEntry{{"h1", "Disk", "/", "GAUGE", "MB", "GAUGE", "B", 300}}
+	if !reflect.DeepEqual(history, expected) {
+		t.Errorf("Expected %+v got %+v", expected, history)
+	}
+
+	changes, err := tenant.metadataChanges("h1", "Disk", "/", 300, 400)
+	if err != nil || len(changes) != 0 {
+		t.Errorf("Expected no changes after 300 got %+v (%v)", changes, err)
+	}
+}
+
+func TestMetadataSegments(t *testing.T) {
+	changes := []MetadataHistoryEntry{
+		{PrevDstype: "GAUGE", PrevUom: "MB", Dstype: "GAUGE", Uom: "B", ChangedAt: 200},
+		{PrevDstype: "GAUGE", PrevUom: "B", Dstype: "COUNTER", Uom: "c", ChangedAt: 300},
+	}
+	segments := metadataSegments(100, 400, "COUNTER", "c", changes)
+	expected := []metadataSegment{
+		{100, 199, "GAUGE", "MB"},
+		{200, 299, "GAUGE", "B"},
+		{300, 400, "COUNTER", "c"},
+	}
+	if !reflect.DeepEqual(segments, expected) {
+		t.Errorf("Expected %+v got %+v", expected, segments)
+	}
+
+	segments = metadataSegments(100, 400, "GAUGE", "B", nil)
+	if len(segments) != 1 || segments[0] != (metadataSegment{100, 400, "GAUGE", "B"}) {
+		t.Errorf("Unexpected segments %+v", segments)
+	}
+}
@@ -0,0 +1,358 @@
+package timeseries
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/julienschmidt/httprouter"
+	"io"
+	"net/http"
+	"regexp"
+	"time"
+)
+
+// HostAttributes holds a single value of each attribute, as InfluxDB tags do
+type HostAttributes map[string]string
+type HostsAttributes map[string]HostAttributes
+
+var attributeNameRe = regexp.MustCompile(`^[a-z][a-z0-9_]*$`)
+
+// names used by points written to InfluxDB cannot be reused as attributes
+var reservedAttributeNames = map[string]bool{
+	"service": true,
+	"metric":  true,
+	"value":   true,
+	"time":    true,
+}
+
+func (this HostAttributes) Validate() error {
+	for name, value := range this {
+		if !attributeNameRe.MatchString(name) || reservedAttributeNames[name] {
+			return errors.New(fmt.Sprintf("Invalid attribute name: %s", name))
+		}
+		if value == "" {
+			return errors.New(fmt.Sprintf("Empty value of attribute %s", name))
+		}
+	}
+
+	return nil
+}
+
+func copyHostAttributes(attributes HostAttributes) HostAttributes {
+	copied := make(HostAttributes, len(attributes))
+	for name, value := range attributes {
+		copied[name] = value
+	}
+
+	return copied
+}
+
+// has reports whether the attribute is set to value, or set at all if value
+// is empty
+func (this HostAttributes) has(name, value string) bool {
+	v, ok := this[name]
+
+	return ok && (value == "" || v == value)
+}
+
+// Tags returns attributes as InfluxDB tags
+func (this HostAttributes) Tags() map[string]string {
+	return map[string]string(copyHostAttributes(this))
+}
+
+func (this *SQLMetadataStore) ListHostsAttributes() (HostsAttributes, error) {
+	rows, err := this.db.Query("SELECT host, name, value FROM host_attributes ORDER BY host, name")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	hostsAttributes := make(HostsAttributes)
+	for rows.Next() {
+		var host, name, value string
+		if err := rows.Scan(&host, &name, &value); err != nil {
+			return nil, err
+		}
+		attributes, ok := hostsAttributes[host]
+		if !ok {
+			attributes = make(HostAttributes)
+			hostsAttributes[host] = attributes
+		}
+		attributes[name] = value
+	}
+
+	return hostsAttributes, rows.Err()
+}
+
+func (this *SQLMetadataStore) GetHostAttributes(host string) (HostAttributes, error) {
+	rows, err := this.db.Query("SELECT name, value FROM host_attributes WHERE host = ? ORDER BY name", host)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	attributes := make(HostAttributes)
+	for rows.Next() {
+		var name, value string
+		if err := rows.Scan(&name, &value); err != nil {
+			return nil, err
+		}
+		attributes[name] = value
+	}
+
+	return attributes, rows.Err()
+}
+
+// SetHostsAttributes stores attributes of given hosts in a single
+// transaction. Hosts keep the attributes not listed unless replace is set,
+// with replace all hosts not listed lose their attributes too.
+func (this *TimeseriesTenant) SetHostsAttributes(hostsAttributes HostsAttributes, replace bool) error {
+	if err := hostsAttributes.Validate(); err != nil {
+		return err
+	}
+
+	return this.store.SetHostsAttributes(hostsAttributes, replace)
+}
+
+func (this *SQLMetadataStore) SetHostsAttributes(hostsAttributes HostsAttributes, replace bool) error {
+	tx, err := this.db.Begin()
+	if err != nil {
+		return err
+	}
+
+	if replace {
+		if _, err := tx.Exec("DELETE FROM host_attributes"); err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+
+	for host, attributes := range hostsAttributes {
+		for name, value := range attributes {
+			if _, err := tx.Exec("DELETE FROM host_attributes WHERE host = ? AND name = ?", host, name); err != nil {
+				tx.Rollback()
+				return err
+			}
+			if err := insertHostAttribute(tx, host, name, value); err != nil {
+				tx.Rollback()
+				return err
+			}
+		}
+	}
+
+	return tx.Commit()
+}
+
+func (this *TimeseriesTenant) ReplaceHostAttributes(host string, attributes HostAttributes) error {
+	if err := attributes.Validate(); err != nil {
+		return err
+	}
+
+	return this.store.ReplaceHostAttributes(host, attributes)
+}
+
+func (this *SQLMetadataStore) ReplaceHostAttributes(host string, attributes HostAttributes) error {
+	tx, err := this.db.Begin()
+	if err != nil {
+		return err
+	}
+
+	if _, err := tx.Exec("DELETE FROM host_attributes WHERE host = ?", host); err != nil {
+		tx.Rollback()
+		return err
+	}
+	for name, value := range attributes {
+		if err := insertHostAttribute(tx, host, name, value); err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+func insertHostAttribute(tx *metadataTx, host, name, value string) error {
+	_, err := tx.Exec(tx.dialect.replace("host_attributes", hostAttributesKeys, hostAttributesKeys, "VALUES (?,?,?)"), host, name, value)
+
+	return err
+}
+
+func (this *SQLMetadataStore) DeleteHostAttributes(host string) error {
+	_, err := this.db.Exec("DELETE FROM host_attributes WHERE host = ?", host)
+
+	return err
+}
+
+func (this HostsAttributes) Validate() error {
+	for host, attributes := range this {
+		if host == "" {
+			return errors.New("Empty host name")
+		}
+		if err := attributes.Validate(); err != nil {
+			return errors.New(fmt.Sprintf("Host %s: %s", host, err))
+		}
+	}
+
+	return nil
+}
+
+func decodeHostsAttributes(r io.Reader) (HostsAttributes, error) {
+	var hostsAttributes HostsAttributes
+	if err := json.NewDecoder(r).Decode(&hostsAttributes); err != nil {
+		return nil, err
+	}
+
+	return hostsAttributes, hostsAttributes.Validate()
+}
+
+func (this *TimeseriesTenant) ImportHostsAttributes(r io.Reader, replace bool) error {
+	hostsAttributes, err := decodeHostsAttributes(r)
+	if err != nil {
+		return err
+	}
+
+	return this.store.SetHostsAttributes(hostsAttributes, replace)
+}
+
+// AttributeMetadata returns distinct dstype and uom of the service and metric
+// of hosts having the attribute set to value (or set at all if value is empty)
+func (this *SQLMetadataStore) AttributeMetadata(name, value, service, metric string) ([][2]string, error) {
+	query := "SELECT DISTINCT u.dstype, u.uom FROM host_attributes a JOIN uoms u ON u.host = a.host " +
+		"WHERE a.name = ? AND u.service = ? AND u.metric = ?"
+	args := []interface{}{name, service, metric}
+	if value != "" {
+		query += " AND a.value = ?"
+		args = append(args, value)
+	}
+
+	rows, err := this.db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	metadata := make([][2]string, 0, 1)
+	for rows.Next() {
+		var m [2]string
+		if err := rows.Scan(&m[0], &m[1]); err != nil {
+			return nil, err
+		}
+		metadata = append(metadata, m)
+	}
+
+	return metadata, rows.Err()
+}
+
+func (this *TimeseriesTenant) loadHostTags() error {
+	hostsAttributes, err := this.store.ListHostsAttributes()
+	if err != nil {
+		return err
+	}
+
+	hostTags := make(map[string]map[string]string, len(hostsAttributes))
+	for host, attributes := range hostsAttributes {
+		hostTags[host] = attributes.Tags()
+	}
+
+	this.hostTagsLock.Lock()
+	this.hostTags = hostTags
+	this.hostTagsLock.Unlock()
+
+	return nil
+}
+
+func (this *TimeseriesTenant) refreshHostTags(interval time.Duration, stop <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+		if err := this.loadHostTags(); err != nil {
+			this.log.Error("Failed to refresh host attributes: %s", err)
+		}
+	}
+}
+
+func (this *TimeseriesTenant) HostTags(host string) map[string]string {
+	this.hostTagsLock.RLock()
+	defer this.hostTagsLock.RUnlock()
+
+	return this.hostTags[host]
+}
+
+func (this *TimeseriesServer) ListHostsAttributesHandler(w http.ResponseWriter, r *http.Request, ps httprouter.Params, tenant *TimeseriesTenant) {
+	hostsAttributes, err := tenant.store.ListHostsAttributes()
+	if err != nil {
+		this.sendHTTPError(w, http.StatusInternalServerError, "Failed to list host attributes: %s", err)
+		return
+	}
+	json, err := json.Marshal(hostsAttributes)
+
+	if err != nil {
+		this.sendHTTPError(w, http.StatusInternalServerError, "Failed to encode JSON response: %s", err)
+		return
+	}
+	w.Write(json)
+}
+
+func (this *TimeseriesServer) ImportHostsAttributesHandler(w http.ResponseWriter, r *http.Request, ps httprouter.Params, tenant *TimeseriesTenant) {
+	defer r.Body.Close()
+
+	hostsAttributes, err := decodeHostsAttributes(r.Body)
+	if err != nil {
+		this.sendHTTPError(w, http.StatusBadRequest, "Invalid host attributes: %s", err)
+		return
+	}
+	replace := r.URL.Query().Get("replace") == "1"
+	if err := tenant.store.SetHostsAttributes(hostsAttributes, replace); err != nil {
+		this.sendHTTPError(w, http.StatusInternalServerError, "Failed to import host attributes: %s", err)
+		return
+	}
+	w.Write([]byte("{\"status\":0}"))
+}
+
+func (this *TimeseriesServer) GetHostAttributesHandler(w http.ResponseWriter, r *http.Request, ps httprouter.Params, tenant *TimeseriesTenant) {
+	attributes, err := tenant.store.GetHostAttributes(ps.ByName("host"))
+	if err != nil {
+		this.sendHTTPError(w, http.StatusInternalServerError, "Failed to get host attributes: %s", err)
+		return
+	}
+	json, err := json.Marshal(attributes)
+
+	if err != nil {
+		this.sendHTTPError(w, http.StatusInternalServerError, "Failed to encode JSON response: %s", err)
+		return
+	}
+	w.Write(json)
+}
+
+func (this *TimeseriesServer) SetHostAttributesHandler(w http.ResponseWriter, r *http.Request, ps httprouter.Params, tenant *TimeseriesTenant) {
+	defer r.Body.Close()
+
+	var attributes HostAttributes
+	if err := json.NewDecoder(r.Body).Decode(&attributes); err != nil {
+		this.sendHTTPError(w, http.StatusBadRequest, "Failed to decode host attributes: %s", err)
+		return
+	}
+	if err := attributes.Validate(); err != nil {
+		this.sendHTTPError(w, http.StatusBadRequest, "Invalid host attributes: %s", err)
+		return
+	}
+	if err := tenant.ReplaceHostAttributes(ps.ByName("host"), attributes); err != nil {
+		this.sendHTTPError(w, http.StatusInternalServerError, "Failed to set host attributes: %s", err)
+		return
+	}
+	w.Write([]byte("{\"status\":0}"))
+}
+
+func (this *TimeseriesServer) DeleteHostAttributesHandler(w http.ResponseWriter, r *http.Request, ps httprouter.Params, tenant *TimeseriesTenant) {
+	if err := tenant.store.DeleteHostAttributes(ps.ByName("host")); err != nil {
+		this.sendHTTPError(w, http.StatusInternalServerError, "Failed to delete host attributes: %s", err)
+		return
+	}
+	w.Write([]byte("{\"status\":0}"))
+}
@@ -0,0 +1,141 @@
+package timeseries
+
+import (
+	"encoding/json"
+	"github.com/influxdata/influxdb/client/v2"
+	"github.com/influxdata/influxdb/models"
+	"log/syslog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestHostAttributesValidate(t *testing.T) {
+	valid := HostAttributes{"role": "web", "dc": "eu,west"}
+	if err := valid.Validate(); err != nil {
+		t.Errorf("Unexpected error: %s", err)
+	}
+	if tags := valid.Tags(); tags["role"] != "web" || tags["dc"] != "eu,west" {
+		t.Errorf("Unexpected tags: %v", tags)
+	}
+
+	for _, attributes := range []HostAttributes{
+		{"role": ""},
+		{"Role": "web"},
+		{"service": "web"},
+	} {
+		if err := attributes.Validate(); err == nil {
+			t.Errorf("Expected error of %v", attributes)
+		}
+	}
+}
+
+func TestQueryHandlerAttribute(t *testing.T) {
+	tenant, cleanup := newTestTenant(t)
+	defer cleanup()
+
+	if err := tenant.updateMetadata([][5]string{
+		{"h1", "CPU", "load1", "GAUGE", ""},
+		{"h2", "CPU", "load1", "GAUGE", ""},
+		{"h3", "CPU", "load1", "GAUGE", ""},
+	}, time.Now().Unix()); err != nil {
+		t.Fatal(err)
+	}
+	if err := tenant.SetHostsAttributes(HostsAttributes{
+		"h1": {"role": "web"},
+		"h2": {"role": "web"},
+		"h3": {"role": "db"},
+	}, false); err != nil {
+		t.Fatal(err)
+	}
+
+	// every statement returns series of h1 and h2 tagged role=web
+	var requests []string
+	influxdb := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		command := r.FormValue("q")
+		requests = append(requests, command)
+
+		var response client.Response
+		for _, statement := range strings.Split(command, "; ") {
+			var result client.Result
+			for i, host := range []string{"h1", "h2"} {
+				row := models.Row{
+					Name:    host,
+					Tags:    map[string]string{"service": "CPU", "metric": "load1", "role": "web"},
+					Columns: []string{"time", "value"},
+					Values:  [][]interface{}{{1500000000, 1 + i}, {1500000300, 3 + i}},
+				}
+				if !strings.Contains(statement, "GROUP BY time(") {
+					row.Columns = []string{"time", "min", "max", "mean", "stddev", "percentile"}
+					row.Values = [][]interface{}{{0, 1, 2, 1.5, 0.5, 2}}
+				}
+				result.Series = append(result.Series, row)
+			}
+			response.Results = append(response.Results, result)
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(response)
+	}))
+	defer influxdb.Close()
+	server := newTestQueryServer(tenant, influxdb.URL)
+
+	query := func(params string) map[string]QueryResultData {
+		w := httptest.NewRecorder()
+		server.QueryHandler(w, httptest.NewRequest("GET", "/query?start=1500000000&end=1500000300&fixed_time_slot=300&hsm=@role=web::CPU::load1"+params, nil), nil, tenant)
+		if w.Code != 200 {
+			t.Fatalf("Unexpected response %d: %s", w.Code, w.Body.String())
+		}
+
+		var results map[string]QueryResultData
+		if err := json.Unmarshal(w.Body.Bytes(), &results); err != nil {
+			t.Fatal(err)
+		}
+		return results
+	}
+
+	results := query("")
+	if len(results) != 2 || len(results["h1::CPU::load1"].Data) != 2 || results["h2::CPU::load1"].Data[1][1] != 4.0 {
+		t.Errorf("Unexpected results: %+v", results)
+	}
+	// hosts are selected by the tag in one statement
+	if len(requests) != 1 || !strings.Contains(requests[0], `FROM "opsview"."autogen"./.*/ WHERE ("service" = 'CPU' AND "metric" = 'load1' AND "role" = 'web')`) ||
+		!strings.Contains(requests[0], `GROUP BY time(300s), service, metric, "role"`) {
+		t.Errorf("Unexpected requests: %v", requests)
+	}
+
+	results = query("&hosts_aggregate=sum")
+	if r, ok := results["@role=web::CPU::load1"]; !ok || len(results) != 1 || r.Data[0][1] != 3.0 || r.Data[1][1] != 7.0 {
+		t.Errorf("Unexpected aggregated results: %+v", results)
+	}
+}
+
+func TestImportHostsAttributesHandler(t *testing.T) {
+	tenant, cleanup := newTestTenant(t)
+	defer cleanup()
+	server := &TimeseriesServer{log: &TimeseriesLogger{logLevel: syslog.LOG_EMERG}}
+
+	post := func(body string) int {
+		w := httptest.NewRecorder()
+		server.ImportHostsAttributesHandler(w, httptest.NewRequest("POST", "/attributes", strings.NewReader(body)), nil, tenant)
+		return w.Code
+	}
+
+	if code := post(`{"h1":{"role":"web"}}`); code != http.StatusOK {
+		t.Errorf("Unexpected response %d", code)
+	}
+	if attributes, err := tenant.store.GetHostAttributes("h1"); err != nil || attributes["role"] != "web" {
+		t.Errorf("Unexpected attributes %v (%v)", attributes, err)
+	}
+	for _, body := range []string{`{"h1":{"role":["web","db"]}}`, `{"h1":{"service":"web"}}`, `{`} {
+		if code := post(body); code != http.StatusBadRequest {
+			t.Errorf("%s: expected 400 got %d", body, code)
+		}
+	}
+
+	tenant.CloseMetadataDB()
+	if code := post(`{"h1":{"role":"db"}}`); code != http.StatusInternalServerError {
+		t.Errorf("Expected 500 of database failure got %d", code)
+	}
+}
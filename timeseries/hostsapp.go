@@ -0,0 +1,143 @@
+package timeseries
+
+import (
+	"encoding/json"
+	"github.com/julienschmidt/httprouter"
+	"net/http"
+)
+
+type HostEntry struct {
+	Host      string `json:"host"`
+	Services  int    `json:"services"`
+	FirstSeen int64  `json:"first_seen,omitempty"`
+	LastSeen  int64  `json:"last_seen,omitempty"`
+}
+
+type ServiceEntry struct {
+	Service   string `json:"service"`
+	Metrics   int    `json:"metrics"`
+	FirstSeen int64  `json:"first_seen,omitempty"`
+	LastSeen  int64  `json:"last_seen,omitempty"`
+}
+
+type MetricEntry struct {
+	Metric     string  `json:"metric"`
+	Dstype     string  `json:"dstype"`
+	Uom        string  `json:"uom"`
+	Unit       string  `json:"unit"`
+	Multiplier float64 `json:"multiplier"`
+	FirstSeen  int64   `json:"first_seen,omitempty"`
+	LastSeen   int64   `json:"last_seen,omitempty"`
+}
+
+func (this *SQLMetadataStore) ListHosts() ([]HostEntry, error) {
+	rows, err := this.db.Query(`
+        SELECT host, COUNT(DISTINCT service), MIN(first_seen), MAX(last_seen)
+        FROM uoms GROUP BY host ORDER BY host
+        `)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	hosts := make([]HostEntry, 0)
+	for rows.Next() {
+		var h HostEntry
+		if err := rows.Scan(&h.Host, &h.Services, &h.FirstSeen, &h.LastSeen); err != nil {
+			return nil, err
+		}
+		hosts = append(hosts, h)
+	}
+
+	return hosts, rows.Err()
+}
+
+func (this *SQLMetadataStore) ListServices(host string) ([]ServiceEntry, error) {
+	rows, err := this.db.Query(`
+        SELECT service, COUNT(*), MIN(first_seen), MAX(last_seen)
+        FROM uoms WHERE host = ? GROUP BY service ORDER BY service
+        `, host)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	services := make([]ServiceEntry, 0)
+	for rows.Next() {
+		var s ServiceEntry
+		if err := rows.Scan(&s.Service, &s.Metrics, &s.FirstSeen, &s.LastSeen); err != nil {
+			return nil, err
+		}
+		services = append(services, s)
+	}
+
+	return services, rows.Err()
+}
+
+func (this *SQLMetadataStore) ListMetrics(host, service string) ([]MetricEntry, error) {
+	rows, err := this.db.Query(`
+        SELECT metric, dstype, uom, first_seen, last_seen
+        FROM uoms WHERE host = ? AND service = ? ORDER BY metric
+        `, host, service)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	metrics := make([]MetricEntry, 0)
+	for rows.Next() {
+		var m MetricEntry
+		if err := rows.Scan(&m.Metric, &m.Dstype, &m.Uom, &m.FirstSeen, &m.LastSeen); err != nil {
+			return nil, err
+		}
+		m.Unit, m.Multiplier = ConvertUom(m.Uom)
+		metrics = append(metrics, m)
+	}
+
+	return metrics, rows.Err()
+}
+
+func (this *TimeseriesServer) sendJSON(w http.ResponseWriter, v interface{}) {
+	json, err := json.Marshal(v)
+
+	if err != nil {
+		this.sendHTTPError(w, http.StatusInternalServerError, "Failed to encode JSON response: %s", err)
+		return
+	}
+	w.Write(json)
+}
+
+func (this *TimeseriesServer) HostsHandler(w http.ResponseWriter, r *http.Request, ps httprouter.Params, tenant *TimeseriesTenant) {
+	hosts, err := tenant.store.ListHosts()
+	if err != nil {
+		this.sendHTTPError(w, http.StatusInternalServerError, "Failed to list hosts: %s", err)
+		return
+	}
+	this.sendJSON(w, hosts)
+}
+
+func (this *TimeseriesServer) ServicesHandler(w http.ResponseWriter, r *http.Request, ps httprouter.Params, tenant *TimeseriesTenant) {
+	services, err := tenant.store.ListServices(ps.ByName("host"))
+	if err != nil {
+		this.sendHTTPError(w, http.StatusInternalServerError, "Failed to list services: %s", err)
+		return
+	}
+	if len(services) == 0 {
+		this.sendHTTPError(w, http.StatusNotFound, "Unknown host: %s", ps.ByName("host"))
+		return
+	}
+	this.sendJSON(w, services)
+}
+
+func (this *TimeseriesServer) MetricsHandler(w http.ResponseWriter, r *http.Request, ps httprouter.Params, tenant *TimeseriesTenant) {
+	metrics, err := tenant.store.ListMetrics(ps.ByName("host"), ps.ByName("service"))
+	if err != nil {
+		this.sendHTTPError(w, http.StatusInternalServerError, "Failed to list metrics: %s", err)
+		return
+	}
+	if len(metrics) == 0 {
+		this.sendHTTPError(w, http.StatusNotFound, "Unknown host or service: %s::%s", ps.ByName("host"), ps.ByName("service"))
+		return
+	}
+	this.sendJSON(w, metrics)
+}
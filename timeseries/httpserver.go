@@ -1,21 +1,24 @@
 package timeseries
 
 import (
-	"database/sql"
+	"context"
 	"encoding/json"
 	"fmt"
 	"github.com/julienschmidt/httprouter"
 	"log"
 	"net/http"
+	"os"
+	"os/signal"
 	"sync"
+	"syscall"
 	"time"
 )
 
 type TimeseriesServer struct {
-	config *TimeseriesConfig
-	metadb *sql.DB
-	queue  chan [][5]string
-	log    *TimeseriesLogger
+	config  *TimeseriesConfig
+	tenants map[string]*TimeseriesTenant
+	log     *TimeseriesLogger
+	servers []*http.Server
 }
 
 type TimeseriesErrorResponse struct {
@@ -41,15 +44,42 @@ func (this *TimeseriesServer) AccessLog(h httprouter.Handle) httprouter.Handle {
 	}
 }
 
-func (this *TimeseriesServer) BasicAuth(h httprouter.Handle, requiredUser, requiredPassword string) httprouter.Handle {
+func (this *TimeseriesServer) BasicAuth(h tenantHandle) httprouter.Handle {
+	return this.authenticate(h, func(user, password string) *TimeseriesTenant {
+		if t, ok := this.tenants[user]; ok && password == t.config.Password {
+			return t
+		}
+		return nil
+	})
+}
+
+// AdminAuth accepts only admin credentials of a tenant, admin endpoints of
+// tenants without them are disabled
+func (this *TimeseriesServer) AdminAuth(h tenantHandle) httprouter.Handle {
+	return this.authenticate(h, func(user, password string) *TimeseriesTenant {
+		for _, t := range this.tenants {
+			if t.config.AdminUser != "" && user == t.config.AdminUser && password == t.config.AdminPassword {
+				return t
+			}
+		}
+		return nil
+	})
+}
+
+func (this *TimeseriesServer) authenticate(h tenantHandle, lookup func(user, password string) *TimeseriesTenant) httprouter.Handle {
 	return func(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
 		user, password, hasAuth := r.BasicAuth()
 
-		if hasAuth && user == requiredUser && password == requiredPassword {
+		var tenant *TimeseriesTenant
+		if hasAuth {
+			tenant = lookup(user, password)
+		}
+
+		if tenant != nil {
 			// always responds with json
 			w.Header().Set("Content-Type", "application/json")
 
-			h(w, r, ps)
+			h(w, r, ps, tenant)
 		} else {
 			w.Header().Set("WWW-Authenticate", "Basic realm=Restricted")
 			w.WriteHeader(http.StatusUnauthorized)
@@ -76,68 +106,207 @@ func (this *TimeseriesServer) sendHTTPError(w http.ResponseWriter, responseCode
 	if err == nil {
 		w.Write(json_error)
 	} else {
-		this.log.Critical("Failed to create error response:", err)
+		this.log.Critical("Failed to create error response: %s", err)
 		w.Write([]byte(`{"error":"Unknown error"}`))
 	}
 }
 
-func (this *TimeseriesServer) launchUpdatesWorker(port int) {
+func (this *TimeseriesServer) newUpdatesServer(port int) *http.Server {
 	bind := fmt.Sprintf("%s:%d", this.config.Server.Updates.Host, port)
 
 	router := httprouter.New()
-	router.POST("/", this.AccessLog(this.BasicAuth(this.WriteHandler, this.config.Server.User, this.config.Server.Password)))
+	router.POST("/", this.AccessLog(this.BasicAuth(this.WriteHandler)))
+	router.GET("/status", this.AccessLog(this.BasicAuth(this.StatusHandler)))
+	router.POST("/attributes", this.AccessLog(this.AdminAuth(this.ImportHostsAttributesHandler)))
+	router.PUT("/hosts/:host/attributes", this.AccessLog(this.AdminAuth(this.SetHostAttributesHandler)))
+	router.DELETE("/hosts/:host/attributes", this.AccessLog(this.AdminAuth(this.DeleteHostAttributesHandler)))
 
-	this.log.Notice("Server started on %s\n", bind)
-	http.ListenAndServe(bind, router)
+	return &http.Server{Addr: bind, Handler: router}
 }
 
-func (this *TimeseriesServer) launchQueriesWorker() {
+func (this *TimeseriesServer) newQueriesServer() *http.Server {
 	bind := fmt.Sprintf("%s:%d", this.config.Server.Queries.Host, this.config.Server.Queries.Port)
 
 	router := httprouter.New()
-	router.GET("/list", this.AccessLog(this.BasicAuth(this.ListHandler, this.config.Server.User, this.config.Server.Password)))
-	router.GET("/query", this.AccessLog(this.BasicAuth(this.QueryHandler, this.config.Server.User, this.config.Server.Password)))
-	router.POST("/query", this.AccessLog(this.BasicAuth(this.QueryHandler, this.config.Server.User, this.config.Server.Password)))
+	router.GET("/list", this.AccessLog(this.BasicAuth(this.ListHandler)))
+	router.GET("/query", this.AccessLog(this.BasicAuth(this.QueryHandler)))
+	router.POST("/query", this.AccessLog(this.BasicAuth(this.QueryHandler)))
+	router.GET("/top", this.AccessLog(this.BasicAuth(this.TopHandler)))
+	router.GET("/metadata/search", this.AccessLog(this.BasicAuth(this.MetadataSearchHandler)))
+	router.GET("/metadata/stale", this.AccessLog(this.BasicAuth(this.StaleMetadataHandler)))
+	router.GET("/stats/cardinality", this.AccessLog(this.BasicAuth(this.CardinalityHandler)))
+	router.GET("/metadata/events", this.AccessLog(this.BasicAuth(this.MetadataEventsHandler)))
+	router.GET("/metadata/conflicts", this.AccessLog(this.BasicAuth(this.MetadataConflictsHandler)))
+	router.GET("/hosts", this.AccessLog(this.BasicAuth(this.HostsHandler)))
+	router.GET("/hosts/:host/services", this.AccessLog(this.BasicAuth(this.ServicesHandler)))
+	router.GET("/hosts/:host/services/:service/metrics", this.AccessLog(this.BasicAuth(this.MetricsHandler)))
+	router.POST("/admin/rename", this.AccessLog(this.AdminAuth(this.RenameHandler)))
+	router.POST("/admin/delete", this.AccessLog(this.AdminAuth(this.DeleteHandler)))
+	router.GET("/admin/jobs", this.AccessLog(this.AdminAuth(this.JobsHandler)))
+	router.GET("/admin/jobs/:id", this.AccessLog(this.AdminAuth(this.JobHandler)))
+	router.GET("/attributes", this.AccessLog(this.BasicAuth(this.ListHostsAttributesHandler)))
+	router.GET("/hosts/:host/attributes", this.AccessLog(this.BasicAuth(this.GetHostAttributesHandler)))
 
-	this.log.Notice("Server started on %s\n", bind)
-	http.ListenAndServe(bind, router)
+	return &http.Server{Addr: bind, Handler: router}
 }
 
-func (this *TimeseriesServer) Launch(role string) {
+func (this *TimeseriesServer) serve(server *http.Server) {
+	this.log.Notice("Server started on %s\n", server.Addr)
+	if err := server.ListenAndServe(); err != http.ErrServerClosed {
+		this.log.Critical("Server on %s failed: %s", server.Addr, err)
+	}
+}
 
-	if err := this.InitMetadataDB(); err != nil {
-		log.Fatalf("Failed to initialize metadata database: %s\n", err)
-		return
+// Shutdown stops accepting connections and waits for in-flight requests, stops
+// background tasks of tenants, then writes queued metadata; whatever is not
+// done before timeout is abandoned
+func (this *TimeseriesServer) Shutdown(timeout time.Duration) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	for _, tenant := range this.tenants {
+		if tenant.events != nil {
+			tenant.events.Close()
+		}
 	}
-	defer this.metadb.Close()
 
 	var wg sync.WaitGroup
-	switch role {
-	case "updates":
-		this.log = NewLogger(this.config.Server.Updates.LogFacility, this.config.Server.Updates.LogLevel, "influxdb-updates")
-		this.queue = make(chan [][5]string, len(this.config.Server.Updates.Ports))
+	for _, server := range this.servers {
 		wg.Add(1)
-		go func() {
+		go func(server *http.Server) {
 			defer wg.Done()
-			this.updateMetadata()
-		}()
-		for _, port := range this.config.Server.Updates.Ports {
-			wg.Add(1)
-			go func(port int) {
-				defer wg.Done()
 
-				this.launchUpdatesWorker(port)
-			}(port)
+			if err := server.Shutdown(ctx); err != nil {
+				this.log.Warning("Server on %s did not finish in-flight requests: %s", server.Addr, err)
+				server.Close()
+			}
+		}(server)
+	}
+	wg.Wait()
+
+	for _, tenant := range this.tenants {
+		if err := tenant.stopWorkers(ctx); err != nil {
+			this.log.Warning("Background tasks of tenant %s did not stop: %s", tenant.Name(), err)
 		}
+	}
+
+	for _, tenant := range this.tenants {
+		if tenant.metadata == nil {
+			continue
+		}
+		if lost, err := tenant.metadata.Drain(ctx); err != nil {
+			this.log.Error("Failed to write metadata of tenant %s on shutdown, %d rows lost: %s", tenant.Name(), lost, err)
+		}
+	}
+}
+
+func (this *TimeseriesServer) Launch(role string) {
+
+	switch role {
+	case "updates":
+		this.log = NewLogger(this.config.Server.Updates.LogFacility, this.config.Server.Updates.LogLevel, "influxdb-updates")
 	case "queries":
 		this.log = NewLogger(this.config.Server.Queries.LogFacility, this.config.Server.Queries.LogLevel, "influxdb-queries")
+	}
+	defer this.log.Close()
+
+	this.tenants = make(map[string]*TimeseriesTenant, len(this.config.Tenants))
+	for i := range this.config.Tenants {
+		tenant := NewTenant(&this.config.Tenants[i], this.log)
+		if err := tenant.InitMetadataDB(); err != nil {
+			log.Fatalf("Failed to initialize metadata database for tenant %s: %s\n", tenant.Name(), err)
+			return
+		}
+		defer tenant.Close()
+
+		this.tenants[tenant.config.User] = tenant
+	}
+
+	switch role {
+	case "updates":
+		for _, tenant := range this.tenants {
+			// used by background tasks
+			tenant := tenant
+			if err := tenant.loadHostTags(); err != nil {
+				log.Fatalf("Failed to load host attributes for tenant %s: %s\n", tenant.Name(), err)
+				return
+			}
+			if this.config.Server.Updates.HostAttributesRefresh > 0 {
+				interval := time.Duration(this.config.Server.Updates.HostAttributesRefresh) * time.Second
+				tenant.goRun(func(stop <-chan struct{}) {
+					tenant.refreshHostTags(interval, stop)
+				})
+			}
+
+			writer, err := NewMetadataWriter(tenant, this.config.Server.Updates.MetadataQueueSize, int64(this.config.Server.Updates.LastSeenResolution))
+			if err != nil {
+				log.Fatalf("Failed to load metadata for tenant %s: %s\n", tenant.Name(), err)
+				return
+			}
+			tenant.metadata = writer
+			interval := time.Duration(this.config.Server.Updates.MetadataFlushInterval) * time.Second
+			tenant.goRun(func(stop <-chan struct{}) {
+				writer.Run(interval, stop)
+			})
+
+			if this.config.Server.Updates.Purge.UnseenDays > 0 {
+				tenant.goRun(func(stop <-chan struct{}) {
+					tenant.runPurge(&this.config.Server.Updates.Purge, stop)
+				})
+			}
+			if this.config.Server.Updates.Cardinality.Interval > 0 {
+				tenant.goRun(func(stop <-chan struct{}) {
+					tenant.runCardinality(&this.config.Server.Updates.Cardinality, stop)
+				})
+			}
+		}
+		for _, port := range this.config.Server.Updates.Ports {
+			this.servers = append(this.servers, this.newUpdatesServer(port))
+		}
+	case "queries":
+		for _, tenant := range this.tenants {
+			cache, err := NewMetadataCache(tenant)
+			if err != nil {
+				log.Fatalf("Failed to load metadata for tenant %s: %s\n", tenant.Name(), err)
+				return
+			}
+			tenant.cache = cache
+			tenant.events = NewMetadataEvents()
+			if cacheConfig := this.config.Server.Queries.Cache; cacheConfig.TTL > 0 && cacheConfig.MaxPoints > 0 {
+				tenant.queryCache = NewQueryCache(time.Duration(cacheConfig.TTL)*time.Second, cacheConfig.MaxPoints)
+			}
+			interval := time.Duration(this.config.Server.Queries.MetadataRefresh) * time.Second
+			tenant.goRun(func(stop <-chan struct{}) {
+				cache.Run(interval, stop)
+			})
+		}
+		this.servers = append(this.servers, this.newQueriesServer())
+	}
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	defer signal.Stop(signals)
+
+	var wg sync.WaitGroup
+	for _, server := range this.servers {
 		wg.Add(1)
-		go func() {
+		go func(server *http.Server) {
 			defer wg.Done()
 
-			this.launchQueriesWorker()
-		}()
+			this.serve(server)
+		}(server)
 	}
+	stopped := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(stopped)
+	}()
 
-	wg.Wait()
+	select {
+	case sig := <-signals:
+		this.log.Notice("Received %s, shutting down", sig)
+		this.Shutdown(time.Duration(this.config.Server.ShutdownTimeout) * time.Second)
+		this.log.Notice("Shutdown complete")
+	case <-stopped:
+	}
 }
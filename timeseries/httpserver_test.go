@@ -0,0 +1,125 @@
+package timeseries
+
+import (
+	"github.com/julienschmidt/httprouter"
+	"io/ioutil"
+	"log/syslog"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestShutdown(t *testing.T) {
+	tenant, cleanup := newTestTenant(t)
+	defer cleanup()
+
+	writer, err := NewMetadataWriter(tenant, 10, 3600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tenant.metadata = writer
+	flushing := make(chan bool)
+	tenant.goRun(func(stop <-chan struct{}) {
+		writer.Run(time.Hour, stop)
+		close(flushing)
+	})
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	started := make(chan bool)
+	server := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		time.Sleep(200 * time.Millisecond)
+		writer.Add([][5]string{{"h1", "CPU", "load1", "GAUGE", ""}})
+		w.Write([]byte("done"))
+	})}
+	go server.Serve(listener)
+
+	this := &TimeseriesServer{
+		tenants: map[string]*TimeseriesTenant{"test": tenant},
+		log:     &TimeseriesLogger{logLevel: syslog.LOG_EMERG},
+		servers: []*http.Server{server},
+	}
+
+	response := make(chan string)
+	go func() {
+		res, err := http.Get("http://" + listener.Addr().String())
+		if err != nil {
+			response <- err.Error()
+			return
+		}
+		defer res.Body.Close()
+		body, _ := ioutil.ReadAll(res.Body)
+		response <- string(body)
+	}()
+
+	<-started
+	this.Shutdown(5 * time.Second)
+
+	if body := <-response; body != "done" {
+		t.Errorf("In-flight request not finished: %s", body)
+	}
+	select {
+	case <-flushing:
+	default:
+		t.Errorf("Metadata writer still running")
+	}
+	if stats := writer.Stats(); stats.Pending != 0 || stats.Written != 1 {
+		t.Errorf("Metadata queue not drained: %+v", stats)
+	}
+	if _, err := http.Get("http://" + listener.Addr().String()); err == nil {
+		t.Errorf("Server still accepts connections")
+	}
+}
+
+func TestAdminAuth(t *testing.T) {
+	tenant := NewTenant(
+		&TimeseriesTenantConfig{Name: "test", User: "u", Password: "p", AdminUser: "a", AdminPassword: "ap"},
+		&TimeseriesLogger{logLevel: syslog.LOG_EMERG},
+	)
+	other := NewTenant(
+		&TimeseriesTenantConfig{Name: "other", User: "o", Password: ""},
+		&TimeseriesLogger{logLevel: syslog.LOG_EMERG},
+	)
+	this := &TimeseriesServer{
+		tenants: map[string]*TimeseriesTenant{"u": tenant, "o": other},
+		log:     &TimeseriesLogger{logLevel: syslog.LOG_EMERG},
+	}
+	handler := func(w http.ResponseWriter, r *http.Request, ps httprouter.Params, t *TimeseriesTenant) {
+		w.Write([]byte(t.Name()))
+	}
+
+	tests := []struct {
+		admin          bool
+		user, password string
+		expected       int
+	}{
+		{false, "u", "p", http.StatusOK},
+		{false, "a", "ap", http.StatusUnauthorized},
+		{true, "a", "ap", http.StatusOK},
+		{true, "u", "p", http.StatusUnauthorized},
+		{true, "a", "p", http.StatusUnauthorized},
+		// tenant without admin credentials
+		{true, "", "", http.StatusUnauthorized},
+	}
+	for _, test := range tests {
+		h := this.BasicAuth(handler)
+		if test.admin {
+			h = this.AdminAuth(handler)
+		}
+		r := httptest.NewRequest("POST", "/admin/rename", nil)
+		r.SetBasicAuth(test.user, test.password)
+		w := httptest.NewRecorder()
+		h(w, r, nil)
+		if w.Code != test.expected {
+			t.Errorf("%+v: got %d", test, w.Code)
+		}
+		if w.Code == http.StatusOK && w.Body.String() != "test" {
+			t.Errorf("%+v: unexpected tenant %s", test, w.Body.String())
+		}
+	}
+}
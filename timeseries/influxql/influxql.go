@@ -0,0 +1,168 @@
+// Package influxql builds InfluxQL statements, identifiers and string literals
+// are always escaped so names containing quotes, backslashes or newlines can
+// not break out of the statement.
+package influxql
+
+import (
+	"fmt"
+	"strings"
+)
+
+var (
+	identReplacer  = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+	stringReplacer = strings.NewReplacer(`\`, `\\`, `'`, `\'`, "\n", `\n`)
+)
+
+// QuoteIdent returns double quoted identifier, e.g. measurement or tag key
+func QuoteIdent(s string) string {
+	return `"` + identReplacer.Replace(s) + `"`
+}
+
+// QuoteString returns single quoted string literal, e.g. tag value
+func QuoteString(s string) string {
+	return `'` + stringReplacer.Replace(s) + `'`
+}
+
+// Measurement returns measurement name qualified with database and retention
+// policy, both can be empty
+func Measurement(database, rp, name string) string {
+	return qualify(database, rp, QuoteIdent(name))
+}
+
+// AllMeasurements returns regular expression matching all measurements
+// qualified with database and retention policy
+func AllMeasurements(database, rp string) string {
+	return qualify(database, rp, "/.*/")
+}
+
+func qualify(database, rp, measurement string) string {
+	if database == "" && rp == "" {
+		return measurement
+	}
+	if database == "" {
+		return QuoteIdent(rp) + "." + measurement
+	}
+
+	rpIdent := ""
+	if rp != "" {
+		rpIdent = QuoteIdent(rp)
+	}
+
+	return QuoteIdent(database) + "." + rpIdent + "." + measurement
+}
+
+// Eq returns condition matching tag with given value
+func Eq(tag, value string) string {
+	return QuoteIdent(tag) + " = " + QuoteString(value)
+}
+
+// Ne returns condition matching tag with other value, empty value matches
+// series having the tag
+func Ne(tag, value string) string {
+	return QuoteIdent(tag) + " != " + QuoteString(value)
+}
+
+// And returns conditions combined with AND in parentheses
+func And(conditions ...string) string {
+	return combine(" AND ", conditions)
+}
+
+// Or returns conditions combined with OR in parentheses
+func Or(conditions ...string) string {
+	return combine(" OR ", conditions)
+}
+
+func combine(operator string, conditions []string) string {
+	if len(conditions) == 1 {
+		return conditions[0]
+	}
+
+	return "(" + strings.Join(conditions, operator) + ")"
+}
+
+type Statement interface {
+	String() string
+}
+
+// Join returns statements to be sent in one request
+func Join(statements ...Statement) string {
+	s := make([]string, len(statements))
+	for i, statement := range statements {
+		s[i] = statement.String()
+	}
+
+	return strings.Join(s, "; ")
+}
+
+// SelectStatement is built from fields and conditions which are expressions
+// written by the caller, only names and values passed to From and WhereTag
+// are escaped
+type SelectStatement struct {
+	fields  []string
+	from    string
+	where   []string
+	groupBy []string
+	fill    string
+}
+
+func Select(fields ...string) *SelectStatement {
+	return &SelectStatement{fields: fields}
+}
+
+// From sets already qualified measurement, see Measurement
+func (this *SelectStatement) From(measurement string) *SelectStatement {
+	this.from = measurement
+	return this
+}
+
+func (this *SelectStatement) Where(condition string) *SelectStatement {
+	this.where = append(this.where, condition)
+	return this
+}
+
+func (this *SelectStatement) WhereTag(tag, value string) *SelectStatement {
+	return this.Where(Eq(tag, value))
+}
+
+// TimeRange limits time to inclusive range, start and end are time
+// expressions such as "1500000000s - 5m"
+func (this *SelectStatement) TimeRange(start, end string) *SelectStatement {
+	return this.Where("time >= " + start).Where("time <= " + end)
+}
+
+func (this *SelectStatement) GroupBy(dimensions ...string) *SelectStatement {
+	this.groupBy = append(this.groupBy, dimensions...)
+	return this
+}
+
+// GroupByTime groups by time intervals of given duration, e.g. "300s"
+func (this *SelectStatement) GroupByTime(interval string) *SelectStatement {
+	return this.GroupBy(fmt.Sprintf("time(%s)", interval))
+}
+
+func (this *SelectStatement) Fill(option string) *SelectStatement {
+	this.fill = option
+	return this
+}
+
+func (this *SelectStatement) String() string {
+	var b strings.Builder
+
+	b.WriteString("SELECT ")
+	b.WriteString(strings.Join(this.fields, ", "))
+	b.WriteString(" FROM ")
+	b.WriteString(this.from)
+	if len(this.where) > 0 {
+		b.WriteString(" WHERE ")
+		b.WriteString(strings.Join(this.where, " AND "))
+	}
+	if len(this.groupBy) > 0 {
+		b.WriteString(" GROUP BY ")
+		b.WriteString(strings.Join(this.groupBy, ", "))
+	}
+	if this.fill != "" {
+		b.WriteString(" fill(" + this.fill + ")")
+	}
+
+	return b.String()
+}
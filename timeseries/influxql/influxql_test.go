@@ -0,0 +1,86 @@
+package influxql
+
+import (
+	"testing"
+)
+
+func TestQuote(t *testing.T) {
+	tests := []struct {
+		in, ident, str string
+	}{
+		{`host1`, `"host1"`, `'host1'`},
+		{`Disk 'C:'`, `"Disk 'C:'"`, `'Disk \'C:\''`},
+		{`my "host"`, `"my \"host\""`, `'my "host"'`},
+		{`C:\`, `"C:\\"`, `'C:\\'`},
+		{`a\'b`, `"a\\'b"`, `'a\\\'b'`},
+		{"two\nlines", `"two\nlines"`, `'two\nlines'`},
+		{``, `""`, `''`},
+	}
+
+	for _, test := range tests {
+		if got := QuoteIdent(test.in); got != test.ident {
+			t.Errorf("QuoteIdent(%q) = %s, expected %s", test.in, got, test.ident)
+		}
+		if got := QuoteString(test.in); got != test.str {
+			t.Errorf("QuoteString(%q) = %s, expected %s", test.in, got, test.str)
+		}
+	}
+}
+
+func TestMeasurement(t *testing.T) {
+	tests := []struct {
+		database, rp, name, expected string
+	}{
+		{"", "", "h1", `"h1"`},
+		{"", "autogen", "h1", `"autogen"."h1"`},
+		{"opsview", "", "h1", `"opsview".."h1"`},
+		{"opsview", "autogen", `h"1`, `"opsview"."autogen"."h\"1"`},
+	}
+
+	for _, test := range tests {
+		if got := Measurement(test.database, test.rp, test.name); got != test.expected {
+			t.Errorf("Measurement(%q, %q, %q) = %s, expected %s", test.database, test.rp, test.name, got, test.expected)
+		}
+	}
+
+	if got := AllMeasurements("opsview", "autogen"); got != `"opsview"."autogen"./.*/` {
+		t.Errorf("Unexpected all measurements: %s", got)
+	}
+}
+
+func TestSelect(t *testing.T) {
+	s := Select("MEAN(value)").
+		From(Measurement("opsview", "autogen", `it's "mine"`)).
+		WhereTag("service", `Disk 'C:'`).
+		WhereTag("metric", `C:\`).
+		TimeRange("1500000000s", "1500003600s + 300s").
+		GroupByTime("300s").
+		Fill("null")
+
+	expected := `SELECT MEAN(value) FROM "opsview"."autogen"."it's \"mine\"" ` +
+		`WHERE "service" = 'Disk \'C:\'' AND "metric" = 'C:\\' AND time >= 1500000000s AND time <= 1500003600s + 300s ` +
+		`GROUP BY time(300s) fill(null)`
+	if got := s.String(); got != expected {
+		t.Errorf("Unexpected statement:\n%s\nexpected:\n%s", got, expected)
+	}
+
+	if got := Select("MIN(value)", "MAX(value)").From(`"h1"`).String(); got != `SELECT MIN(value), MAX(value) FROM "h1"` {
+		t.Errorf("Unexpected statement without conditions: %s", got)
+	}
+
+	where := Or(And(Eq("service", "CPU"), Eq("metric", "load1")), And(Eq("service", "Disk"), Eq("metric", "/")))
+	if where != `(("service" = 'CPU' AND "metric" = 'load1') OR ("service" = 'Disk' AND "metric" = '/'))` {
+		t.Errorf("Unexpected conditions: %s", where)
+	}
+	if ne := Ne("role", ""); ne != `"role" != ''` {
+		t.Errorf("Unexpected not equal condition: %s", ne)
+	}
+	if single := Or(Eq("service", "CPU")); single != `"service" = 'CPU'` {
+		t.Errorf("Unexpected single condition: %s", single)
+	}
+
+	joined := Join(Select("*").From(`"h1"`), Select("*").From(`"h2"`))
+	if joined != `SELECT * FROM "h1"; SELECT * FROM "h2"` {
+		t.Errorf("Unexpected joined statements: %s", joined)
+	}
+}
@@ -0,0 +1,189 @@
+package timeseries
+
+import (
+	"errors"
+	"github.com/julienschmidt/httprouter"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	JOB_PENDING = "pending"
+	JOB_RUNNING = "running"
+	JOB_DONE    = "done"
+	JOB_FAILED  = "failed"
+
+	MAX_FINISHED_JOBS = 100
+)
+
+type Job struct {
+	ID          int64   `json:"id"`
+	Type        string  `json:"type"`
+	Description string  `json:"description"`
+	Status      string  `json:"status"`
+	Progress    float64 `json:"progress"`
+	Error       string  `json:"error,omitempty"`
+	Created     int64   `json:"created"`
+	Started     int64   `json:"started,omitempty"`
+	Finished    int64   `json:"finished,omitempty"`
+}
+
+// jobFunc must return once stop is closed unless stopping would leave data
+// inconsistent, the shutdown waits for it
+type jobFunc func(stop <-chan struct{}, progress func(done, total int)) error
+
+var errJobStopped = errors.New("Stopped by shutdown")
+
+// JobManager runs long lasting jobs of the tenant one at a time and keeps
+// their status, only MAX_FINISHED_JOBS most recent finished jobs are kept
+type JobManager struct {
+	log   *TimeseriesLogger
+	goRun func(run func(stop <-chan struct{}))
+
+	lock   sync.Mutex
+	nextID int64
+	jobs   []*Job
+
+	run sync.Mutex
+}
+
+func NewJobManager(logger *TimeseriesLogger, goRun func(run func(stop <-chan struct{}))) *JobManager {
+	return &JobManager{
+		log:    logger,
+		goRun:  goRun,
+		nextID: 1,
+		jobs:   make([]*Job, 0),
+	}
+}
+
+func (this *JobManager) Submit(jobType, description string, fn jobFunc) Job {
+	this.lock.Lock()
+	job := &Job{
+		ID:          this.nextID,
+		Type:        jobType,
+		Description: description,
+		Status:      JOB_PENDING,
+		Created:     time.Now().Unix(),
+	}
+	this.nextID++
+	this.jobs = append(this.jobs, job)
+	this.expire()
+	snapshot := *job
+	this.lock.Unlock()
+
+	this.goRun(func(stop <-chan struct{}) {
+		this.run.Lock()
+		defer this.run.Unlock()
+
+		var err error
+		select {
+		case <-stop:
+			// pending jobs are not started by the shutdown
+			err = errJobStopped
+		default:
+			this.update(job, func() {
+				job.Status = JOB_RUNNING
+				job.Started = time.Now().Unix()
+			})
+			this.log.Notice("Job %d started: %s", job.ID, description)
+
+			err = fn(stop, func(done, total int) {
+				this.update(job, func() {
+					if total > 0 {
+						job.Progress = float64(done) / float64(total)
+					}
+				})
+			})
+		}
+
+		this.update(job, func() {
+			job.Finished = time.Now().Unix()
+			if err != nil {
+				job.Status = JOB_FAILED
+				job.Error = err.Error()
+			} else {
+				job.Status = JOB_DONE
+				job.Progress = 1
+			}
+		})
+		if err != nil {
+			this.log.Error("Job %d failed: %s", job.ID, err)
+		} else {
+			this.log.Notice("Job %d finished: %s", job.ID, description)
+		}
+	})
+
+	return snapshot
+}
+
+func (this *JobManager) update(job *Job, fn func()) {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	fn()
+}
+
+func (this *JobManager) expire() {
+	finished := 0
+	for _, job := range this.jobs {
+		if job.Finished > 0 {
+			finished++
+		}
+	}
+
+	jobs := make([]*Job, 0, len(this.jobs))
+	for _, job := range this.jobs {
+		if job.Finished > 0 && finished > MAX_FINISHED_JOBS {
+			finished--
+			continue
+		}
+		jobs = append(jobs, job)
+	}
+	this.jobs = jobs
+}
+
+func (this *JobManager) List() []Job {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	jobs := make([]Job, len(this.jobs))
+	for i, job := range this.jobs {
+		jobs[i] = *job
+	}
+
+	return jobs
+}
+
+func (this *JobManager) Get(id int64) (Job, bool) {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	for _, job := range this.jobs {
+		if job.ID == id {
+			return *job, true
+		}
+	}
+
+	return Job{}, false
+}
+
+func (this *TimeseriesServer) JobsHandler(w http.ResponseWriter, r *http.Request, ps httprouter.Params, tenant *TimeseriesTenant) {
+	this.sendJSON(w, tenant.jobs.List())
+}
+
+func (this *TimeseriesServer) JobHandler(w http.ResponseWriter, r *http.Request, ps httprouter.Params, tenant *TimeseriesTenant) {
+	id, err := strconv.ParseInt(ps.ByName("id"), 10, 64)
+	if err != nil {
+		this.sendHTTPError(w, http.StatusBadRequest, "Invalid job id: %s", ps.ByName("id"))
+		return
+	}
+
+	job, ok := tenant.jobs.Get(id)
+	if !ok {
+		this.sendHTTPError(w, http.StatusNotFound, "Unknown job: %d", id)
+		return
+	}
+	this.sendJSON(w, job)
+}
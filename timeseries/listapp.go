@@ -6,8 +6,8 @@ import (
 	"net/http"
 )
 
-func (this *TimeseriesServer) ListHandler(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
-	hsm2u, err := this.ListHSM2U()
+func (this *TimeseriesServer) ListHandler(w http.ResponseWriter, r *http.Request, ps httprouter.Params, tenant *TimeseriesTenant) {
+	hsm2u, err := tenant.ListHSM2U()
 	if err != nil {
 		this.sendHTTPError(w, http.StatusInternalServerError, "Failed to list metadata information: %s", err)
 		return
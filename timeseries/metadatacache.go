@@ -0,0 +1,244 @@
+package timeseries
+
+import (
+	"sync"
+	"time"
+)
+
+const (
+	METADATA_ADDED   = "added"
+	METADATA_REMOVED = "removed"
+	METADATA_CHANGED = "changed"
+)
+
+type MetadataChange struct {
+	Type    string `json:"type"`
+	Host    string `json:"host"`
+	Service string `json:"service"`
+	Metric  string `json:"metric"`
+	Dstype  string `json:"dstype,omitempty"`
+	Uom     string `json:"uom,omitempty"`
+}
+
+// MetadataCache keeps whole uoms table in memory for the queries role, it is
+// reloaded when version of the store changes
+type MetadataCache struct {
+	tenant *TimeseriesTenant
+
+	lock    sync.RWMutex
+	version int64
+	entries map[metadataKey]metadataValue
+	history map[metadataKey][]MetadataHistoryEntry
+	hsm2u   metatadaMapH2S
+}
+
+func NewMetadataCache(tenant *TimeseriesTenant) (*MetadataCache, error) {
+	cache := &MetadataCache{
+		tenant:  tenant,
+		entries: make(map[metadataKey]metadataValue),
+	}
+	if _, err := cache.Refresh(); err != nil {
+		return nil, err
+	}
+
+	return cache, nil
+}
+
+func (this *MetadataCache) Refresh() ([]MetadataChange, error) {
+	version, err := this.tenant.store.Version()
+	if err != nil {
+		return nil, err
+	}
+
+	this.lock.RLock()
+	unchanged := version == this.version && this.hsm2u != nil
+	this.lock.RUnlock()
+	if unchanged {
+		return nil, nil
+	}
+
+	data, err := this.tenant.ListMetadata()
+	if err != nil {
+		return nil, err
+	}
+
+	// only Refresh modifies the cache
+	this.lock.RLock()
+	changes := make([]MetadataChange, 0)
+	seen := make(map[metadataKey]bool, len(data))
+	for _, i := range data {
+		key := metadataKey{i[0], i[1], i[2]}
+		seen[key] = true
+
+		if v, ok := this.entries[key]; !ok {
+			changes = append(changes, MetadataChange{METADATA_ADDED, i[0], i[1], i[2], i[3], i[4]})
+		} else if v != (metadataValue{i[3], i[4]}) {
+			changes = append(changes, MetadataChange{METADATA_CHANGED, i[0], i[1], i[2], i[3], i[4]})
+		}
+	}
+	for key := range this.entries {
+		if !seen[key] {
+			changes = append(changes, MetadataChange{Type: METADATA_REMOVED, Host: key.host, Service: key.service, Metric: key.metric})
+		}
+	}
+	this.lock.RUnlock()
+
+	history, err := this.loadHistory(changes)
+	if err != nil {
+		return nil, err
+	}
+
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	for _, change := range changes {
+		key := metadataKey{change.Host, change.Service, change.Metric}
+		if change.Type == METADATA_REMOVED {
+			delete(this.entries, key)
+		} else {
+			this.entries[key] = metadataValue{change.Dstype, change.Uom}
+		}
+	}
+
+	this.version = version
+	this.history = history
+	if len(changes) > 0 || this.hsm2u == nil {
+		this.buildHSM2U()
+	}
+
+	return changes, nil
+}
+
+// loadHistory returns history of all series, only history of series with
+// changed dstype or uom is reloaded unless some series were removed as
+// renaming moves history to another series
+func (this *MetadataCache) loadHistory(changes []MetadataChange) (map[metadataKey][]MetadataHistoryEntry, error) {
+	this.lock.RLock()
+	current := this.history
+	this.lock.RUnlock()
+
+	full := current == nil
+	changed := make([]metadataKey, 0)
+	for _, change := range changes {
+		switch change.Type {
+		case METADATA_REMOVED:
+			full = true
+		case METADATA_CHANGED:
+			changed = append(changed, metadataKey{change.Host, change.Service, change.Metric})
+		}
+	}
+
+	if full {
+		all, err := this.tenant.store.ListAllMetadataHistory()
+		if err != nil {
+			return nil, err
+		}
+		history := make(map[metadataKey][]MetadataHistoryEntry)
+		for _, e := range all {
+			key := metadataKey{e.Host, e.Service, e.Metric}
+			history[key] = append(history[key], e)
+		}
+		return history, nil
+	}
+	if len(changed) == 0 {
+		return current, nil
+	}
+
+	// the map is shared with readers of the previous one
+	history := make(map[metadataKey][]MetadataHistoryEntry, len(current)+len(changed))
+	for key, entries := range current {
+		history[key] = entries
+	}
+	for _, key := range changed {
+		entries, err := this.tenant.store.SeriesHistory(key.host, key.service, key.metric)
+		if err != nil {
+			return nil, err
+		}
+		history[key] = entries
+	}
+
+	return history, nil
+}
+
+func (this *MetadataCache) buildHSM2U() {
+	hsm2u := make(metatadaMapH2S)
+	for key, value := range this.entries {
+		sm, ok := hsm2u[key.host]
+		if !ok {
+			sm = make(metatadaMapS2M)
+			hsm2u[key.host] = sm
+		}
+
+		mm, ok := sm[key.service]
+		if !ok {
+			mm = make(metatadaMapM2U)
+			sm[key.service] = mm
+		}
+		mm[key.metric] = value.uom
+	}
+	this.hsm2u = hsm2u
+}
+
+func (this *MetadataCache) Run(interval time.Duration, stop <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+
+		changes, err := this.Refresh()
+		if err != nil {
+			this.tenant.log.Error("Failed to refresh metadata cache: %s", err)
+			continue
+		}
+		if len(changes) > 0 {
+			this.tenant.log.Info("Metadata cache of tenant %s refreshed: %d changes", this.tenant.Name(), len(changes))
+			if this.tenant.queryCache != nil {
+				this.tenant.queryCache.Invalidate(changes)
+			}
+			if this.tenant.events != nil {
+				this.tenant.events.Publish(changes)
+			}
+		}
+	}
+}
+
+func (this *MetadataCache) Get(host, service, metric string) (dstype, uom string, ok bool) {
+	this.lock.RLock()
+	defer this.lock.RUnlock()
+
+	v, ok := this.entries[metadataKey{host, service, metric}]
+
+	return v.dstype, v.uom, ok
+}
+
+func (this *MetadataCache) History(host, service, metric string) []MetadataHistoryEntry {
+	this.lock.RLock()
+	defer this.lock.RUnlock()
+
+	return this.history[metadataKey{host, service, metric}]
+}
+
+func (this *MetadataCache) List() [][5]string {
+	this.lock.RLock()
+	defer this.lock.RUnlock()
+
+	data := make([][5]string, 0, len(this.entries))
+	for key, value := range this.entries {
+		data = append(data, [5]string{key.host, key.service, key.metric, value.dstype, value.uom})
+	}
+
+	return data
+}
+
+// HSM2U returns shared map, callers must not modify it
+func (this *MetadataCache) HSM2U() metatadaMapH2S {
+	this.lock.RLock()
+	defer this.lock.RUnlock()
+
+	return this.hsm2u
+}
@@ -0,0 +1,112 @@
+package timeseries
+
+import (
+	"testing"
+	"time"
+)
+
+func TestMetadataCacheRefresh(t *testing.T) {
+	tenant, cleanup := newTestTenant(t)
+	defer cleanup()
+
+	if err := tenant.updateMetadata([][5]string{
+		{"h1", "CPU", "load1", "GAUGE", ""},
+		{"h1", "Disk", "/", "GAUGE", "MB"},
+	}, time.Now().Unix()); err != nil {
+		t.Fatal(err)
+	}
+
+	cache, err := NewMetadataCache(tenant)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tenant.cache = cache
+
+	if hsm2u, _ := tenant.ListHSM2U(); hsm2u["h1"]["Disk"]["/"] != "MB" {
+		t.Errorf("Unexpected cached metadata %v", hsm2u)
+	}
+
+	if changes, err := cache.Refresh(); err != nil || len(changes) != 0 {
+		t.Errorf("Expected no changes got %v (%v)", changes, err)
+	}
+
+	if err := tenant.updateMetadata([][5]string{
+		{"h1", "Disk", "/", "GAUGE", "B"},
+		{"h2", "CPU", "load1", "GAUGE", ""},
+	}, time.Now().Unix()); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := testMetadataDB(tenant).Exec("DELETE FROM uoms WHERE host = 'h1' AND service = 'CPU'"); err != nil {
+		t.Fatal(err)
+	}
+
+	changes, err := cache.Refresh()
+	if err != nil {
+		t.Fatal(err)
+	}
+	counts := make(map[string]int)
+	for _, change := range changes {
+		counts[change.Type]++
+	}
+	if counts[METADATA_ADDED] != 1 || counts[METADATA_CHANGED] != 1 || counts[METADATA_REMOVED] != 1 {
+		t.Errorf("Unexpected changes %+v", changes)
+	}
+
+	if _, uom, ok := cache.Get("h1", "Disk", "/"); !ok || uom != "B" {
+		t.Errorf("Expected B got %s", uom)
+	}
+	if hsm2u, _ := tenant.ListHSM2U(); len(hsm2u) != 2 || len(hsm2u["h1"]) != 1 {
+		t.Errorf("Unexpected cached metadata %v", hsm2u)
+	}
+	if history := cache.History("h1", "Disk", "/"); len(history) != 1 || history[0].PrevUom != "MB" {
+		t.Errorf("Unexpected history %+v", history)
+	}
+
+	// history of the changed series is reloaded
+	if err := tenant.updateMetadata([][5]string{{"h1", "Disk", "/", "GAUGE", "KB"}}, time.Now().Unix()); err != nil {
+		t.Fatal(err)
+	}
+	if changes, err := cache.Refresh(); err != nil || len(changes) != 1 {
+		t.Errorf("Expected one change got %v (%v)", changes, err)
+	}
+	if history := cache.History("h1", "Disk", "/"); len(history) != 2 || history[1].PrevUom != "B" || history[1].Uom != "KB" {
+		t.Errorf("Unexpected history %+v", history)
+	}
+}
+
+func TestMetadataCacheVersion(t *testing.T) {
+	tenant, cleanup := newTestTenant(t)
+	defer cleanup()
+
+	// as on PostgreSQL and MySQL
+	store := tenant.store.(*SQLMetadataStore)
+	dialect := *store.dialect
+	dialect.dataVersion = ""
+	store.dialect, store.db.dialect = &dialect, &dialect
+
+	if err := tenant.updateMetadata([][5]string{{"h1", "CPU", "load1", "GAUGE", ""}}, time.Now().Unix()); err != nil {
+		t.Fatal(err)
+	}
+	cache, err := NewMetadataCache(tenant)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// seen again, version is unchanged and metadata is not reloaded
+	if err := tenant.updateMetadata([][5]string{{"h1", "CPU", "load1", "GAUGE", ""}}, time.Now().Unix()); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := testMetadataDB(tenant).Exec("DELETE FROM uoms"); err != nil {
+		t.Fatal(err)
+	}
+	if changes, err := cache.Refresh(); err != nil || len(changes) != 0 {
+		t.Errorf("Expected no changes got %v (%v)", changes, err)
+	}
+
+	if err := tenant.updateMetadata([][5]string{{"h2", "CPU", "load1", "GAUGE", ""}}, time.Now().Unix()); err != nil {
+		t.Fatal(err)
+	}
+	if changes, err := cache.Refresh(); err != nil || len(changes) != 2 {
+		t.Errorf("Expected two changes got %v (%v)", changes, err)
+	}
+}
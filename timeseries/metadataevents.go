@@ -0,0 +1,172 @@
+package timeseries
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/julienschmidt/httprouter"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	// events queued for a client before it is disconnected
+	METADATA_EVENTS_BUFFER = 1000
+	// interval of comments keeping idle connections open
+	METADATA_EVENTS_KEEPALIVE = 30 * time.Second
+)
+
+type metadataEvent struct {
+	id     int64
+	change MetadataChange
+}
+
+// MetadataEvents delivers changes found by metadata cache to subscribed
+// clients, slow clients which do not keep up are dropped
+type MetadataEvents struct {
+	lock        sync.Mutex
+	lastID      int64
+	subscribers map[chan metadataEvent]bool
+	closed      bool
+}
+
+func NewMetadataEvents() *MetadataEvents {
+	return &MetadataEvents{
+		subscribers: make(map[chan metadataEvent]bool),
+	}
+}
+
+func (this *MetadataEvents) Subscribe() chan metadataEvent {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	ch := make(chan metadataEvent, METADATA_EVENTS_BUFFER)
+	if this.closed {
+		close(ch)
+		return ch
+	}
+	this.subscribers[ch] = true
+
+	return ch
+}
+
+func (this *MetadataEvents) Unsubscribe(ch chan metadataEvent) {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	if this.subscribers[ch] {
+		delete(this.subscribers, ch)
+		close(ch)
+	}
+}
+
+func (this *MetadataEvents) Publish(changes []MetadataChange) {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	for _, change := range changes {
+		this.lastID++
+		event := metadataEvent{this.lastID, change}
+		for ch := range this.subscribers {
+			select {
+			case ch <- event:
+			default:
+				delete(this.subscribers, ch)
+				close(ch)
+			}
+		}
+	}
+}
+
+// Close disconnects all subscribers, used on shutdown as streaming requests
+// would never finish otherwise
+func (this *MetadataEvents) Close() {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	this.closed = true
+	for ch := range this.subscribers {
+		delete(this.subscribers, ch)
+		close(ch)
+	}
+}
+
+func (this *MetadataEvents) Closed() bool {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	return this.closed
+}
+
+func (this *MetadataEvents) Subscribers() int {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	return len(this.subscribers)
+}
+
+func (this *TimeseriesServer) MetadataEventsHandler(w http.ResponseWriter, r *http.Request, ps httprouter.Params, tenant *TimeseriesTenant) {
+	flusher, ok := w.(http.Flusher)
+	if !ok || tenant.events == nil {
+		this.sendHTTPError(w, http.StatusInternalServerError, "Streaming is not supported")
+		return
+	}
+
+	// dstype and uom filters apply to the new values, removals match only
+	// host, service and metric
+	filter, err := ParseMetadataFilter(r.URL.Query())
+	if err != nil {
+		this.sendHTTPError(w, http.StatusBadRequest, "Failed to parse query: %s", err)
+		return
+	}
+	removalFilter := *filter
+	removalFilter.Dstype = ""
+	removalFilter.Uom = ""
+
+	events := tenant.events.Subscribe()
+	defer tenant.events.Unsubscribe(events)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.WriteHeader(http.StatusOK)
+	fmt.Fprintf(w, "retry: %d\n\n", METADATA_EVENTS_KEEPALIVE/time.Millisecond)
+	flusher.Flush()
+
+	keepalive := time.NewTicker(METADATA_EVENTS_KEEPALIVE)
+	defer keepalive.Stop()
+
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-keepalive.C:
+			fmt.Fprint(w, ": keepalive\n\n")
+			flusher.Flush()
+		case event, ok := <-events:
+			if !ok {
+				if !tenant.events.Closed() {
+					this.log.Warning("Metadata events client %s dropped: too slow", r.RemoteAddr)
+				}
+				return
+			}
+
+			c := event.change
+			matching := filter
+			if c.Type == METADATA_REMOVED {
+				matching = &removalFilter
+			}
+			if !matching.Match([5]string{c.Host, c.Service, c.Metric, c.Dstype, c.Uom}) {
+				continue
+			}
+
+			data, err := json.Marshal(c)
+			if err != nil {
+				this.log.Error("Failed to encode metadata event: %s", err)
+				continue
+			}
+			fmt.Fprintf(w, "id: %d\nevent: %s\ndata: %s\n\n", event.id, c.Type, data)
+			flusher.Flush()
+		}
+	}
+}
@@ -0,0 +1,94 @@
+package timeseries
+
+import (
+	"bufio"
+	"log/syslog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestMetadataEvents(t *testing.T) {
+	events := NewMetadataEvents()
+	fast := events.Subscribe()
+	slow := events.Subscribe()
+
+	changes := make([]MetadataChange, METADATA_EVENTS_BUFFER)
+	for i := range changes {
+		changes[i] = MetadataChange{Type: METADATA_ADDED, Host: "h"}
+	}
+	events.Publish(changes[:1])
+	<-fast
+	events.Publish(changes)
+
+	if n := events.Subscribers(); n != 1 {
+		t.Errorf("Expected slow subscriber dropped, %d left", n)
+	}
+	if _, ok := <-slow; !ok {
+		t.Errorf("Expected queued events delivered before close")
+	}
+	events.Unsubscribe(fast)
+	events.Unsubscribe(slow)
+}
+
+func TestMetadataEventsHandler(t *testing.T) {
+	server := &TimeseriesServer{log: &TimeseriesLogger{logLevel: syslog.LOG_EMERG}}
+	tenant := &TimeseriesTenant{events: NewMetadataEvents()}
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		server.MetadataEventsHandler(w, r, nil, tenant)
+	}))
+	defer ts.Close()
+
+	res, err := http.Get(ts.URL + "/metadata/events?host=web")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+	if ct := res.Header.Get("Content-Type"); ct != "text/event-stream" {
+		t.Errorf("Unexpected content type %s", ct)
+	}
+
+	tenant.events.Publish([]MetadataChange{
+		{Type: METADATA_ADDED, Host: "db1", Service: "Disk", Metric: "/", Dstype: "GAUGE", Uom: "MB"},
+		{Type: METADATA_REMOVED, Host: "web1", Service: "Disk", Metric: "/"},
+	})
+
+	reader := bufio.NewReader(res.Body)
+	var lines []string
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			t.Fatal(err)
+		}
+		if strings.HasPrefix(line, "data: ") {
+			lines = append(lines, line)
+			break
+		}
+		if strings.HasPrefix(line, "id: ") || strings.HasPrefix(line, "event: ") {
+			lines = append(lines, line)
+		}
+	}
+
+	expected := "id: 2\nevent: removed\ndata: {\"type\":\"removed\",\"host\":\"web1\",\"service\":\"Disk\",\"metric\":\"/\"}\n"
+	if got := strings.Join(lines, ""); got != expected {
+		t.Errorf("Expected %q got %q", expected, got)
+	}
+}
+
+func TestMetadataEventsClose(t *testing.T) {
+	events := NewMetadataEvents()
+	ch := events.Subscribe()
+	events.Close()
+
+	if _, ok := <-ch; ok {
+		t.Errorf("Subscriber not disconnected")
+	}
+	if _, ok := <-events.Subscribe(); ok {
+		t.Errorf("Subscribed to closed events")
+	}
+	if !events.Closed() || events.Subscribers() != 0 {
+		t.Errorf("Unexpected state after close")
+	}
+}
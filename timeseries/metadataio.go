@@ -0,0 +1,176 @@
+package timeseries
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	METADATA_FORMAT_JSON = "json"
+	METADATA_FORMAT_CSV  = "csv"
+
+	// number of invalid rows reported by ValidateMetadata
+	METADATA_MAX_ERRORS = 10
+)
+
+var metadataCSVHeader = []string{"host", "service", "metric", "dstype", "uom"}
+
+type MetadataImportReport struct {
+	Imported int `json:"imported"`
+	Removed  int `json:"removed"`
+}
+
+func ValidUom(uom string) bool {
+	if uom == "" {
+		return true
+	}
+	_, ok := uom_mapping[uom]
+
+	return ok
+}
+
+func (this *TimeseriesTenant) ExportMetadata(w io.Writer, format string, filter *MetadataFilter) (int, error) {
+	data, err := this.SearchMetadata(filter)
+	if err != nil {
+		return 0, err
+	}
+	sort.Slice(data, func(i, j int) bool {
+		for k := 0; k < 3; k++ {
+			if data[i][k] != data[j][k] {
+				return data[i][k] < data[j][k]
+			}
+		}
+		return false
+	})
+
+	switch format {
+	case METADATA_FORMAT_JSON:
+		entries := make([]MetadataEntry, len(data))
+		for n, i := range data {
+			entries[n] = MetadataEntry{i[0], i[1], i[2], i[3], i[4]}
+		}
+		encoder := json.NewEncoder(w)
+		encoder.SetIndent("", "  ")
+		if err := encoder.Encode(entries); err != nil {
+			return 0, err
+		}
+	case METADATA_FORMAT_CSV:
+		writer := csv.NewWriter(w)
+		writer.Write(metadataCSVHeader)
+		for _, i := range data {
+			writer.Write(i[:])
+		}
+		writer.Flush()
+		if err := writer.Error(); err != nil {
+			return 0, err
+		}
+	default:
+		return 0, errors.New(fmt.Sprintf("Invalid format: %s", format))
+	}
+
+	return len(data), nil
+}
+
+func ReadMetadata(r io.Reader, format string) ([][5]string, error) {
+	data := make([][5]string, 0)
+
+	switch format {
+	case METADATA_FORMAT_JSON:
+		var entries []MetadataEntry
+		if err := json.NewDecoder(r).Decode(&entries); err != nil {
+			return nil, err
+		}
+		for _, e := range entries {
+			data = append(data, [5]string{e.Host, e.Service, e.Metric, e.Dstype, e.Uom})
+		}
+	case METADATA_FORMAT_CSV:
+		reader := csv.NewReader(r)
+		reader.FieldsPerRecord = len(metadataCSVHeader)
+		records, err := reader.ReadAll()
+		if err != nil {
+			return nil, err
+		}
+		for n, record := range records {
+			if n == 0 && strings.Join(record, ",") == strings.Join(metadataCSVHeader, ",") {
+				continue
+			}
+			data = append(data, [5]string{record[0], record[1], record[2], record[3], record[4]})
+		}
+	default:
+		return nil, errors.New(fmt.Sprintf("Invalid format: %s", format))
+	}
+
+	return data, nil
+}
+
+func ValidateMetadata(data [][5]string, allowUnknownUom bool) error {
+	problems := make([]string, 0)
+	seen := make(map[metadataKey]bool, len(data))
+	for n, i := range data {
+		var problem string
+		key := metadataKey{i[0], i[1], i[2]}
+		switch {
+		case i[0] == "" || i[1] == "" || i[2] == "":
+			problem = "host, service and metric are required"
+		case seen[key]:
+			problem = "duplicated entry"
+		case !ValidDstype(i[3]):
+			problem = fmt.Sprintf("invalid dstype %q", i[3])
+		case !allowUnknownUom && !ValidUom(i[4]):
+			problem = fmt.Sprintf("unknown uom %q", i[4])
+		}
+		seen[key] = true
+
+		if problem != "" {
+			problems = append(problems, fmt.Sprintf("#%d %s::%s::%s: %s", n+1, i[0], i[1], i[2], problem))
+		}
+	}
+
+	if len(problems) == 0 {
+		return nil
+	}
+	if len(problems) > METADATA_MAX_ERRORS {
+		problems = append(problems[:METADATA_MAX_ERRORS], fmt.Sprintf("and %d more", len(problems)-METADATA_MAX_ERRORS))
+	}
+
+	return errors.New("Invalid metadata: " + strings.Join(problems, "; "))
+}
+
+// with replace existing rows matching the filter but not imported are removed
+func (this *TimeseriesTenant) ImportMetadata(data [][5]string, replace bool, filter *MetadataFilter) (*MetadataImportReport, error) {
+	report := &MetadataImportReport{}
+
+	var existing [][5]string
+	if replace {
+		var err error
+		if existing, err = this.SearchMetadata(filter); err != nil {
+			return nil, err
+		}
+	}
+	imported := make(map[metadataKey]bool, len(data))
+	for _, i := range data {
+		imported[metadataKey{i[0], i[1], i[2]}] = true
+	}
+	remove := make([]metadataKey, 0)
+	for _, i := range existing {
+		if key := (metadataKey{i[0], i[1], i[2]}); !imported[key] {
+			remove = append(remove, key)
+		}
+	}
+
+	// import is applied completely or not at all
+	removed, err := this.store.ImportMetadata(data, remove, time.Now().Unix())
+	if err != nil {
+		return nil, err
+	}
+	report.Imported = len(data)
+	report.Removed = removed
+
+	return report, nil
+}
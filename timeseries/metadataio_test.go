@@ -0,0 +1,94 @@
+package timeseries
+
+import (
+	"bytes"
+	"net/url"
+	"reflect"
+	"testing"
+)
+
+func TestExportImportMetadata(t *testing.T) {
+	tenant, cleanup := newTestTenant(t)
+	defer cleanup()
+
+	rows := [][5]string{
+		{"db1", "Disk", "/", "GAUGE", "MB"},
+		{"web1", "Disk", "/", "GAUGE", "MB"},
+		{"web1", "HTTP", "time", "GAUGE", "s"},
+	}
+	if err := tenant.updateMetadata(rows, 100); err != nil {
+		t.Fatal(err)
+	}
+
+	filter, err := ParseMetadataFilter(url.Values{"host": {"web*"}, "match": {"glob"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, format := range []string{METADATA_FORMAT_JSON, METADATA_FORMAT_CSV} {
+		var buf bytes.Buffer
+		n, err := tenant.ExportMetadata(&buf, format, filter)
+		if err != nil || n != 2 {
+			t.Fatalf("%s: expected 2 rows exported got %d (%v)", format, n, err)
+		}
+		data, err := ReadMetadata(&buf, format)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(data, rows[1:]) {
+			t.Errorf("%s: expected %+v got %+v", format, rows[1:], data)
+		}
+	}
+
+	// failed removal leaves imported rows out as well
+	if _, err := testMetadataDB(tenant).Exec("CREATE TRIGGER keep_uoms BEFORE DELETE ON uoms BEGIN SELECT RAISE(ABORT, 'kept'); END"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tenant.ImportMetadata([][5]string{{"web2", "Disk", "/", "GAUGE", "B"}}, true, filter); err == nil {
+		t.Error("Expected import to fail")
+	}
+	if data, err := tenant.SearchMetadata(&MetadataFilter{}); err != nil || len(data) != 3 {
+		t.Errorf("Expected 3 rows got %+v (%v)", data, err)
+	}
+	if _, err := testMetadataDB(tenant).Exec("DROP TRIGGER keep_uoms"); err != nil {
+		t.Fatal(err)
+	}
+
+	// web1 HTTP is removed, db1 is outside of the filter
+	report, err := tenant.ImportMetadata([][5]string{{"web1", "Disk", "/", "GAUGE", "B"}}, true, filter)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Imported != 1 || report.Removed != 1 {
+		t.Errorf("Unexpected report %+v", report)
+	}
+	data, err := tenant.SearchMetadata(&MetadataFilter{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(data) != 2 {
+		t.Errorf("Expected 2 rows got %+v", data)
+	}
+}
+
+func TestValidateMetadata(t *testing.T) {
+	if err := ValidateMetadata([][5]string{{"h", "s", "m", "GAUGE", "MB"}, {"h", "s", "n", "COUNTER", ""}}, false); err != nil {
+		t.Errorf("Unexpected error %s", err)
+	}
+
+	invalid := [][][5]string{
+		{{"h", "s", "", "GAUGE", ""}},
+		{{"h", "s", "m", "GAUGE", ""}, {"h", "s", "m", "GAUGE", ""}},
+		{{"h", "s", "m", "gauge", ""}},
+		{{"h", "s", "m", "GAUGE", "furlongs"}},
+	}
+	for _, data := range invalid {
+		if err := ValidateMetadata(data, false); err == nil {
+			t.Errorf("Expected error for %+v", data)
+		}
+	}
+
+	if err := ValidateMetadata([][5]string{{"h", "s", "m", "GAUGE", "furlongs"}}, true); err != nil {
+		t.Errorf("Unexpected error %s", err)
+	}
+}
@@ -0,0 +1,633 @@
+package timeseries
+
+import (
+	"database/sql"
+	"sort"
+	"sync"
+)
+
+type memoryMetadataRow struct {
+	metadataValue
+	firstSeen, lastSeen int64
+}
+
+// MemoryMetadataStore keeps metadata in memory of the process only, it is
+// meant for tests and tools which do not need the metadata to persist
+type MemoryMetadataStore struct {
+	lock        sync.RWMutex
+	version     int64
+	uoms        map[metadataKey]memoryMetadataRow
+	archive     map[metadataKey]memoryMetadataRow
+	history     []MetadataHistoryEntry
+	cardinality []CardinalitySample
+	attributes  HostsAttributes
+}
+
+func NewMemoryMetadataStore() *MemoryMetadataStore {
+	return &MemoryMetadataStore{}
+}
+
+func (this *MemoryMetadataStore) InitMetadataDB() error {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	if this.uoms == nil {
+		this.uoms = make(map[metadataKey]memoryMetadataRow)
+		this.archive = make(map[metadataKey]memoryMetadataRow)
+		this.attributes = make(HostsAttributes)
+	}
+
+	return nil
+}
+
+func (this *MemoryMetadataStore) Close() error {
+	return nil
+}
+
+func (this *MemoryMetadataStore) Version() (int64, error) {
+	this.lock.RLock()
+	defer this.lock.RUnlock()
+
+	return this.version, nil
+}
+
+func (this *MemoryMetadataStore) UpdateMetadata(data [][5]string, seen int64) error {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	this.update(data, seen)
+
+	return nil
+}
+
+func (this *MemoryMetadataStore) update(data [][5]string, seen int64) {
+	changed := false
+	for _, i := range data {
+		key := metadataKey{i[0], i[1], i[2]}
+		row, ok := this.uoms[key]
+		if ok && (row.dstype != i[3] || row.uom != i[4]) {
+			this.history = append(this.history, MetadataHistoryEntry{i[0], i[1], i[2], row.dstype, row.uom, i[3], i[4], seen})
+			changed = true
+		} else if !ok {
+			changed = true
+		}
+		if row.firstSeen == 0 {
+			row.firstSeen = seen
+		}
+		row.metadataValue = metadataValue{i[3], i[4]}
+		row.lastSeen = seen
+		this.uoms[key] = row
+	}
+	if changed {
+		this.version++
+	}
+}
+
+func (this *MemoryMetadataStore) ImportMetadata(data [][5]string, remove []metadataKey, seen int64) (int, error) {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	this.update(data, seen)
+	for _, key := range remove {
+		delete(this.uoms, key)
+	}
+	if len(remove) > 0 {
+		this.version++
+	}
+
+	return len(remove), nil
+}
+
+func (this *MemoryMetadataStore) ListMetadata() ([][5]string, error) {
+	this.lock.RLock()
+	defer this.lock.RUnlock()
+
+	data := make([][5]string, 0, len(this.uoms))
+	for key, row := range this.uoms {
+		data = append(data, [5]string{key.host, key.service, key.metric, row.dstype, row.uom})
+	}
+
+	return data, nil
+}
+
+func (this *MemoryMetadataStore) ListMetadataLastSeen() (map[metadataKey]metadataState, error) {
+	this.lock.RLock()
+	defer this.lock.RUnlock()
+
+	states := make(map[metadataKey]metadataState, len(this.uoms))
+	for key, row := range this.uoms {
+		states[key] = metadataState{row.metadataValue, row.lastSeen}
+	}
+
+	return states, nil
+}
+
+func (this *MemoryMetadataStore) ListHSM2U() (metatadaMapH2S, error) {
+	this.lock.RLock()
+	defer this.lock.RUnlock()
+
+	hsm2u := make(metatadaMapH2S)
+	for key, row := range this.uoms {
+		sm, ok := hsm2u[key.host]
+		if !ok {
+			sm = make(metatadaMapS2M)
+			hsm2u[key.host] = sm
+		}
+		mm, ok := sm[key.service]
+		if !ok {
+			mm = make(metatadaMapM2U)
+			sm[key.service] = mm
+		}
+		mm[key.metric] = row.uom
+	}
+
+	return hsm2u, nil
+}
+
+func (this *MemoryMetadataStore) GetHSMmetadata(host, service, metric string) (string, string, error) {
+	this.lock.RLock()
+	defer this.lock.RUnlock()
+
+	row, ok := this.uoms[metadataKey{host, service, metric}]
+	if !ok {
+		return "", "", sql.ErrNoRows
+	}
+
+	return row.dstype, row.uom, nil
+}
+
+// sortedKeys returns keys of rows matching filter ordered by host, service
+// and metric
+func (this *MemoryMetadataStore) sortedKeys(filter func(key metadataKey) bool) []metadataKey {
+	keys := make([]metadataKey, 0)
+	for key := range this.uoms {
+		if filter(key) {
+			keys = append(keys, key)
+		}
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		a, b := keys[i], keys[j]
+		if a.host != b.host {
+			return a.host < b.host
+		}
+		if a.service != b.service {
+			return a.service < b.service
+		}
+		return a.metric < b.metric
+	})
+
+	return keys
+}
+
+func (this *MemoryMetadataStore) ListHosts() ([]HostEntry, error) {
+	this.lock.RLock()
+	defer this.lock.RUnlock()
+
+	hosts := make([]HostEntry, 0)
+	var service string
+	for _, key := range this.sortedKeys(func(metadataKey) bool { return true }) {
+		row := this.uoms[key]
+		last := len(hosts) - 1
+		if last < 0 || hosts[last].Host != key.host {
+			hosts = append(hosts, HostEntry{Host: key.host, FirstSeen: row.firstSeen})
+			last++
+			service = ""
+		}
+		h := &hosts[last]
+		if h.Services == 0 || service != key.service {
+			h.Services++
+			service = key.service
+		}
+		if row.firstSeen < h.FirstSeen {
+			h.FirstSeen = row.firstSeen
+		}
+		if row.lastSeen > h.LastSeen {
+			h.LastSeen = row.lastSeen
+		}
+	}
+
+	return hosts, nil
+}
+
+func (this *MemoryMetadataStore) ListServices(host string) ([]ServiceEntry, error) {
+	this.lock.RLock()
+	defer this.lock.RUnlock()
+
+	services := make([]ServiceEntry, 0)
+	for _, key := range this.sortedKeys(func(key metadataKey) bool { return key.host == host }) {
+		row := this.uoms[key]
+		last := len(services) - 1
+		if last < 0 || services[last].Service != key.service {
+			services = append(services, ServiceEntry{Service: key.service, FirstSeen: row.firstSeen})
+			last++
+		}
+		s := &services[last]
+		s.Metrics++
+		if row.firstSeen < s.FirstSeen {
+			s.FirstSeen = row.firstSeen
+		}
+		if row.lastSeen > s.LastSeen {
+			s.LastSeen = row.lastSeen
+		}
+	}
+
+	return services, nil
+}
+
+func (this *MemoryMetadataStore) ListMetrics(host, service string) ([]MetricEntry, error) {
+	this.lock.RLock()
+	defer this.lock.RUnlock()
+
+	metrics := make([]MetricEntry, 0)
+	for _, key := range this.sortedKeys(func(key metadataKey) bool { return key.host == host && key.service == service }) {
+		row := this.uoms[key]
+		m := MetricEntry{Metric: key.metric, Dstype: row.dstype, Uom: row.uom, FirstSeen: row.firstSeen, LastSeen: row.lastSeen}
+		m.Unit, m.Multiplier = ConvertUom(m.Uom)
+		metrics = append(metrics, m)
+	}
+
+	return metrics, nil
+}
+
+// listHistory returns entries matching filter ordered by time of the change
+func (this *MemoryMetadataStore) listHistory(filter func(e MetadataHistoryEntry) bool) []MetadataHistoryEntry {
+	entries := make([]MetadataHistoryEntry, 0)
+	for _, e := range this.history {
+		if filter(e) {
+			entries = append(entries, e)
+		}
+	}
+	sort.SliceStable(entries, func(i, j int) bool {
+		return entries[i].ChangedAt < entries[j].ChangedAt
+	})
+
+	return entries
+}
+
+func (this *MemoryMetadataStore) ListMetadataHistory(since int64, limit int) ([]MetadataHistoryEntry, error) {
+	this.lock.RLock()
+	defer this.lock.RUnlock()
+
+	entries := this.listHistory(func(e MetadataHistoryEntry) bool { return e.ChangedAt >= since })
+	for i, j := 0, len(entries)-1; i < j; i, j = i+1, j-1 {
+		entries[i], entries[j] = entries[j], entries[i]
+	}
+	if len(entries) > limit {
+		entries = entries[:limit]
+	}
+
+	return entries, nil
+}
+
+func (this *MemoryMetadataStore) ListAllMetadataHistory() ([]MetadataHistoryEntry, error) {
+	this.lock.RLock()
+	defer this.lock.RUnlock()
+
+	return this.listHistory(func(MetadataHistoryEntry) bool { return true }), nil
+}
+
+func (this *MemoryMetadataStore) SeriesHistory(host, service, metric string) ([]MetadataHistoryEntry, error) {
+	this.lock.RLock()
+	defer this.lock.RUnlock()
+
+	return this.listHistory(func(e MetadataHistoryEntry) bool {
+		return e.Host == host && e.Service == service && e.Metric == metric
+	}), nil
+}
+
+func (this *MemoryMetadataStore) InitLastSeen(now int64) error {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	for key, row := range this.uoms {
+		if row.lastSeen == 0 {
+			row.lastSeen = now
+			this.uoms[key] = row
+		}
+	}
+
+	return nil
+}
+
+func (this *MemoryMetadataStore) StaleMetadata(unseenSince int64) ([]StaleMetadataEntry, error) {
+	this.lock.RLock()
+	defer this.lock.RUnlock()
+
+	entries := make([]StaleMetadataEntry, 0)
+	for _, key := range this.sortedKeys(func(key metadataKey) bool {
+		row := this.uoms[key]
+		return row.lastSeen > 0 && row.lastSeen < unseenSince
+	}) {
+		row := this.uoms[key]
+		entries = append(entries, StaleMetadataEntry{
+			MetadataEntry: MetadataEntry{key.host, key.service, key.metric, row.dstype, row.uom},
+			FirstSeen:     row.firstSeen,
+			LastSeen:      row.lastSeen,
+		})
+	}
+
+	return entries, nil
+}
+
+func (this *MemoryMetadataStore) PurgeMetadata(entries []StaleMetadataEntry, unseenSince int64, archive bool) ([]StaleMetadataEntry, error) {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	purged := make([]StaleMetadataEntry, 0, len(entries))
+	for _, e := range entries {
+		key := metadataKey{e.Host, e.Service, e.Metric}
+		row, ok := this.uoms[key]
+		if !ok || row.lastSeen >= unseenSince {
+			continue
+		}
+		if archive {
+			this.archive[key] = row
+		}
+		delete(this.uoms, key)
+		purged = append(purged, e)
+	}
+	if len(purged) > 0 {
+		this.version++
+	}
+
+	return purged, nil
+}
+
+// matches reports keys selected by the request, empty service or metric
+// selects all of them
+func (this *MemoryMetadataStore) matches(req AdminRequest, host, service, metric string) bool {
+	return host == req.Host &&
+		(req.Service == "" || service == req.Service) &&
+		(req.Metric == "" || metric == req.Metric)
+}
+
+func (this *MemoryMetadataStore) MetadataExists(req AdminRequest) (bool, error) {
+	this.lock.RLock()
+	defer this.lock.RUnlock()
+
+	for key := range this.uoms {
+		if this.matches(req, key.host, key.service, key.metric) {
+			return true, nil
+		}
+	}
+
+	return false, nil
+}
+
+func (this *MemoryMetadataStore) RenameMetadata(req AdminRequest) error {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	selector := AdminRequest{Host: req.Host}
+	switch req.Type {
+	case "service":
+		selector.Service = req.Service
+	case "metric":
+		selector.Service, selector.Metric = req.Service, req.Metric
+	}
+	rename := func(host, service, metric string) (string, string, string) {
+		switch req.Type {
+		case "host":
+			return req.To, service, metric
+		case "service":
+			return host, req.To, metric
+		}
+		return host, service, req.To
+	}
+
+	// renamed rows replace existing rows with the same keys
+	renamed := make(map[metadataKey]memoryMetadataRow)
+	for key, row := range this.uoms {
+		if this.matches(selector, key.host, key.service, key.metric) {
+			delete(this.uoms, key)
+			host, service, metric := rename(key.host, key.service, key.metric)
+			renamed[metadataKey{host, service, metric}] = row
+		}
+	}
+	for key, row := range renamed {
+		this.uoms[key] = row
+	}
+	for i, e := range this.history {
+		if this.matches(selector, e.Host, e.Service, e.Metric) {
+			this.history[i].Host, this.history[i].Service, this.history[i].Metric = rename(e.Host, e.Service, e.Metric)
+		}
+	}
+	if attributes, ok := this.attributes[req.Host]; ok && req.Type == "host" {
+		delete(this.attributes, req.Host)
+		this.attributes[req.To] = attributes
+	}
+	this.version++
+
+	return nil
+}
+
+func (this *MemoryMetadataStore) DeleteMetadata(req AdminRequest) error {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	selector := AdminRequest{Host: req.Host}
+	switch req.Type {
+	case "service":
+		selector.Service = req.Service
+	case "metric":
+		selector.Service, selector.Metric = req.Service, req.Metric
+	}
+
+	for key := range this.uoms {
+		if this.matches(selector, key.host, key.service, key.metric) {
+			delete(this.uoms, key)
+		}
+	}
+	history := this.history[:0]
+	for _, e := range this.history {
+		if !this.matches(selector, e.Host, e.Service, e.Metric) {
+			history = append(history, e)
+		}
+	}
+	this.history = history
+	if req.Type == "host" {
+		delete(this.attributes, req.Host)
+	}
+	this.version++
+
+	return nil
+}
+
+func (this *MemoryMetadataStore) MetadataCardinality() (series, hosts, services int, err error) {
+	this.lock.RLock()
+	defer this.lock.RUnlock()
+
+	distinctHosts := make(map[string]bool)
+	distinctServices := make(map[[2]string]bool)
+	for key := range this.uoms {
+		distinctHosts[key.host] = true
+		distinctServices[[2]string{key.host, key.service}] = true
+	}
+
+	return len(this.uoms), len(distinctHosts), len(distinctServices), nil
+}
+
+func (this *MemoryMetadataStore) TopCardinality(limit int, byService bool) ([]CardinalityEntry, error) {
+	this.lock.RLock()
+	defer this.lock.RUnlock()
+
+	counts := make(map[[2]string]int)
+	for key := range this.uoms {
+		k := [2]string{key.host, ""}
+		if byService {
+			k[1] = key.service
+		}
+		counts[k]++
+	}
+
+	entries := make([]CardinalityEntry, 0, len(counts))
+	for k, n := range counts {
+		entries = append(entries, CardinalityEntry{Host: k[0], Service: k[1], Series: n})
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		a, b := entries[i], entries[j]
+		if a.Series != b.Series {
+			return a.Series > b.Series
+		}
+		if a.Host != b.Host {
+			return a.Host < b.Host
+		}
+		return a.Service < b.Service
+	})
+	if len(entries) > limit {
+		entries = entries[:limit]
+	}
+
+	return entries, nil
+}
+
+func (this *MemoryMetadataStore) HostCardinality(host string) (int, error) {
+	this.lock.RLock()
+	defer this.lock.RUnlock()
+
+	series := 0
+	for key := range this.uoms {
+		if key.host == host {
+			series++
+		}
+	}
+
+	return series, nil
+}
+
+func (this *MemoryMetadataStore) CardinalityHistory(since int64) ([]CardinalitySample, error) {
+	this.lock.RLock()
+	defer this.lock.RUnlock()
+
+	samples := make([]CardinalitySample, 0)
+	for _, s := range this.cardinality {
+		if s.RecordedAt >= since {
+			samples = append(samples, s)
+		}
+	}
+
+	return samples, nil
+}
+
+func (this *MemoryMetadataStore) RecordCardinality(sample *CardinalitySample, retainSince int64) (*CardinalitySample, error) {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	var previous *CardinalitySample
+	if n := len(this.cardinality); n > 0 {
+		last := this.cardinality[n-1]
+		previous = &last
+	}
+
+	samples := make([]CardinalitySample, 0, len(this.cardinality)+1)
+	for _, s := range this.cardinality {
+		if s.RecordedAt >= retainSince && s.RecordedAt != sample.RecordedAt {
+			samples = append(samples, s)
+		}
+	}
+	samples = append(samples, *sample)
+	sort.Slice(samples, func(i, j int) bool {
+		return samples[i].RecordedAt < samples[j].RecordedAt
+	})
+	this.cardinality = samples
+
+	return previous, nil
+}
+
+func (this *MemoryMetadataStore) ListHostsAttributes() (HostsAttributes, error) {
+	this.lock.RLock()
+	defer this.lock.RUnlock()
+
+	hostsAttributes := make(HostsAttributes, len(this.attributes))
+	for host, attributes := range this.attributes {
+		hostsAttributes[host] = copyHostAttributes(attributes)
+	}
+
+	return hostsAttributes, nil
+}
+
+func (this *MemoryMetadataStore) GetHostAttributes(host string) (HostAttributes, error) {
+	this.lock.RLock()
+	defer this.lock.RUnlock()
+
+	return copyHostAttributes(this.attributes[host]), nil
+}
+
+func (this *MemoryMetadataStore) SetHostsAttributes(hostsAttributes HostsAttributes, replace bool) error {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	if replace {
+		this.attributes = make(HostsAttributes)
+	}
+	for host, attributes := range hostsAttributes {
+		current, ok := this.attributes[host]
+		if !ok {
+			current = make(HostAttributes)
+			this.attributes[host] = current
+		}
+		for name, value := range attributes {
+			current[name] = value
+		}
+	}
+
+	return nil
+}
+
+func (this *MemoryMetadataStore) ReplaceHostAttributes(host string, attributes HostAttributes) error {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	this.attributes[host] = copyHostAttributes(attributes)
+
+	return nil
+}
+
+func (this *MemoryMetadataStore) DeleteHostAttributes(host string) error {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	delete(this.attributes, host)
+
+	return nil
+}
+
+func (this *MemoryMetadataStore) AttributeMetadata(name, value, service, metric string) ([][2]string, error) {
+	this.lock.RLock()
+	defer this.lock.RUnlock()
+
+	seen := make(map[[2]string]bool)
+	metadata := make([][2]string, 0, 1)
+	for host, attributes := range this.attributes {
+		if !attributes.has(name, value) {
+			continue
+		}
+		row, ok := this.uoms[metadataKey{host, service, metric}]
+		if m := [2]string{row.dstype, row.uom}; ok && !seen[m] {
+			seen[m] = true
+			metadata = append(metadata, m)
+		}
+	}
+
+	return metadata, nil
+}
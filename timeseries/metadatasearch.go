@@ -0,0 +1,277 @@
+package timeseries
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/julienschmidt/httprouter"
+	"net/http"
+	"net/url"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const (
+	METADATA_SEARCH_LIMIT     = 100
+	METADATA_SEARCH_MAX_LIMIT = 10000
+)
+
+type MetadataEntry struct {
+	Host    string `json:"host"`
+	Service string `json:"service"`
+	Metric  string `json:"metric"`
+	Dstype  string `json:"dstype"`
+	Uom     string `json:"uom"`
+}
+
+type MetadataSearchResult struct {
+	Total      int             `json:"total"`
+	Items      []MetadataEntry `json:"items"`
+	NextCursor string          `json:"next_cursor,omitempty"`
+}
+
+type MetadataFilter struct {
+	Host    *regexp.Regexp
+	Service *regexp.Regexp
+	Metric  *regexp.Regexp
+	Dstype  string
+	Uom     string
+}
+
+var metadataSortFields = map[string]int{
+	"host":    0,
+	"service": 1,
+	"metric":  2,
+	"dstype":  3,
+	"uom":     4,
+}
+
+func globToRegexp(pattern string, ignoreCase bool) (*regexp.Regexp, error) {
+	expr := regexp.QuoteMeta(pattern)
+	expr = strings.Replace(expr, `\*`, ".*", -1)
+	expr = strings.Replace(expr, `\?`, ".", -1)
+
+	return compilePattern("^"+expr+"$", ignoreCase)
+}
+
+func compilePattern(expr string, ignoreCase bool) (*regexp.Regexp, error) {
+	if ignoreCase {
+		expr = "(?i)" + expr
+	}
+
+	return regexp.Compile(expr)
+}
+
+func newPatternRegexp(pattern, match string, ignoreCase bool) (*regexp.Regexp, error) {
+	if pattern == "" {
+		return nil, nil
+	}
+
+	switch match {
+	case "", "substring":
+		return compilePattern(regexp.QuoteMeta(pattern), ignoreCase)
+	case "glob":
+		return globToRegexp(pattern, ignoreCase)
+	case "regex":
+		return compilePattern(pattern, ignoreCase)
+	}
+
+	return nil, errors.New(fmt.Sprintf("Invalid match type: %s", match))
+}
+
+func ParseMetadataFilter(query url.Values) (*MetadataFilter, error) {
+	var err error
+	filter := &MetadataFilter{
+		Dstype: query.Get("dstype"),
+		Uom:    query.Get("uom"),
+	}
+
+	match := query.Get("match")
+	ignoreCase := query.Get("ignore_case") == "1"
+
+	if filter.Host, err = newPatternRegexp(query.Get("host"), match, ignoreCase); err != nil {
+		return nil, errors.New(fmt.Sprintf("Invalid parameter host: %s", err))
+	}
+	if filter.Service, err = newPatternRegexp(query.Get("service"), match, ignoreCase); err != nil {
+		return nil, errors.New(fmt.Sprintf("Invalid parameter service: %s", err))
+	}
+	if filter.Metric, err = newPatternRegexp(query.Get("metric"), match, ignoreCase); err != nil {
+		return nil, errors.New(fmt.Sprintf("Invalid parameter metric: %s", err))
+	}
+
+	return filter, nil
+}
+
+func (this *MetadataFilter) Match(i [5]string) bool {
+	if this.Host != nil && !this.Host.MatchString(i[0]) {
+		return false
+	}
+	if this.Service != nil && !this.Service.MatchString(i[1]) {
+		return false
+	}
+	if this.Metric != nil && !this.Metric.MatchString(i[2]) {
+		return false
+	}
+	if this.Dstype != "" && this.Dstype != i[3] {
+		return false
+	}
+	if this.Uom != "" && this.Uom != i[4] {
+		return false
+	}
+
+	return true
+}
+
+func (this *TimeseriesTenant) SearchMetadata(filter *MetadataFilter) ([][5]string, error) {
+	var data [][5]string
+	if this.cache != nil {
+		data = this.cache.List()
+	} else {
+		var err error
+		if data, err = this.ListMetadata(); err != nil {
+			return nil, err
+		}
+	}
+
+	found := make([][5]string, 0)
+	for _, i := range data {
+		if filter.Match(i) {
+			found = append(found, i)
+		}
+	}
+
+	return found, nil
+}
+
+type metadataSorter struct {
+	fields []int
+	desc   []bool
+}
+
+// host, service and metric are always used to break ties
+func parseMetadataSort(sortBy string) (*metadataSorter, error) {
+	sorter := &metadataSorter{}
+	used := make(map[int]bool)
+
+	if sortBy != "" {
+		for _, field := range strings.Split(sortBy, ",") {
+			desc := strings.HasPrefix(field, "-")
+			i, ok := metadataSortFields[strings.TrimPrefix(field, "-")]
+			if !ok {
+				return nil, errors.New(fmt.Sprintf("Invalid sort field: %s", field))
+			}
+			if used[i] {
+				continue
+			}
+			used[i] = true
+			sorter.fields = append(sorter.fields, i)
+			sorter.desc = append(sorter.desc, desc)
+		}
+	}
+	for i := 0; i < 3; i++ {
+		if !used[i] {
+			sorter.fields = append(sorter.fields, i)
+			sorter.desc = append(sorter.desc, false)
+		}
+	}
+
+	return sorter, nil
+}
+
+func (this *metadataSorter) less(a, b [5]string) bool {
+	for n, i := range this.fields {
+		if a[i] == b[i] {
+			continue
+		}
+		if this.desc[n] {
+			return a[i] > b[i]
+		}
+		return a[i] < b[i]
+	}
+
+	return false
+}
+
+func encodeMetadataCursor(i [5]string) string {
+	data, _ := json.Marshal(i)
+
+	return base64.URLEncoding.EncodeToString(data)
+}
+
+func decodeMetadataCursor(cursor string) ([5]string, error) {
+	var i [5]string
+
+	data, err := base64.URLEncoding.DecodeString(cursor)
+	if err == nil {
+		err = json.Unmarshal(data, &i)
+	}
+
+	return i, err
+}
+
+func (this *TimeseriesServer) MetadataSearchHandler(w http.ResponseWriter, r *http.Request, ps httprouter.Params, tenant *TimeseriesTenant) {
+	query := r.URL.Query()
+
+	filter, err := ParseMetadataFilter(query)
+	if err != nil {
+		this.sendHTTPError(w, http.StatusBadRequest, "Failed to parse query: %s", err)
+		return
+	}
+
+	sorter, err := parseMetadataSort(query.Get("sort"))
+	if err != nil {
+		this.sendHTTPError(w, http.StatusBadRequest, "Failed to parse query: %s", err)
+		return
+	}
+
+	limit := METADATA_SEARCH_LIMIT
+	if v := query.Get("limit"); v != "" {
+		if limit, err = strconv.Atoi(v); err != nil || limit < 1 || limit > METADATA_SEARCH_MAX_LIMIT {
+			this.sendHTTPError(w, http.StatusBadRequest, "Failed to parse query: Invalid parameter: limit")
+			return
+		}
+	}
+
+	found, err := tenant.SearchMetadata(filter)
+	if err != nil {
+		this.sendHTTPError(w, http.StatusInternalServerError, "Failed to search metadata information: %s", err)
+		return
+	}
+	sort.Slice(found, func(i, j int) bool { return sorter.less(found[i], found[j]) })
+
+	start := 0
+	if cursor := query.Get("cursor"); cursor != "" {
+		last, err := decodeMetadataCursor(cursor)
+		if err != nil {
+			this.sendHTTPError(w, http.StatusBadRequest, "Failed to parse query: Invalid parameter: cursor")
+			return
+		}
+		start = sort.Search(len(found), func(i int) bool { return sorter.less(last, found[i]) })
+	}
+	end := start + limit
+	if end > len(found) {
+		end = len(found)
+	}
+
+	result := MetadataSearchResult{
+		Total: len(found),
+		Items: make([]MetadataEntry, 0, end-start),
+	}
+	for _, i := range found[start:end] {
+		result.Items = append(result.Items, MetadataEntry{i[0], i[1], i[2], i[3], i[4]})
+	}
+	if end < len(found) {
+		result.NextCursor = encodeMetadataCursor(found[end-1])
+	}
+
+	json, err := json.Marshal(result)
+
+	if err != nil {
+		this.sendHTTPError(w, http.StatusInternalServerError, "Failed to encode JSON response: %s", err)
+		return
+	}
+	w.Write(json)
+}
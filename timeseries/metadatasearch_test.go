@@ -0,0 +1,64 @@
+package timeseries
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestMetadataSearchHandler(t *testing.T) {
+	tenant, cleanup := newTestTenant(t)
+	defer cleanup()
+
+	if err := tenant.updateMetadata([][5]string{
+		{"web1", "CPU", "load1", "GAUGE", ""},
+		{"web2", "CPU", "load1", "GAUGE", ""},
+		{"web3", "CPU", "load1", "GAUGE", ""},
+		{"web3", "Disk", "/", "GAUGE", "MB"},
+		{"db1", "CPU", "load1", "GAUGE", ""},
+	}, time.Now().Unix()); err != nil {
+		t.Fatal(err)
+	}
+
+	server := &TimeseriesServer{log: tenant.log}
+	search := func(query string) MetadataSearchResult {
+		var result MetadataSearchResult
+
+		w := httptest.NewRecorder()
+		server.MetadataSearchHandler(w, httptest.NewRequest("GET", "/metadata/search?"+query, nil), nil, tenant)
+		if w.Code != 200 {
+			t.Fatalf("%s: unexpected response %d %s", query, w.Code, w.Body)
+		}
+		if err := json.Unmarshal(w.Body.Bytes(), &result); err != nil {
+			t.Fatal(err)
+		}
+		return result
+	}
+
+	result := search("host=web*&match=glob&service=CPU&sort=-host&limit=2")
+	if result.Total != 3 || len(result.Items) != 2 || result.Items[0].Host != "web3" || result.Items[1].Host != "web2" || result.NextCursor == "" {
+		t.Errorf("Unexpected first page %+v", result)
+	}
+
+	result = search("host=web*&match=glob&service=CPU&sort=-host&limit=2&cursor=" + result.NextCursor)
+	if result.Total != 3 || len(result.Items) != 1 || result.Items[0].Host != "web1" || result.NextCursor != "" {
+		t.Errorf("Unexpected second page %+v", result)
+	}
+
+	result = search("host=^(db|web)1$&match=regex")
+	if result.Total != 2 || result.Items[0].Host != "db1" {
+		t.Errorf("Unexpected regex result %+v", result)
+	}
+
+	result = search("uom=MB")
+	if result.Total != 1 || result.Items[0].Metric != "/" {
+		t.Errorf("Unexpected uom result %+v", result)
+	}
+
+	w := httptest.NewRecorder()
+	server.MetadataSearchHandler(w, httptest.NewRequest("GET", "/metadata/search?sort=size", nil), nil, tenant)
+	if w.Code != 400 {
+		t.Errorf("Expected 400 for invalid sort got %d", w.Code)
+	}
+}
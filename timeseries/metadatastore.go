@@ -0,0 +1,476 @@
+package timeseries
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	_ "github.com/go-sql-driver/mysql"
+	_ "github.com/lib/pq"
+	_ "github.com/mattn/go-sqlite3"
+	"sync"
+)
+
+// MetadataStore keeps dstype and uom of series with their history, host
+// attributes and cardinality samples. All changes of uoms are seen by Version.
+type MetadataStore interface {
+	InitMetadataDB() error
+	Close() error
+	// Version changes whenever uoms are modified, also by other servers
+	Version() (int64, error)
+
+	UpdateMetadata(data [][5]string, seen int64) error
+	// ImportMetadata updates data and removes rows of remove at once
+	ImportMetadata(data [][5]string, remove []metadataKey, seen int64) (int, error)
+	ListMetadata() ([][5]string, error)
+	ListMetadataLastSeen() (map[metadataKey]metadataState, error)
+	ListHSM2U() (metatadaMapH2S, error)
+	GetHSMmetadata(host, service, metric string) (string, string, error)
+
+	ListHosts() ([]HostEntry, error)
+	ListServices(host string) ([]ServiceEntry, error)
+	ListMetrics(host, service string) ([]MetricEntry, error)
+
+	ListMetadataHistory(since int64, limit int) ([]MetadataHistoryEntry, error)
+	ListAllMetadataHistory() ([]MetadataHistoryEntry, error)
+	SeriesHistory(host, service, metric string) ([]MetadataHistoryEntry, error)
+
+	InitLastSeen(now int64) error
+	StaleMetadata(unseenSince int64) ([]StaleMetadataEntry, error)
+	PurgeMetadata(entries []StaleMetadataEntry, unseenSince int64, archive bool) ([]StaleMetadataEntry, error)
+
+	MetadataExists(req AdminRequest) (bool, error)
+	RenameMetadata(req AdminRequest) error
+	DeleteMetadata(req AdminRequest) error
+
+	MetadataCardinality() (series, hosts, services int, err error)
+	TopCardinality(limit int, byService bool) ([]CardinalityEntry, error)
+	HostCardinality(host string) (int, error)
+	CardinalityHistory(since int64) ([]CardinalitySample, error)
+	// RecordCardinality stores the sample and returns the previous one, nil if
+	// there is none; samples older than retainSince are removed
+	RecordCardinality(sample *CardinalitySample, retainSince int64) (*CardinalitySample, error)
+
+	ListHostsAttributes() (HostsAttributes, error)
+	GetHostAttributes(host string) (HostAttributes, error)
+	SetHostsAttributes(hostsAttributes HostsAttributes, replace bool) error
+	ReplaceHostAttributes(host string, attributes HostAttributes) error
+	DeleteHostAttributes(host string) error
+	AttributeMetadata(name, value, service, metric string) ([][2]string, error)
+}
+
+// SQLMetadataStore keeps metadata in SQLite file or in PostgreSQL/MySQL
+// database shared by servers running on different hosts
+type SQLMetadataStore struct {
+	dsn     string
+	dialect *sqlDialect
+	db      *metadataDB
+	log     *TimeseriesLogger
+
+	// data version of SQLite changes only with commits of other connections
+	versionLock sync.Mutex
+	versionConn *sql.Conn
+}
+
+func NewMetadataStore(config *TimeseriesTenantConfig, logger *TimeseriesLogger) (MetadataStore, error) {
+	driver := config.MetadataDriver
+	if driver == "" {
+		driver = METADATA_SQLITE
+	}
+	dialect, err := getSQLDialect(driver)
+	if err != nil {
+		return nil, err
+	}
+
+	return &SQLMetadataStore{
+		dsn:     config.MetadataDB,
+		dialect: dialect,
+		log:     logger,
+	}, nil
+}
+
+func (this *SQLMetadataStore) InitMetadataDB() error {
+	meta, err := sql.Open(this.dialect.name, this.dsn)
+	if err != nil {
+		return err
+	}
+	db := &metadataDB{meta, this.dialect}
+
+	if err := this.createSchema(db); err != nil {
+		meta.Close()
+		return err
+	}
+	this.db = db
+
+	return nil
+}
+
+func (this *SQLMetadataStore) createSchema(db *metadataDB) error {
+	ts := this.dialect.timestamp
+	tables := []string{`
+        CREATE TABLE IF NOT EXISTS uoms (
+            host VARCHAR(255) NOT NULL,
+            service VARCHAR(255) NOT NULL,
+            metric VARCHAR(255) NOT NULL,
+            dstype VARCHAR(255) NOT NULL,
+            uom VARCHAR(255) NOT NULL,
+            first_seen ` + ts + ` NOT NULL DEFAULT 0,
+            last_seen ` + ts + ` NOT NULL DEFAULT 0,
+            PRIMARY KEY(host, service, metric)
+        )`, `
+        CREATE TABLE IF NOT EXISTS uoms_archive (
+            host VARCHAR(255) NOT NULL,
+            service VARCHAR(255) NOT NULL,
+            metric VARCHAR(255) NOT NULL,
+            dstype VARCHAR(255) NOT NULL,
+            uom VARCHAR(255) NOT NULL,
+            first_seen ` + ts + ` NOT NULL DEFAULT 0,
+            last_seen ` + ts + ` NOT NULL DEFAULT 0,
+            archived_at ` + ts + ` NOT NULL,
+            PRIMARY KEY(host, service, metric)
+        )`, `
+        CREATE TABLE IF NOT EXISTS uoms_history (
+            host VARCHAR(255) NOT NULL,
+            service VARCHAR(255) NOT NULL,
+            metric VARCHAR(255) NOT NULL,
+            prev_dstype VARCHAR(255) NOT NULL,
+            prev_uom VARCHAR(255) NOT NULL,
+            dstype VARCHAR(255) NOT NULL,
+            uom VARCHAR(255) NOT NULL,
+            changed_at ` + ts + ` NOT NULL
+        )`, `
+        CREATE TABLE IF NOT EXISTS cardinality_history (
+            recorded_at ` + ts + ` NOT NULL,
+            series INTEGER NOT NULL,
+            hosts INTEGER NOT NULL,
+            influxdb_series INTEGER NOT NULL,
+            PRIMARY KEY(recorded_at)
+        )`, `
+        CREATE TABLE IF NOT EXISTS metadata_version (
+            id INTEGER NOT NULL,
+            version BIGINT NOT NULL,
+            PRIMARY KEY(id)
+        )`, `
+        CREATE TABLE IF NOT EXISTS host_attributes (
+            host VARCHAR(255) NOT NULL,
+            name VARCHAR(255) NOT NULL,
+            value VARCHAR(255) NOT NULL,
+            PRIMARY KEY(host, name, value)
+        )`,
+	}
+	for _, table := range tables {
+		if _, err := db.Exec(table + this.dialect.tableOptions); err != nil {
+			return err
+		}
+	}
+
+	_, err := db.Exec("INSERT INTO metadata_version (id, version) VALUES (1, 0) " +
+		this.dialect.conflict([]string{"id"}, "version = metadata_version.version"))
+	if err != nil {
+		return err
+	}
+
+	if this.dialect.name == METADATA_SQLITE {
+		// databases created before first_seen/last_seen were tracked
+		for _, column := range []string{"first_seen", "last_seen"} {
+			if err := addColumnIfMissing(db, "uoms", column, "INTEGER NOT NULL DEFAULT 0"); err != nil {
+				return err
+			}
+		}
+	}
+
+	if err := this.createIndex(db, "uoms_history_changed_at", "uoms_history", "changed_at"); err != nil {
+		return err
+	}
+
+	if this.dialect.name == METADATA_SQLITE {
+		if _, err := db.Exec("PRAGMA journal_mode=WAL"); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (this *SQLMetadataStore) createIndex(db *metadataDB, name, table, columns string) error {
+	// MySQL has no CREATE INDEX IF NOT EXISTS
+	if this.dialect.name == METADATA_MYSQL {
+		var count int
+		err := db.QueryRow(
+			"SELECT COUNT(*) FROM information_schema.statistics WHERE table_schema = DATABASE() AND table_name = ? AND index_name = ?",
+			table, name,
+		).Scan(&count)
+		if err != nil || count > 0 {
+			return err
+		}
+		_, err = db.Exec(fmt.Sprintf("CREATE INDEX %s ON %s (%s)", name, table, columns))
+		return err
+	}
+
+	_, err := db.Exec(fmt.Sprintf("CREATE INDEX IF NOT EXISTS %s ON %s (%s)", name, table, columns))
+
+	return err
+}
+
+func addColumnIfMissing(db *metadataDB, table, column, definition string) error {
+	rows, err := db.Query(fmt.Sprintf("PRAGMA table_info(%s)", table))
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	columns, err := rows.Columns()
+	if err != nil {
+		return err
+	}
+	for rows.Next() {
+		values := make([]interface{}, len(columns))
+		var name string
+		for i := range values {
+			if columns[i] == "name" {
+				values[i] = &name
+			} else {
+				values[i] = new(interface{})
+			}
+		}
+		if err := rows.Scan(values...); err != nil {
+			return err
+		}
+		if name == column {
+			return nil
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	rows.Close()
+
+	_, err = db.Exec(fmt.Sprintf("ALTER TABLE %s ADD COLUMN %s %s", table, column, definition))
+
+	return err
+}
+
+// UpdateMetadata stores rows as seen at given time, first_seen is set only
+// for new rows
+func (this *SQLMetadataStore) UpdateMetadata(data [][5]string, seen int64) error {
+	tx, err := this.db.Begin()
+	if err != nil {
+		this.log.Error("Failed to start transcation for metadata update: %s", err)
+		return err
+	}
+	if err := this.updateMetadata(tx, data, seen); err != nil {
+		if err := tx.Rollback(); err != nil {
+			this.log.Error("Failed to rollback metadata update: %s", err)
+		}
+		return err
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		this.log.Error("Failed to commit metadata update: %s", err)
+	}
+
+	return err
+}
+
+// updateMetadata stores rows within given transaction, the caller commits or
+// rolls it back
+func (this *SQLMetadataStore) updateMetadata(tx *metadataTx, data [][5]string, seen int64) error {
+	current, err := tx.Prepare("SELECT dstype, uom FROM uoms WHERE host = ? AND service = ? AND metric = ?")
+	if err != nil {
+		this.log.Error("Failed to prepare metadata lookup statement: %s", err)
+		return err
+	}
+	defer current.Close()
+
+	history, err := tx.Prepare(`
+        INSERT INTO uoms_history (host, service, metric, prev_dstype, prev_uom, dstype, uom, changed_at)
+        VALUES (?,?,?,?,?,?,?,?)
+        `)
+	if err != nil {
+		this.log.Error("Failed to prepare metadata history statement: %s", err)
+		return err
+	}
+	defer history.Close()
+
+	d := this.dialect
+	stmt, err := tx.Prepare(`
+        INSERT INTO uoms (host, service, metric, dstype, uom, first_seen, last_seen) VALUES (?,?,?,?,?,?,?)
+        ` + d.conflict(uomsKeys,
+		"dstype = "+d.excluded("dstype"),
+		"uom = "+d.excluded("uom"),
+		"first_seen = CASE WHEN uoms.first_seen = 0 THEN "+d.excluded("first_seen")+" ELSE uoms.first_seen END",
+		"last_seen = "+d.excluded("last_seen"),
+	))
+	if err != nil {
+		this.log.Error("Failed to prepare metadata update statement: %s", err)
+		return err
+	}
+	defer stmt.Close()
+
+	changed := false
+	for _, i := range data {
+		var dstype, uom string
+		exErr := current.QueryRow(i[0], i[1], i[2]).Scan(&dstype, &uom)
+		if exErr == nil && (dstype != i[3] || uom != i[4]) {
+			this.log.Warning("Metadata of %s::%s::%s changed to dstype %s uom %s", i[0], i[1], i[2], i[3], i[4])
+			_, exErr = history.Exec(i[0], i[1], i[2], dstype, uom, i[3], i[4], seen)
+			changed = true
+		} else if exErr == sql.ErrNoRows {
+			exErr = nil
+			changed = true
+		}
+		if exErr == nil {
+			_, exErr = stmt.Exec(i[0], i[1], i[2], i[3], i[4], seen, seen)
+		}
+		if exErr != nil {
+			this.log.Error("Failed to add entry to metadata database: %s\n", exErr)
+			return exErr
+		}
+	}
+
+	if changed {
+		if err := tx.bumpVersion(); err != nil {
+			this.log.Error("Failed to update metadata version: %s", err)
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (this *SQLMetadataStore) Version() (int64, error) {
+	this.versionLock.Lock()
+	defer this.versionLock.Unlock()
+
+	if this.versionConn == nil {
+		conn, err := this.db.Conn(context.Background())
+		if err != nil {
+			return 0, err
+		}
+		this.versionConn = conn
+	}
+
+	query := this.dialect.dataVersion
+	if query == "" {
+		query = "SELECT version FROM metadata_version WHERE id = 1"
+	}
+	var version int64
+	err := this.versionConn.QueryRowContext(context.Background(), query).Scan(&version)
+
+	return version, err
+}
+
+func (this *SQLMetadataStore) ImportMetadata(data [][5]string, remove []metadataKey, seen int64) (int, error) {
+	tx, err := this.db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	if len(data) > 0 {
+		if err := this.updateMetadata(tx, data, seen); err != nil {
+			tx.Rollback()
+			return 0, err
+		}
+	}
+	for _, key := range remove {
+		if _, err := tx.Exec("DELETE FROM uoms WHERE host = ? AND service = ? AND metric = ?", key.host, key.service, key.metric); err != nil {
+			tx.Rollback()
+			return 0, err
+		}
+	}
+	if len(remove) > 0 {
+		if err := tx.bumpVersion(); err != nil {
+			tx.Rollback()
+			return 0, err
+		}
+	}
+
+	return len(remove), tx.Commit()
+}
+
+func (this *SQLMetadataStore) ListMetadata() ([][5]string, error) {
+	rows, err := this.db.Query("SELECT host, service, metric, dstype, uom FROM uoms")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	data := make([][5]string, 0)
+	for rows.Next() {
+		var i [5]string
+		if err := rows.Scan(&i[0], &i[1], &i[2], &i[3], &i[4]); err != nil {
+			return nil, err
+		}
+		data = append(data, i)
+	}
+
+	return data, rows.Err()
+}
+
+func (this *SQLMetadataStore) ListMetadataLastSeen() (map[metadataKey]metadataState, error) {
+	rows, err := this.db.Query("SELECT host, service, metric, dstype, uom, last_seen FROM uoms")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	states := make(map[metadataKey]metadataState)
+	for rows.Next() {
+		var key metadataKey
+		var state metadataState
+		if err := rows.Scan(&key.host, &key.service, &key.metric, &state.value.dstype, &state.value.uom, &state.lastSeen); err != nil {
+			return nil, err
+		}
+		states[key] = state
+	}
+
+	return states, rows.Err()
+}
+
+func (this *SQLMetadataStore) ListHSM2U() (metatadaMapH2S, error) {
+	rows, err := this.db.Query("SELECT host, service, metric, uom FROM uoms")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	metadbMap := make(metatadaMapH2S)
+	for rows.Next() {
+		var host, service, metric, uom string
+		err = rows.Scan(&host, &service, &metric, &uom)
+		if err != nil {
+			return nil, err
+		}
+		sm, ok := metadbMap[host]
+		if !ok {
+			sm = make(metatadaMapS2M)
+			metadbMap[host] = sm
+		}
+
+		mm, ok := sm[service]
+		if !ok {
+			mm = make(metatadaMapM2U)
+			sm[service] = mm
+		}
+		mm[metric] = uom
+	}
+
+	return metadbMap, rows.Err()
+}
+
+func (this *SQLMetadataStore) GetHSMmetadata(host, service, metric string) (string, string, error) {
+	var dstype, uom string
+	err := this.db.QueryRow("SELECT dstype, uom FROM uoms WHERE host = ? AND service = ? AND metric = ?", host, service, metric).Scan(&dstype, &uom)
+
+	return dstype, uom, err
+}
+
+func (this *SQLMetadataStore) Close() error {
+	if this.db == nil {
+		return nil
+	}
+	if this.versionConn != nil {
+		this.versionConn.Close()
+	}
+
+	return this.db.Close()
+}
@@ -0,0 +1,158 @@
+package timeseries
+
+import (
+	"log/syslog"
+	"reflect"
+	"sort"
+	"testing"
+)
+
+// testStores runs test with the SQLite and the in-memory store
+func testStores(t *testing.T, test func(t *testing.T, tenant *TimeseriesTenant)) {
+	t.Run("sqlite", func(t *testing.T) {
+		tenant, cleanup := newTestTenant(t)
+		defer cleanup()
+		test(t, tenant)
+	})
+	t.Run("memory", func(t *testing.T) {
+		tenant := NewTenant(&TimeseriesTenantConfig{Name: "test"}, &TimeseriesLogger{logLevel: syslog.LOG_EMERG})
+		if err := tenant.UseMetadataStore(NewMemoryMetadataStore()); err != nil {
+			t.Fatal(err)
+		}
+		defer tenant.CloseMetadataDB()
+		test(t, tenant)
+	})
+}
+
+func TestMetadataStore(t *testing.T) {
+	testStores(t, func(t *testing.T, tenant *TimeseriesTenant) {
+		store := tenant.store
+		version, _ := store.Version()
+
+		if err := store.UpdateMetadata([][5]string{
+			{"h1", "Disk", "/", "GAUGE", "MB"},
+			{"h1", "Disk", "/var", "GAUGE", "MB"},
+			{"h1", "CPU", "load1", "GAUGE", ""},
+			{"h2", "CPU", "load1", "GAUGE", ""},
+		}, 100); err != nil {
+			t.Fatal(err)
+		}
+		if err := store.UpdateMetadata([][5]string{{"h1", "Disk", "/", "GAUGE", "B"}}, 200); err != nil {
+			t.Fatal(err)
+		}
+		if v, err := store.Version(); err != nil || v == version {
+			t.Errorf("Expected version to change, got %d (%v)", v, err)
+		}
+
+		if dstype, uom, err := store.GetHSMmetadata("h1", "Disk", "/"); err != nil || dstype != "GAUGE" || uom != "B" {
+			t.Errorf("Unexpected metadata %s %s (%v)", dstype, uom, err)
+		}
+		if _, _, err := store.GetHSMmetadata("h3", "CPU", "load1"); err == nil {
+			t.Error("Expected error of unknown series")
+		}
+
+		hosts, err := store.ListHosts()
+		expectedHosts := []HostEntry{{"h1", 2, 100, 200}, {"h2", 1, 100, 100}}
+		if err != nil || !reflect.DeepEqual(hosts, expectedHosts) {
+			t.Errorf("Expected hosts %+v got %+v (%v)", expectedHosts, hosts, err)
+		}
+		services, err := store.ListServices("h1")
+		expectedServices := []ServiceEntry{{"CPU", 1, 100, 100}, {"Disk", 2, 100, 200}}
+		if err != nil || !reflect.DeepEqual(services, expectedServices) {
+			t.Errorf("Expected services %+v got %+v (%v)", expectedServices, services, err)
+		}
+
+		history, err := store.SeriesHistory("h1", "Disk", "/")
+		if err != nil || len(history) != 1 || history[0].PrevUom != "MB" || history[0].ChangedAt != 200 {
+			t.Errorf("Unexpected history %+v (%v)", history, err)
+		}
+
+		if series, hosts, services, err := store.MetadataCardinality(); err != nil || series != 4 || hosts != 2 || services != 3 {
+			t.Errorf("Unexpected cardinality %d %d %d (%v)", series, hosts, services, err)
+		}
+		top, err := store.TopCardinality(1, true)
+		if err != nil || len(top) != 1 || top[0] != (CardinalityEntry{Host: "h1", Service: "Disk", Series: 2}) {
+			t.Errorf("Unexpected top cardinality %+v (%v)", top, err)
+		}
+
+		if err := store.SetHostsAttributes(HostsAttributes{"h1": {"role": "web"}, "h2": {"role": "db"}}, false); err != nil {
+			t.Fatal(err)
+		}
+		if metadata, err := store.AttributeMetadata("role", "web", "CPU", "load1"); err != nil || len(metadata) != 1 || metadata[0] != [2]string{"GAUGE", ""} {
+			t.Errorf("Unexpected attribute metadata %v (%v)", metadata, err)
+		}
+
+		if err := store.RenameMetadata(AdminRequest{Type: "host", Host: "h1", To: "h3"}); err != nil {
+			t.Fatal(err)
+		}
+		if exists, err := store.MetadataExists(AdminRequest{Host: "h1"}); err != nil || exists {
+			t.Errorf("Expected renamed host to be gone (%v)", err)
+		}
+		if history, _ := store.SeriesHistory("h3", "Disk", "/"); len(history) != 1 {
+			t.Errorf("Expected history to be renamed, got %+v", history)
+		}
+		if attributes, _ := store.GetHostAttributes("h3"); !reflect.DeepEqual(attributes, HostAttributes{"role": "web"}) {
+			t.Errorf("Expected attributes to be renamed, got %+v", attributes)
+		}
+
+		if err := store.DeleteMetadata(AdminRequest{Type: "service", Host: "h3", Service: "Disk"}); err != nil {
+			t.Fatal(err)
+		}
+		data, _ := store.ListMetadata()
+		sort.Slice(data, func(i, j int) bool { return data[i][0] < data[j][0] })
+		expected := [][5]string{{"h2", "CPU", "load1", "GAUGE", ""}, {"h3", "CPU", "load1", "GAUGE", ""}}
+		if !reflect.DeepEqual(data, expected) {
+			t.Errorf("Expected %v got %v", expected, data)
+		}
+
+		stale, err := store.StaleMetadata(150)
+		if err != nil || len(stale) != 2 {
+			t.Fatalf("Unexpected stale metadata %+v (%v)", stale, err)
+		}
+		if err := store.UpdateMetadata([][5]string{{"h2", "CPU", "load1", "GAUGE", ""}}, 300); err != nil {
+			t.Fatal(err)
+		}
+		purged, err := store.PurgeMetadata(stale, 150, true)
+		if err != nil || len(purged) != 1 || purged[0].Host != "h3" {
+			t.Errorf("Expected only h3 to be purged, got %+v (%v)", purged, err)
+		}
+
+		if previous, err := store.RecordCardinality(&CardinalitySample{RecordedAt: 100, Series: 4}, 0); err != nil || previous != nil {
+			t.Errorf("Unexpected previous sample %+v (%v)", previous, err)
+		}
+		if previous, err := store.RecordCardinality(&CardinalitySample{RecordedAt: 200, Series: 1}, 150); err != nil || previous == nil || previous.Series != 4 {
+			t.Errorf("Unexpected previous sample %+v (%v)", previous, err)
+		}
+		if samples, err := store.CardinalityHistory(0); err != nil || len(samples) != 1 || samples[0].RecordedAt != 200 {
+			t.Errorf("Expected old samples to be removed, got %+v (%v)", samples, err)
+		}
+	})
+}
+
+func TestMemoryMetadataStoreQuery(t *testing.T) {
+	tenant := NewTenant(&TimeseriesTenantConfig{Name: "test"}, &TimeseriesLogger{logLevel: syslog.LOG_EMERG})
+	if err := tenant.UseMetadataStore(NewMemoryMetadataStore()); err != nil {
+		t.Fatal(err)
+	}
+	if err := tenant.updateMetadata([][5]string{{"h1", "Disk", "/", "GAUGE", "MB"}}, 100); err != nil {
+		t.Fatal(err)
+	}
+	cache, err := NewMetadataCache(tenant)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tenant.cache = cache
+
+	if _, uomLabel, multiplier, err := tenant.GetHSMsetup("h1", "Disk", "/"); err != nil || uomLabel != "bytes" || multiplier != 1000*1000 {
+		t.Errorf("Unexpected setup %s %f (%v)", uomLabel, multiplier, err)
+	}
+	if err := tenant.updateMetadata([][5]string{{"h1", "Disk", "/", "GAUGE", "B"}}, 200); err != nil {
+		t.Fatal(err)
+	}
+	if changes, err := cache.Refresh(); err != nil || len(changes) != 1 {
+		t.Errorf("Expected one change got %v (%v)", changes, err)
+	}
+	if changes, err := tenant.metadataChanges("h1", "Disk", "/", 0, 300); err != nil || len(changes) != 1 {
+		t.Errorf("Expected one change of history got %v (%v)", changes, err)
+	}
+}
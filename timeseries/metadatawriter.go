@@ -0,0 +1,202 @@
+package timeseries
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+const (
+	// delay between attempts to write queued metadata on shutdown
+	METADATA_DRAIN_RETRY = time.Second
+	// failed flushes of a row before it is dropped
+	METADATA_MAX_RETRIES = 3
+)
+
+type metadataKey struct {
+	host, service, metric string
+}
+
+type metadataValue struct {
+	dstype, uom string
+}
+
+type metadataState struct {
+	value    metadataValue
+	lastSeen int64
+}
+
+type MetadataWriterStats struct {
+	Pending   int    `json:"pending"`
+	Known     int    `json:"known"`
+	Dropped   uint64 `json:"dropped"`
+	Written   uint64 `json:"written"`
+	Failed    uint64 `json:"failed"`
+	LastFlush int64  `json:"last_flush"`
+}
+
+// MetadataWriter collects metadata of the written points and stores only the
+// rows which are new, have changed dstype or uom or were last seen more than
+// lastSeenResolution seconds ago. Adding rows never blocks, once there are
+// maxPending rows waiting new ones are dropped until next flush.
+type MetadataWriter struct {
+	tenant             *TimeseriesTenant
+	maxPending         int
+	lastSeenResolution int64
+
+	// only one flush writes at a time
+	flushLock sync.Mutex
+
+	lock    sync.Mutex
+	pending map[metadataKey]metadataValue
+	known   map[metadataKey]metadataState
+	retries map[metadataKey]int
+	stats   MetadataWriterStats
+}
+
+func NewMetadataWriter(tenant *TimeseriesTenant, maxPending int, lastSeenResolution int64) (*MetadataWriter, error) {
+	known, err := tenant.store.ListMetadataLastSeen()
+	if err != nil {
+		return nil, err
+	}
+
+	return &MetadataWriter{
+		tenant:             tenant,
+		maxPending:         maxPending,
+		lastSeenResolution: lastSeenResolution,
+		pending:            make(map[metadataKey]metadataValue),
+		known:              known,
+		retries:            make(map[metadataKey]int),
+	}, nil
+}
+
+func (this *MetadataWriter) Add(data [][5]string) {
+	now := time.Now().Unix()
+
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	for _, i := range data {
+		key := metadataKey{i[0], i[1], i[2]}
+		value := metadataValue{i[3], i[4]}
+
+		if v, ok := this.known[key]; ok && v.value == value && now-v.lastSeen < this.lastSeenResolution {
+			delete(this.pending, key)
+			continue
+		}
+		if _, ok := this.pending[key]; !ok && len(this.pending) >= this.maxPending {
+			this.stats.Dropped++
+			continue
+		}
+		this.pending[key] = value
+	}
+}
+
+func (this *MetadataWriter) Flush() error {
+	this.flushLock.Lock()
+	defer this.flushLock.Unlock()
+
+	this.lock.Lock()
+	pending := this.pending
+	this.pending = make(map[metadataKey]metadataValue)
+	this.lock.Unlock()
+
+	if len(pending) == 0 {
+		return nil
+	}
+
+	data := make([][5]string, 0, len(pending))
+	for key, value := range pending {
+		data = append(data, [5]string{key.host, key.service, key.metric, value.dstype, value.uom})
+	}
+
+	now := time.Now().Unix()
+	err := this.tenant.updateMetadata(data, now)
+
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	this.stats.LastFlush = now
+	if err != nil {
+		this.stats.Failed++
+		// retry with next flush unless newer values were added meanwhile
+		dropped := 0
+		for key, value := range pending {
+			if _, ok := this.pending[key]; ok {
+				continue
+			}
+			this.retries[key]++
+			if this.retries[key] > METADATA_MAX_RETRIES || len(this.pending) >= this.maxPending {
+				delete(this.retries, key)
+				dropped++
+				continue
+			}
+			this.pending[key] = value
+		}
+		if dropped > 0 {
+			this.stats.Dropped += uint64(dropped)
+			this.tenant.log.Warning("Dropped %d metadata rows which failed to be written", dropped)
+		}
+		return err
+	}
+
+	for key, value := range pending {
+		this.known[key] = metadataState{value, now}
+		delete(this.retries, key)
+	}
+	this.stats.Written += uint64(len(data))
+
+	return nil
+}
+
+// Forget removes purged entries so they are written again if seen
+func (this *MetadataWriter) Forget(entries []StaleMetadataEntry) {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	for _, e := range entries {
+		delete(this.known, metadataKey{e.Host, e.Service, e.Metric})
+	}
+}
+
+func (this *MetadataWriter) Run(interval time.Duration, stop <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			this.Flush()
+		}
+	}
+}
+
+// Drain writes queued rows retrying failed flushes until the context is done,
+// returns number of rows left unwritten
+func (this *MetadataWriter) Drain(ctx context.Context) (int, error) {
+	for {
+		err := this.Flush()
+		if err == nil {
+			return 0, nil
+		}
+
+		select {
+		case <-ctx.Done():
+			return this.Stats().Pending, err
+		case <-time.After(METADATA_DRAIN_RETRY):
+		}
+	}
+}
+
+func (this *MetadataWriter) Stats() MetadataWriterStats {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	stats := this.stats
+	stats.Pending = len(this.pending)
+	stats.Known = len(this.known)
+
+	return stats
+}
@@ -0,0 +1,122 @@
+package timeseries
+
+import (
+	"io/ioutil"
+	"log/syslog"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func newTestTenant(t *testing.T) (*TimeseriesTenant, func()) {
+	dir, err := ioutil.TempDir("", "timeseries")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tenant := NewTenant(
+		&TimeseriesTenantConfig{Name: "test", MetadataDB: filepath.Join(dir, SQLITE_DB)},
+		&TimeseriesLogger{logLevel: syslog.LOG_EMERG},
+	)
+	if err := tenant.InitMetadataDB(); err != nil {
+		os.RemoveAll(dir)
+		t.Fatal(err)
+	}
+
+	return tenant, func() {
+		tenant.CloseMetadataDB()
+		os.RemoveAll(dir)
+	}
+}
+
+// testMetadataDB returns database of the SQLite store of newTestTenant
+func testMetadataDB(tenant *TimeseriesTenant) *metadataDB {
+	return tenant.store.(*SQLMetadataStore).db
+}
+
+func TestMetadataWriter(t *testing.T) {
+	tenant, cleanup := newTestTenant(t)
+	defer cleanup()
+
+	if err := tenant.updateMetadata([][5]string{{"h1", "CPU", "load1", "GAUGE", ""}}, time.Now().Unix()); err != nil {
+		t.Fatal(err)
+	}
+
+	writer, err := NewMetadataWriter(tenant, 3, 3600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	writer.Add([][5]string{
+		{"h1", "CPU", "load1", "GAUGE", ""},
+		{"h1", "Disk", "/", "GAUGE", "MB"},
+	})
+	writer.Add([][5]string{
+		{"h1", "Disk", "/", "GAUGE", "B"},
+		{"h2", "Disk", "/", "GAUGE", "B"},
+		{"h3", "Disk", "/", "GAUGE", "B"},
+		{"h4", "Disk", "/", "GAUGE", "B"},
+	})
+
+	stats := writer.Stats()
+	if stats.Pending != 3 || stats.Dropped != 1 || stats.Known != 1 {
+		t.Errorf("Unexpected stats before flush %+v", stats)
+	}
+
+	if err := writer.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	stats = writer.Stats()
+	if stats.Pending != 0 || stats.Written != 3 || stats.Known != 4 {
+		t.Errorf("Unexpected stats after flush %+v", stats)
+	}
+
+	_, uom, _, err := tenant.GetHSMsetup("h1", "Disk", "/")
+	if err != nil || uom != "bytes" {
+		t.Errorf("Expected bytes got %s (%v)", uom, err)
+	}
+
+	writer.Add([][5]string{{"h2", "Disk", "/", "GAUGE", "B"}})
+	if stats = writer.Stats(); stats.Pending != 0 {
+		t.Errorf("Expected unchanged row to be skipped %+v", stats)
+	}
+}
+
+func TestMetadataWriterRetries(t *testing.T) {
+	tenant, cleanup := newTestTenant(t)
+	defer cleanup()
+
+	writer, err := NewMetadataWriter(tenant, 10, 3600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := testMetadataDB(tenant).Exec("ALTER TABLE uoms RENAME TO uoms_offline"); err != nil {
+		t.Fatal(err)
+	}
+
+	writer.Add([][5]string{{"h1", "CPU", "load1", "GAUGE", ""}})
+	for i := 0; i < METADATA_MAX_RETRIES; i++ {
+		if err := writer.Flush(); err == nil {
+			t.Fatal("Expected flush to fail")
+		}
+		if stats := writer.Stats(); stats.Pending != 1 || stats.Dropped != 0 {
+			t.Errorf("Expected row to be retried %+v", stats)
+		}
+	}
+	writer.Flush()
+	if stats := writer.Stats(); stats.Pending != 0 || stats.Dropped != 1 || stats.Failed != METADATA_MAX_RETRIES+1 {
+		t.Errorf("Expected row to be dropped %+v", stats)
+	}
+
+	if _, err := testMetadataDB(tenant).Exec("ALTER TABLE uoms_offline RENAME TO uoms"); err != nil {
+		t.Fatal(err)
+	}
+	writer.Add([][5]string{{"h1", "CPU", "load1", "GAUGE", ""}})
+	if err := writer.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if stats := writer.Stats(); stats.Written != 1 || stats.Known != 1 {
+		t.Errorf("Unexpected stats %+v", stats)
+	}
+}
@@ -0,0 +1,233 @@
+package timeseries
+
+import (
+	"errors"
+	"fmt"
+	"github.com/ajgb/go-opsview/timeseries/influxql"
+	"github.com/influxdata/influxdb/client/v2"
+	"github.com/julienschmidt/httprouter"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+const (
+	PURGE_REPORT  = "report"
+	PURGE_DELETE  = "delete"
+	PURGE_ARCHIVE = "archive"
+)
+
+type StaleMetadataEntry struct {
+	MetadataEntry
+	FirstSeen int64 `json:"first_seen,omitempty"`
+	LastSeen  int64 `json:"last_seen"`
+}
+
+type PurgeReport struct {
+	Mode        string               `json:"mode"`
+	UnseenSince int64                `json:"unseen_since"`
+	DropSeries  bool                 `json:"drop_series"`
+	Purged      int                  `json:"purged"`
+	Entries     []StaleMetadataEntry `json:"entries"`
+}
+
+// InitLastSeen sets last seen time of rows stored before it was tracked, so
+// they are purged only if they are not seen for given period from now on
+func (this *SQLMetadataStore) InitLastSeen(now int64) error {
+	_, err := this.db.Exec("UPDATE uoms SET last_seen = ? WHERE last_seen = 0", now)
+
+	return err
+}
+
+func (this *SQLMetadataStore) StaleMetadata(unseenSince int64) ([]StaleMetadataEntry, error) {
+	rows, err := this.db.Query(`
+        SELECT host, service, metric, dstype, uom, first_seen, last_seen
+        FROM uoms WHERE last_seen > 0 AND last_seen < ? ORDER BY host, service, metric
+        `, unseenSince)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	entries := make([]StaleMetadataEntry, 0)
+	for rows.Next() {
+		var e StaleMetadataEntry
+		if err := rows.Scan(&e.Host, &e.Service, &e.Metric, &e.Dstype, &e.Uom, &e.FirstSeen, &e.LastSeen); err != nil {
+			return nil, err
+		}
+		entries = append(entries, e)
+	}
+
+	return entries, rows.Err()
+}
+
+// PurgeMetadata removes (and archives if requested) given entries unless they
+// were seen again in the meantime, returns entries actually removed
+func (this *SQLMetadataStore) PurgeMetadata(entries []StaleMetadataEntry, unseenSince int64, archive bool) ([]StaleMetadataEntry, error) {
+	tx, err := this.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now().Unix()
+	purged := make([]StaleMetadataEntry, 0, len(entries))
+	for _, e := range entries {
+		if archive {
+			// archived_at is inlined, PostgreSQL cannot infer type of a
+			// placeholder in select list
+			_, err := tx.Exec(tx.dialect.replace("uoms_archive",
+				[]string{"host", "service", "metric", "dstype", "uom", "first_seen", "last_seen", "archived_at"}, uomsKeys, fmt.Sprintf(`
+                SELECT host, service, metric, dstype, uom, first_seen, last_seen, %d
+                FROM uoms WHERE host = ? AND service = ? AND metric = ? AND last_seen < ?
+                `, now)), e.Host, e.Service, e.Metric, unseenSince)
+			if err != nil {
+				tx.Rollback()
+				return nil, err
+			}
+		}
+
+		res, err := tx.Exec("DELETE FROM uoms WHERE host = ? AND service = ? AND metric = ? AND last_seen < ?", e.Host, e.Service, e.Metric, unseenSince)
+		if err != nil {
+			tx.Rollback()
+			return nil, err
+		}
+		if n, _ := res.RowsAffected(); n > 0 {
+			purged = append(purged, e)
+		}
+	}
+
+	if len(purged) > 0 {
+		if err := tx.bumpVersion(); err != nil {
+			tx.Rollback()
+			return nil, err
+		}
+	}
+
+	return purged, tx.Commit()
+}
+
+func (this *TimeseriesTenant) dropSeries(entries []StaleMetadataEntry) error {
+	if len(entries) == 0 {
+		return nil
+	}
+
+	db, err := this.NewInfluxDBClient()
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	for _, e := range entries {
+		q := client.Query{
+			Command: fmt.Sprintf("DROP SERIES FROM %s WHERE %s AND %s",
+				influxql.QuoteIdent(e.Host), influxql.Eq("service", e.Service), influxql.Eq("metric", e.Metric)),
+			Database: this.config.InfluxDB.Database,
+		}
+		response, err := db.Query(q)
+		if err != nil {
+			return err
+		}
+		if err := response.Error(); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (this *TimeseriesTenant) Purge(unseenDays int, mode string, dropSeries bool) (*PurgeReport, error) {
+	report := &PurgeReport{
+		Mode:        mode,
+		UnseenSince: time.Now().Unix() - int64(unseenDays)*DAY,
+		DropSeries:  dropSeries,
+	}
+
+	entries, err := this.store.StaleMetadata(report.UnseenSince)
+	if err != nil {
+		return nil, err
+	}
+
+	switch mode {
+	case PURGE_REPORT:
+		report.Entries = entries
+		return report, nil
+	case PURGE_DELETE, PURGE_ARCHIVE:
+	default:
+		return nil, errors.New(fmt.Sprintf("Invalid purge mode: %s", mode))
+	}
+
+	purged, err := this.store.PurgeMetadata(entries, report.UnseenSince, mode == PURGE_ARCHIVE)
+	if err != nil {
+		return nil, err
+	}
+	report.Entries = purged
+	report.Purged = len(purged)
+
+	if this.metadata != nil {
+		this.metadata.Forget(purged)
+	}
+
+	if dropSeries {
+		if err := this.dropSeries(purged); err != nil {
+			return report, errors.New(fmt.Sprintf("Failed to drop series: %s", err))
+		}
+	}
+
+	return report, nil
+}
+
+func (this *TimeseriesTenant) runPurge(config *TimeseriesPurgeConfig, stop <-chan struct{}) {
+	if err := this.store.InitLastSeen(time.Now().Unix()); err != nil {
+		this.log.Error("Failed to initialize last seen time of metadata: %s", err)
+	}
+
+	ticker := time.NewTicker(time.Duration(config.Interval) * time.Second)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+
+		report, err := this.Purge(config.UnseenDays, config.Mode, config.DropSeries)
+		if err != nil {
+			this.log.Error("Failed to purge metadata of tenant %s: %s", this.Name(), err)
+			if report == nil {
+				continue
+			}
+		}
+
+		if config.Mode == PURGE_REPORT {
+			this.log.Notice("Metadata of tenant %s unseen for %d days (dry run): %d", this.Name(), config.UnseenDays, len(report.Entries))
+		} else {
+			this.log.Notice("Metadata of tenant %s unseen for %d days purged (%s): %d", this.Name(), config.UnseenDays, config.Mode, report.Purged)
+		}
+		for _, e := range report.Entries {
+			this.log.Info("Stale metadata %s::%s::%s last seen %s", e.Host, e.Service, e.Metric, time.Unix(e.LastSeen, 0))
+		}
+	}
+}
+
+func (this *TimeseriesServer) StaleMetadataHandler(w http.ResponseWriter, r *http.Request, ps httprouter.Params, tenant *TimeseriesTenant) {
+	days := this.config.Server.Updates.Purge.UnseenDays
+	if v := r.URL.Query().Get("days"); v != "" {
+		var err error
+		if days, err = strconv.Atoi(v); err != nil || days < 1 {
+			this.sendHTTPError(w, http.StatusBadRequest, "Failed to parse query: Invalid parameter: days")
+			return
+		}
+	}
+	if days < 1 {
+		this.sendHTTPError(w, http.StatusBadRequest, "Failed to parse query: Missing parameter: days")
+		return
+	}
+
+	report, err := tenant.Purge(days, PURGE_REPORT, this.config.Server.Updates.Purge.DropSeries)
+	if err != nil {
+		this.sendHTTPError(w, http.StatusInternalServerError, "Failed to list stale metadata: %s", err)
+		return
+	}
+	this.sendJSON(w, report)
+}
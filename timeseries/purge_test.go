@@ -0,0 +1,45 @@
+package timeseries
+
+import (
+	"testing"
+	"time"
+)
+
+func TestPurge(t *testing.T) {
+	tenant, cleanup := newTestTenant(t)
+	defer cleanup()
+
+	now := time.Now().Unix()
+	if err := tenant.updateMetadata([][5]string{{"old", "CPU", "load1", "GAUGE", ""}}, now-10*DAY); err != nil {
+		t.Fatal(err)
+	}
+	if err := tenant.updateMetadata([][5]string{{"new", "CPU", "load1", "GAUGE", ""}}, now); err != nil {
+		t.Fatal(err)
+	}
+
+	report, err := tenant.Purge(7, PURGE_REPORT, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(report.Entries) != 1 || report.Entries[0].Host != "old" || report.Purged != 0 {
+		t.Errorf("Unexpected dry run report %+v", report)
+	}
+
+	report, err = tenant.Purge(7, PURGE_ARCHIVE, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Purged != 1 {
+		t.Errorf("Unexpected purge report %+v", report)
+	}
+
+	data, err := tenant.ListMetadata()
+	if err != nil || len(data) != 1 || data[0][0] != "new" {
+		t.Errorf("Unexpected metadata after purge %v (%v)", data, err)
+	}
+
+	var archived int
+	if err := testMetadataDB(tenant).QueryRow("SELECT COUNT(*) FROM uoms_archive WHERE host = 'old'").Scan(&archived); err != nil || archived != 1 {
+		t.Errorf("Expected archived row got %d (%v)", archived, err)
+	}
+}
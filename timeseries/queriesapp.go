@@ -4,29 +4,196 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
-	"github.com/influxdata/influxdb/client/v2"
 	"github.com/julienschmidt/httprouter"
 	"net/http"
 	"net/url"
+	"regexp"
+	"sort"
 	"strconv"
 	"strings"
 	"time"
 )
 
+const HSM_REGEX_PREFIX = "~"
+
 type QueryParamsHSM struct {
 	HSM, Host, eHost, Service, eService, Metric, eMetric string
+	// set if any part is a pattern
+	pattern *MetadataFilter
+	// slot aggregate requested for the HSM, the key of its result ends
+	// with "::aggregate"
+	aggregate *queryAggregate
+}
+
+// hsmKey returns key of the result of host, service and metric of the HSM
+func (this QueryParamsHSM) hsmKey(host, service, metric string) string {
+	parts := []string{host, service, metric}
+	if this.aggregate != nil {
+		parts = append(parts, this.aggregate.String())
+	}
+
+	return strings.Join(parts, "::")
+}
+
+// hsmPattern returns regexp matching the part of HSM and whether it is a
+// pattern, "~" prefix marks regular expression, * or ? glob. Escaped \*, \?
+// and leading \~ match the characters themselves.
+func hsmPattern(part string) (*regexp.Regexp, bool, error) {
+	if strings.HasPrefix(part, HSM_REGEX_PREFIX) {
+		re, err := regexp.Compile(strings.TrimPrefix(part, HSM_REGEX_PREFIX))
+		return re, true, err
+	}
+
+	var expr strings.Builder
+	isPattern := false
+	for i := 0; i < len(part); i++ {
+		switch c := part[i]; {
+		case hsmEscaped(part, i):
+			i++
+			expr.WriteString(regexp.QuoteMeta(part[i : i+1]))
+		case c == '*':
+			expr.WriteString(".*")
+			isPattern = true
+		case c == '?':
+			expr.WriteString(".")
+			isPattern = true
+		default:
+			expr.WriteString(regexp.QuoteMeta(part[i : i+1]))
+		}
+	}
+	re, err := regexp.Compile("^" + expr.String() + "$")
+
+	return re, isPattern, err
+}
+
+// hsmEscaped returns whether backslash at i escapes the next character
+func hsmEscaped(part string, i int) bool {
+	if part[i] != '\\' || i+1 == len(part) {
+		return false
+	}
+	next := part[i+1]
+
+	return next == '*' || next == '?' || (i == 0 && next == HSM_REGEX_PREFIX[0])
+}
+
+// hsmLiteral returns the part of HSM which is not a pattern without escapes
+func hsmLiteral(part string) string {
+	var b strings.Builder
+	for i := 0; i < len(part); i++ {
+		if hsmEscaped(part, i) {
+			i++
+		}
+		b.WriteByte(part[i])
+	}
+
+	return b.String()
+}
+
+func parseHSMPattern(host, service, metric string) (*MetadataFilter, error) {
+	filter := &MetadataFilter{}
+	isPattern := false
+	for _, p := range []struct {
+		part string
+		re   **regexp.Regexp
+	}{{host, &filter.Host}, {service, &filter.Service}, {metric, &filter.Metric}} {
+		re, ok, err := hsmPattern(p.part)
+		if err != nil {
+			return nil, err
+		}
+		*p.re = re
+		isPattern = isPattern || ok
+	}
+	if !isPattern {
+		return nil, nil
+	}
+
+	return filter, nil
+}
+
+// expandPattern returns HSMs matching the pattern sorted by host, service and
+// metric, the limit applies to all patterns of the batch's request
+func (this *TimeseriesServer) expandPattern(batch *queryBatch, hsm QueryParamsHSM) ([]QueryParamsHSM, error) {
+	matched, err := searchHSMs(batch.tenant, hsm.pattern, 0)
+	if err != nil {
+		return nil, errors.New(fmt.Sprintf("Pattern %s: %s", hsm.HSM, err))
+	}
+	batch.patternMatches += len(matched)
+	if max := this.config.Server.Queries.MaxPatternMatches; max > 0 && batch.patternMatches > max {
+		return nil, errors.New(fmt.Sprintf("Pattern %s: %d series match patterns of the request, limit is %d", hsm.HSM, batch.patternMatches, max))
+	}
+	for i := range matched {
+		matched[i].HSM = hsm.hsmKey(matched[i].Host, matched[i].Service, matched[i].Metric)
+		matched[i].aggregate = hsm.aggregate
+	}
+	this.log.Debug("Pattern(%s) HSMs(%d)\n", hsm.HSM, len(matched))
+
+	return matched, nil
+}
+
+// searchHSMs returns HSMs of series matching the filter sorted by host,
+// service and metric, at most max of them if max is set
+func searchHSMs(tenant *TimeseriesTenant, filter *MetadataFilter, max int) ([]QueryParamsHSM, error) {
+	data, err := tenant.SearchMetadata(filter)
+	if err != nil {
+		return nil, err
+	}
+	if max > 0 && len(data) > max {
+		return nil, errors.New(fmt.Sprintf("%d series match, limit is %d", len(data), max))
+	}
+	sort.Slice(data, func(i, j int) bool {
+		for k := 0; k < 3; k++ {
+			if data[i][k] != data[j][k] {
+				return data[i][k] < data[j][k]
+			}
+		}
+		return false
+	})
+
+	matched := make([]QueryParamsHSM, len(data))
+	for n, i := range data {
+		matched[n] = QueryParamsHSM{
+			HSM:     strings.Join(i[:3], "::"),
+			Host:    i[0],
+			eHost:   i[0],
+			Service: i[1],
+			Metric:  i[2],
+		}
+	}
+
+	return matched, nil
 }
+
+// hosts can be selected by their attributes with "@name=value" used in place
+// of host name, "@name" selects all values of the attribute
+func (this QueryParamsHSM) isAttributeSelector() bool {
+	return strings.HasPrefix(this.Host, "@")
+}
+
+func (this QueryParamsHSM) attributeSelector() (name, value string) {
+	name = strings.TrimPrefix(this.Host, "@")
+	if i := strings.Index(name, "="); i >= 0 {
+		name, value = name[:i], name[i+1:]
+	}
+
+	return
+}
+
 type QueryParams struct {
 	dataPoints         int64
 	minTimeSlot        int64
 	fixedTimeSlot      int64
 	fillOption         string
 	counterMetricsMode string
+	aggregate          queryAggregate
 	retentionPolicy    string
 	startEpoch         int64
 	endEpoch           int64
 	includeTzOffset    bool
+	hostsAggregate     string
 	HSMs               []QueryParamsHSM
+	expressions        []*queryExpression
+	forecast           *forecastParams
+	baseline           *baselineParams
 }
 type QueryResultDataStats struct {
 	Min    interface{} `json:"min"`
@@ -34,15 +201,77 @@ type QueryResultDataStats struct {
 	Avg    interface{} `json:"avg"`
 	Stddev interface{} `json:"stddev"`
 	P95    interface{} `json:"p95"`
+	// last value ranks series in top
+	last interface{}
 }
 type QueryResultData struct {
-	Data  [][2]interface{}      `json:"data"`
-	Uom   string                `json:"uom"`
-	Stats *QueryResultDataStats `json:"stats,omitempty"`
+	Data     [][2]interface{}      `json:"data"`
+	Uom      string                `json:"uom"`
+	Stats    *QueryResultDataStats `json:"stats,omitempty"`
+	Forecast *QueryResultForecast  `json:"forecast,omitempty"`
+	Baseline *QueryResultBaseline  `json:"baseline,omitempty"`
 }
 type QueryResults map[string]*QueryResultData
 
-func (this *TimeseriesServer) parseQueryParams(query url.Values) (*QueryParams, error) {
+// parseHSM parses host::service::metric with optional ::aggregate, parts are
+// escaped; nil is returned for HSMs which are skipped
+func (this *TimeseriesServer) parseHSM(hsm string) (*QueryParamsHSM, error) {
+	var qsHSM QueryParamsHSM
+
+	h_s_m := strings.Split(hsm, "::")
+
+	if len(h_s_m) == 3 || len(h_s_m) == 4 {
+		qsHSM.eHost = h_s_m[0]
+		qsHSM.eService = h_s_m[1]
+		qsHSM.eMetric = h_s_m[2]
+	} else {
+		return nil, nil
+	}
+	if len(h_s_m) == 4 {
+		aggregate, err := parseQueryAggregate(h_s_m[3])
+		if err != nil {
+			return nil, errors.New(fmt.Sprintf("%s: %s", hsm, err))
+		}
+		qsHSM.aggregate = &aggregate
+	}
+
+	host, err := url.QueryUnescape(qsHSM.eHost)
+	if err != nil {
+		this.log.Warning("Failed to unescape host: %s\n", err)
+		return nil, nil
+	}
+	qsHSM.Host = host
+
+	service, err := url.QueryUnescape(qsHSM.eService)
+	if err != nil {
+		this.log.Warning("Failed to unescape service: %s\n", err)
+		return nil, nil
+	}
+	qsHSM.Service = service
+
+	metric, err := url.QueryUnescape(qsHSM.eMetric)
+	if err != nil {
+		this.log.Warning("Failed to unescape metric: %s\n", err)
+		return nil, nil
+	}
+	qsHSM.Metric = metric
+
+	qsHSM.HSM = qsHSM.hsmKey(host, service, metric)
+
+	if !qsHSM.isAttributeSelector() {
+		if qsHSM.pattern, err = parseHSMPattern(host, service, metric); err != nil {
+			return nil, errors.New(fmt.Sprintf("%s: %s", qsHSM.HSM, err))
+		}
+		if qsHSM.pattern == nil {
+			qsHSM.Host, qsHSM.Service, qsHSM.Metric = hsmLiteral(host), hsmLiteral(service), hsmLiteral(metric)
+			qsHSM.HSM = qsHSM.hsmKey(qsHSM.Host, qsHSM.Service, qsHSM.Metric)
+		}
+	}
+
+	return &qsHSM, nil
+}
+
+func (this *TimeseriesServer) parseQueryParams(query url.Values, tenant *TimeseriesTenant) (*QueryParams, error) {
 	var qsParams = &QueryParams{}
 
 	this.log.Debug("Params: %s\n", query)
@@ -71,48 +300,32 @@ func (this *TimeseriesServer) parseQueryParams(query url.Values) (*QueryParams,
 		qsParams.includeTzOffset = true
 	}
 
-	if hsms, ok := query["hsm"]; ok {
-		qsParams.HSMs = make([]QueryParamsHSM, 0, len(hsms))
-		for _, hsm := range hsms {
-			var qsHSM QueryParamsHSM
-
-			h_s_m := strings.Split(hsm, "::")
-
-			if len(h_s_m) == 3 {
-				qsHSM.eHost = h_s_m[0]
-				qsHSM.eService = h_s_m[1]
-				qsHSM.eMetric = h_s_m[2]
-			} else {
-				continue
-			}
-
-			host, err := url.QueryUnescape(qsHSM.eHost)
-			if err != nil {
-				this.log.Warning("Failed to unescape host: %s\n", err)
-				continue
-			}
-			qsHSM.Host = host
-
-			service, err := url.QueryUnescape(qsHSM.eService)
-			if err != nil {
-				this.log.Warning("Failed to unescape service: %s\n", err)
-				continue
-			}
-			qsHSM.Service = service
-
-			metric, err := url.QueryUnescape(qsHSM.eMetric)
-			if err != nil {
-				this.log.Warning("Failed to unescape metric: %s\n", err)
-				continue
-			}
-			qsHSM.Metric = metric
-
-			qsHSM.HSM = strings.Join([]string{host, service, metric}, "::")
-
-			qsParams.HSMs = append(qsParams.HSMs, qsHSM)
+	hsms := query["hsm"]
+	expressions := query["expr"]
+	qsParams.HSMs = make([]QueryParamsHSM, 0, len(hsms))
+	for _, hsm := range hsms {
+		qsHSM, err := this.parseHSM(hsm)
+		if err != nil {
+			return nil, errors.New(fmt.Sprintf("Invalid parameter hsm: %s", err))
+		}
+		if qsHSM != nil {
+			qsParams.HSMs = append(qsParams.HSMs, *qsHSM)
 		}
-	} else {
-		return nil, errors.New(fmt.Sprintf("Missing parameter: hsm"))
+	}
+	names := make(map[string]bool, len(qsParams.HSMs)+len(expressions))
+	for _, hsm := range qsParams.HSMs {
+		names[hsm.HSM] = true
+	}
+	for _, expr := range expressions {
+		expression, err := parseQueryExpression(expr, this.parseHSM)
+		if err != nil {
+			return nil, errors.New(fmt.Sprintf("Invalid parameter expr: %s", err))
+		}
+		if names[expression.name] {
+			return nil, errors.New(fmt.Sprintf("Invalid parameter expr: name %s is already used", expression.name))
+		}
+		names[expression.name] = true
+		qsParams.expressions = append(qsParams.expressions, expression)
 	}
 
 	dataPoints := query.Get("data_points")
@@ -170,46 +383,67 @@ func (this *TimeseriesServer) parseQueryParams(query url.Values) (*QueryParams,
 		qsParams.counterMetricsMode = this.config.Server.Queries.CounterMetricsMode
 	}
 
+	aggregate := query.Get("aggregate")
+	if aggregate == "" {
+		aggregate = this.config.Server.Queries.Aggregate
+	}
+	if a, err := parseQueryAggregate(aggregate); err != nil {
+		return nil, errors.New(fmt.Sprintf("Invalid parameter aggregate: %s", aggregate))
+	} else {
+		qsParams.aggregate = a
+	}
+
+	hostsAggregate := query.Get("hosts_aggregate")
+	if hostsAggregate != "" {
+		if !seriesAggregateFunctions[hostsAggregate] {
+			return nil, errors.New(fmt.Sprintf("Invalid parameter hosts_aggregate: %s", hostsAggregate))
+		}
+		qsParams.hostsAggregate = hostsAggregate
+	}
+
+	if forecast, err := parseForecastParams(query, qsParams); err != nil {
+		return nil, err
+	} else {
+		qsParams.forecast = forecast
+	}
+
+	if baseline, err := parseBaselineParams(query); err != nil {
+		return nil, err
+	} else {
+		qsParams.baseline = baseline
+	}
+
 	retentionPolicy := query.Get("rp")
 	if retentionPolicy != "" && !strings.ContainsAny(retentionPolicy, ";\"") {
 		qsParams.retentionPolicy = retentionPolicy
 	} else {
-		qsParams.retentionPolicy = this.config.InfluxDB.RetentionPolicy
+		qsParams.retentionPolicy = tenant.config.InfluxDB.RetentionPolicy
 	}
 
 	return qsParams, nil
 }
 
-func (this *TimeseriesServer) QueryHandler(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+func (this *TimeseriesServer) QueryHandler(w http.ResponseWriter, r *http.Request, ps httprouter.Params, tenant *TimeseriesTenant) {
 	if err := r.ParseForm(); err != nil {
 		this.sendHTTPError(w, http.StatusBadRequest, "Failed to parse query: %s", err)
 		return
 	}
-	qsParams, err := this.parseQueryParams(r.Form)
+	qsParams, err := this.parseQueryParams(r.Form, tenant)
 	if err != nil {
 		this.sendHTTPError(w, http.StatusBadRequest, "Failed to parse query: %s", err)
 		return
 	}
-	this.log.Debug("qsParams: %+v\n", qsParams)
-
-	dbRp := fmt.Sprintf("%s.\"%s\"", this.config.InfluxDB.Database, qsParams.retentionPolicy)
-
-	clientConfig := client.HTTPConfig{
-		Addr: this.config.InfluxDB.Server,
-	}
-	if this.config.InfluxDB.User != "" {
-		clientConfig.Username = this.config.InfluxDB.User
-		clientConfig.Password = this.config.InfluxDB.Password
+	if _, ok := r.Form["hsm"]; !ok && len(qsParams.expressions) == 0 {
+		this.sendHTTPError(w, http.StatusBadRequest, "Failed to parse query: Missing parameter: hsm")
+		return
 	}
-	db, err := client.NewHTTPClient(clientConfig)
+	this.log.Debug("qsParams: %+v\n", qsParams)
 
+	db, err := tenant.InfluxDBClient()
 	if err != nil {
 		this.sendHTTPError(w, http.StatusInternalServerError, "Failed to connect to InfluxDB: %s", err)
 		return
 	}
-	defer db.Close()
-
-	metrics := make(QueryResults)
 
 	var tz_offset = 0
 	if qsParams.includeTzOffset {
@@ -217,168 +451,146 @@ func (this *TimeseriesServer) QueryHandler(w http.ResponseWriter, r *http.Reques
 		_, tz_offset = localtime.Zone()
 	}
 
+	batch := this.newQueryBatch(tenant, qsParams, tz_offset)
+	queries := make(map[string]*hsmQuery)
+	attributes := make([]*attributeQuery, 0)
 	for _, hsm := range qsParams.HSMs {
-		var column string
+		if hsm.isAttributeSelector() {
+			attribute, err := batch.AddAttribute(hsm)
+			if err != nil {
+				this.sendHTTPError(w, http.StatusInternalServerError, "%s", err)
+				return
+			}
+			attributes = append(attributes, attribute)
+			continue
+		}
 
-		this.log.Debug("Host(%s) Service(%s) Metric(%s)\n", hsm.Host, hsm.Service, hsm.Metric)
+		if hsm.pattern != nil {
+			matched, err := this.expandPattern(batch, hsm)
+			if err != nil {
+				this.sendHTTPError(w, http.StatusBadRequest, "Failed to expand pattern: %s", err)
+				return
+			}
+			for _, m := range matched {
+				query, err := batch.Add(m)
+				if err != nil {
+					this.sendHTTPError(w, http.StatusInternalServerError, "%s", err)
+					return
+				}
+				queries[m.HSM] = query
+			}
+			continue
+		}
 
-		dstype, uomLabel, uomMultiplier, err := this.GetHSMsetup(hsm.Host, hsm.Service, hsm.Metric)
+		query, err := batch.Add(hsm)
 		if err != nil {
-			this.sendHTTPError(w, http.StatusInternalServerError, "Failed to query metadata information: %s", err)
+			this.sendHTTPError(w, http.StatusInternalServerError, "%s", err)
 			return
 		}
+		queries[hsm.HSM] = query
+	}
 
-		var start_time, end_time string
-		slot_time := CalculateTimeSlotSize(qsParams.dataPoints, qsParams.startEpoch, qsParams.endEpoch, float64(qsParams.minTimeSlot), float64(qsParams.fixedTimeSlot))
-
-		// until influxdb fixes #7185 we calculate COUNTER/DERIVE manually
-		if dstype == "COUNTER" || dstype == "DERIVE" {
-			start_time = fmt.Sprintf("%ds - %s", qsParams.startEpoch, slot_time)
-			end_time = fmt.Sprintf("%ds + %s", qsParams.endEpoch, slot_time)
-		} else { //case "GAUGE":
-			start_time = fmt.Sprintf("%ds", qsParams.startEpoch)
-			end_time = fmt.Sprintf("%ds + %s", qsParams.endEpoch, slot_time)
-		}
-		column = fmt.Sprintf("MEAN(value) * %f", uomMultiplier)
-
-		sql := fmt.Sprintf(
-			"SELECT %s FROM %s.\"%s\" WHERE service = '%s' AND metric = '%s' AND time >= %s AND time <= %s GROUP BY time(%s) fill(%s); "+
-				"SELECT MIN(value) * %[10]f, MAX(value) * %[10]f, MEAN(value) * %[10]f, STDDEV(value) * %[10]f, PERCENTILE(value, 95) * %[10]f FROM %[2]s.\"%[3]s\" WHERE service = '%[4]s' AND metric = '%[5]s' AND time >= %[6]s AND time <= %[7]s",
-			column,
-			dbRp,
-			hsm.eHost,
-			hsm.Service,
-			hsm.Metric,
-			start_time,
-			end_time,
-			slot_time,
-			qsParams.fillOption,
-			uomMultiplier,
-		)
-		this.log.Debug("dstype(%s) uomLabel(%s) uomMultiplier(%f)\n", dstype, uomLabel, uomMultiplier)
-		this.log.Debug("sql(%s)\n", sql)
-
-		q := client.Query{
-			Command:   sql,
-			Database:  this.config.InfluxDB.Database,
-			Precision: "s",
+	// baselines of series of HSMs, not of attribute selectors nor expressions
+	baselines := make(map[string][]*hsmQuery)
+	if qsParams.baseline != nil {
+		keys := make([]string, 0, len(queries))
+		for key := range queries {
+			keys = append(keys, key)
 		}
-		var results []client.Result
-		if response, err := db.Query(q); err == nil {
-			if resError := response.Error(); resError != nil {
-				this.sendHTTPError(w, http.StatusInternalServerError, "Failed to query database: %s", resError)
+		sort.Strings(keys)
+		for _, key := range keys {
+			if baselines[key], err = batch.AddBaseline(queries[key].hsm, qsParams.baseline); err != nil {
+				this.sendHTTPError(w, http.StatusInternalServerError, "%s", err)
 				return
 			}
-			results = response.Results
-		} else {
-			this.sendHTTPError(w, http.StatusInternalServerError, "Failed to query database: %s", err)
-			return
 		}
-		this.log.Debug("results(%+v)\n", results)
+	}
 
-		metrics[hsm.HSM] = &QueryResultData{
-			Uom: uomLabel,
+	// the same HSM may be referenced by more expressions
+	exprQueries := make(map[string]func() []*hsmQuery)
+	for _, expression := range qsParams.expressions {
+		for _, ref := range expression.refs {
+			if _, ok := exprQueries[ref.HSM]; ok {
+				continue
+			}
+			members, err := this.expressionSeries(batch, ref)
+			if err != nil {
+				this.sendHTTPError(w, http.StatusBadRequest, "Failed to query expression %s: %s", expression.name, err)
+				return
+			}
+			exprQueries[ref.HSM] = members
 		}
+	}
 
-		stats := &QueryResultDataStats{nil, nil, nil, nil, nil}
-
-		if (len(results) == 2 && len(results[0].Series) == 1 && len(results[1].Series) == 1) &&
-			(len(results[1].Series[0].Values) >= 1 && len(results[1].Series[0].Values[0]) == 6) {
-
-			rowsCount := len(results[0].Series[0].Values)
-			metrics[hsm.HSM].Data = make([][2]interface{}, 0, rowsCount)
+	if err := batch.Run(db); err != nil {
+		this.sendHTTPError(w, http.StatusInternalServerError, "%s", err)
+		return
+	}
 
-			if len(results[1].Series[0].Values) == 1 { // InfluxDB < 1.2
-				stats = &QueryResultDataStats{
-					Min:    results[1].Series[0].Values[0][1],
-					Max:    results[1].Series[0].Values[0][2],
-					Avg:    results[1].Series[0].Values[0][3],
-					Stddev: results[1].Series[0].Values[0][4],
-					P95:    results[1].Series[0].Values[0][5],
-				}
-			} else { // InfluxDB 1.2.0
-				for i, _ := range results[1].Series[0].Values {
-					for j := 1; j < 6; j++ {
-						if results[1].Series[0].Values[i][j] != nil {
-							if j == 1 {
-								stats.Min = results[1].Series[0].Values[i][j]
-							} else if j == 2 {
-								stats.Max = results[1].Series[0].Values[i][j]
-							} else if j == 3 {
-								stats.Avg = results[1].Series[0].Values[i][j]
-							} else if j == 4 {
-								stats.Stddev = results[1].Series[0].Values[i][j]
-							} else if j == 5 {
-								stats.P95 = results[1].Series[0].Values[i][j]
-							}
-						}
-					}
-				}
+	metrics := make(QueryResults, len(queries))
+	for key, query := range queries {
+		metrics[key] = query.Result()
+	}
+	for _, attribute := range attributes {
+		if qsParams.hostsAggregate == "" {
+			for _, query := range attribute.queries {
+				metrics[query.hsm.HSM] = query.Result()
 			}
-			var prev_val, prev_calc_val json.Number
-			var prev_ts int64
-			var skip_value bool
-
-			is_counter := dstype == "COUNTER"
-			is_counter_mode_ps := qsParams.counterMetricsMode == "per_second"
-
-			for i, row := range results[0].Series[0].Values {
-				ts, _ := row[0].(json.Number).Int64()
-				skip_value = false
-
-				if ts > qsParams.endEpoch {
-					break
-				}
-
-				ts += int64(tz_offset)
-
-				if is_counter {
-					if row[1] == nil {
-						prev_val = json.Number("")
-						prev_calc_val = json.Number("")
-						skip_value = true
-					} else if prev_val != "" {
-						prev, _ := prev_val.Float64()
-						cur, _ := row[1].(json.Number).Float64()
-						diff := cur - prev
-
-						prev_val = row[1].(json.Number)
-
-						if is_counter && diff < 0 {
-							row[1] = prev_calc_val
-						} else {
-							if is_counter_mode_ps {
-								row[1] = json.Number(fmt.Sprintf("%f", diff/float64(ts-prev_ts)))
-							} else {
-								row[1] = json.Number(fmt.Sprintf("%f", diff))
-							}
-
-							prev_calc_val = row[1].(json.Number)
-						}
-					} else {
-						prev_val = row[1].(json.Number)
-						skip_value = true
-					}
-					if i == 0 {
-						goto SKIP_DATAPOINT
-					}
-				}
-
-				if skip_value {
-					metrics[hsm.HSM].Data = append(metrics[hsm.HSM].Data, [2]interface{}{ts, nil})
-				} else {
-					metrics[hsm.HSM].Data = append(metrics[hsm.HSM].Data, [2]interface{}{ts, row[1]})
-				}
-
-			SKIP_DATAPOINT:
-				prev_ts = ts
+			continue
+		}
 
+		// InfluxDB does not aggregate series of different measurements
+		members := make(map[string][]*QueryResultData)
+		if attribute.value != "" {
+			members[attribute.value] = nil
+		}
+		for i, query := range attribute.queries {
+			members[attribute.values[i]] = append(members[attribute.values[i]], query.Result())
+		}
+		for value, series := range members {
+			key := attribute.hsm.hsmKey("@"+attribute.name+"="+value, attribute.hsm.Service, attribute.hsm.Metric)
+			metrics[key] = aggregateSeries(qsParams.hostsAggregate, series)
+		}
+	}
+	if len(qsParams.expressions) > 0 {
+		exprSeries := make(map[string][]*QueryResultData, len(exprQueries))
+		for key, members := range exprQueries {
+			for _, query := range members() {
+				exprSeries[key] = append(exprSeries[key], query.Result())
 			}
-		} else {
-			metrics[hsm.HSM].Data = make([][2]interface{}, 0)
 		}
+		for _, expression := range qsParams.expressions {
+			// keys of series matched by patterns or attribute selectors
+			if _, ok := metrics[expression.name]; ok {
+				this.sendHTTPError(w, http.StatusBadRequest, "Name of expression %s is already used by a series", expression.name)
+				return
+			}
+			result, err := expression.Eval(exprSeries)
+			if err != nil {
+				this.sendHTTPError(w, http.StatusBadRequest, "Failed to evaluate expression %s: %s", expression.name, err)
+				return
+			}
+			metrics[expression.name] = result
+		}
+	}
 
-		metrics[hsm.HSM].Stats = stats
+	// results may be shared with the cache, they are copied before adding
+	// baseline or forecast
+	for key, history := range baselines {
+		past := make([]*QueryResultData, len(history))
+		for i, query := range history {
+			past[i] = query.Result()
+		}
+		result := *metrics[key]
+		result.Baseline = baselineSeries(qsParams.baseline, &result, past, batch.slot)
+		metrics[key] = &result
+	}
+	if qsParams.forecast != nil {
+		for key, result := range metrics {
+			projected := *result
+			projected.Forecast = forecastSeries(qsParams.forecast, result.Data, batch.slot, qsParams.dataPoints)
+			metrics[key] = &projected
+		}
 	}
 
 	json, err := json.Marshal(metrics)
@@ -0,0 +1,148 @@
+package timeseries
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"net/url"
+	"sort"
+	"testing"
+	"time"
+)
+
+func TestParseHSMPattern(t *testing.T) {
+	tests := []struct {
+		host, service, metric string
+		pattern               bool
+		matches, nonMatching  [][5]string
+	}{
+		{"web1", "CPU", "load1", false, nil, nil},
+		{"web*", "CPU", "*", true,
+			[][5]string{{"web1", "CPU", "load5"}, {"web22", "CPU", "load1"}},
+			[][5]string{{"db1", "CPU", "load1"}, {"web1", "Disk", "/"}}},
+		{"web?", "CPU", "load1", true,
+			[][5]string{{"web1", "CPU", "load1"}},
+			[][5]string{{"web1x", "CPU", "load1"}, {"web1", "CPU", "load5"}}},
+		{"~^db[0-9]+$", "Disk 'C:'", "used", true,
+			[][5]string{{"db12", "Disk 'C:'", "used"}},
+			[][5]string{{"db1a", "Disk 'C:'", "used"}, {"db1", "Disk 'C:'", "free"}}},
+		{"web1", "~Disk", "/", true,
+			[][5]string{{"web1", "Disk: /", "/"}, {"web1", "Disk 'C:'", "/"}},
+			[][5]string{{"web1", "Disk: /", "/var"}, {"web11", "Disk: /", "/"}}},
+		{`web\*`, "CPU", `load\?`, false, nil, nil},
+		{`\~web*`, `Disk \*`, "used", true,
+			[][5]string{{"~web1", "Disk *", "used"}},
+			[][5]string{{"web1", "Disk *", "used"}, {"~web1", "Disk C:", "used"}}},
+	}
+
+	for _, test := range tests {
+		filter, err := parseHSMPattern(test.host, test.service, test.metric)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if (filter != nil) != test.pattern {
+			t.Errorf("%s::%s::%s expected pattern %v", test.host, test.service, test.metric, test.pattern)
+			continue
+		}
+		if filter == nil {
+			continue
+		}
+		for _, m := range test.matches {
+			if !filter.Match(m) {
+				t.Errorf("%s::%s::%s does not match %v", test.host, test.service, test.metric, m)
+			}
+		}
+		for _, m := range test.nonMatching {
+			if filter.Match(m) {
+				t.Errorf("%s::%s::%s matches %v", test.host, test.service, test.metric, m)
+			}
+		}
+	}
+
+	if _, err := parseHSMPattern("~web(", "CPU", "load1"); err == nil {
+		t.Errorf("Expected error for invalid regular expression")
+	}
+}
+
+func TestQueryHandlerPattern(t *testing.T) {
+	tenant, cleanup := newTestTenant(t)
+	defer cleanup()
+
+	if err := tenant.updateMetadata([][5]string{
+		{"web1", "CPU", "load1", "GAUGE", ""},
+		{"web1", "CPU", "load5", "GAUGE", ""},
+		{"web2", "CPU", "load1", "GAUGE", ""},
+		{"web2", "Disk", "/", "GAUGE", "MB"},
+		{"db1", "CPU", "load1", "GAUGE", ""},
+		{"db1", "Disk *", "used", "GAUGE", "MB"},
+	}, time.Now().Unix()); err != nil {
+		t.Fatal(err)
+	}
+
+	fake := newFakeInfluxDB([][]interface{}{{1500000000, 1}})
+	defer fake.Close()
+	server := newTestQueryServer(tenant, fake.URL)
+	server.config.Server.Queries.MaxPatternMatches = 3
+
+	query := func(hsms ...string) (int, map[string]QueryResultData) {
+		params := url.Values{"start": {"1500000000"}, "end": {"1500003600"}, "hsm": hsms}
+		w := httptest.NewRecorder()
+		server.QueryHandler(w, httptest.NewRequest("GET", "/query?"+params.Encode(), nil), nil, tenant)
+
+		var results map[string]QueryResultData
+		if w.Code == 200 {
+			if err := json.Unmarshal(w.Body.Bytes(), &results); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return w.Code, results
+	}
+
+	tests := []struct {
+		hsm      string
+		expected []string
+	}{
+		{"web*::CPU::*", []string{"web1::CPU::load1", "web1::CPU::load5", "web2::CPU::load1"}},
+		{"~^(web2|db1)$::CPU::load1", []string{"db1::CPU::load1", "web2::CPU::load1"}},
+		{"*::Disk::/", []string{"web2::Disk::/"}},
+		{"mail*::CPU::load1", []string{}},
+		{`db1::Disk \*::used`, []string{"db1::Disk *::used"}},
+	}
+	for _, test := range tests {
+		code, results := query(test.hsm)
+		if code != 200 {
+			t.Errorf("%s: unexpected response %d", test.hsm, code)
+			continue
+		}
+		keys := make([]string, 0, len(results))
+		for k, r := range results {
+			keys = append(keys, k)
+			if len(r.Data) != 1 {
+				t.Errorf("%s: unexpected data of %s: %v", test.hsm, k, r.Data)
+			}
+		}
+		sort.Strings(keys)
+		if len(keys) != len(test.expected) {
+			t.Errorf("%s: expected %v got %v", test.hsm, test.expected, keys)
+			continue
+		}
+		for i := range keys {
+			if keys[i] != test.expected[i] {
+				t.Errorf("%s: expected %v got %v", test.hsm, test.expected, keys)
+				break
+			}
+		}
+	}
+
+	if code, _ := query("*::*::*"); code != 400 {
+		t.Errorf("Expected error when pattern matches too many series, got %d", code)
+	}
+	if code, _ := query("web*::CPU::load1", "db*::CPU::*"); code != 200 {
+		t.Errorf("Expected patterns within the limit to succeed, got %d", code)
+	}
+	if code, _ := query("web*::CPU::*", "db*::CPU::*"); code != 400 {
+		t.Errorf("Expected error when patterns of the request match too many series, got %d", code)
+	}
+	if code, _ := query("~web(::CPU::load1"); code != 400 {
+		t.Errorf("Expected error for invalid pattern, got %d", code)
+	}
+}
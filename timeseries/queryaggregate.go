@@ -0,0 +1,90 @@
+package timeseries
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+const QUERY_PERCENTILE_PREFIX = "percentile_"
+
+var queryAggregateFunctions = map[string]string{
+	"mean":   "MEAN",
+	"max":    "MAX",
+	"min":    "MIN",
+	"last":   "LAST",
+	"first":  "FIRST",
+	"sum":    "SUM",
+	"median": "MEDIAN",
+	"count":  "COUNT",
+}
+
+// queryAggregate is the function used to aggregate values of one time slot,
+// percentile_N selects the Nth percentile
+type queryAggregate struct {
+	function   string
+	percentile int
+}
+
+func parseQueryAggregate(name string) (queryAggregate, error) {
+	if strings.HasPrefix(name, QUERY_PERCENTILE_PREFIX) {
+		n, err := strconv.Atoi(strings.TrimPrefix(name, QUERY_PERCENTILE_PREFIX))
+		if err != nil || n < 1 || n > 100 {
+			return queryAggregate{}, errors.New(fmt.Sprintf("Invalid percentile: %s", name))
+		}
+		return queryAggregate{function: "percentile", percentile: n}, nil
+	}
+	if _, ok := queryAggregateFunctions[name]; !ok {
+		return queryAggregate{}, errors.New(fmt.Sprintf("Unknown aggregate function: %s", name))
+	}
+
+	return queryAggregate{function: name}, nil
+}
+
+func (this queryAggregate) String() string {
+	if this.function == "percentile" {
+		return fmt.Sprintf("%s%d", QUERY_PERCENTILE_PREFIX, this.percentile)
+	}
+
+	return this.function
+}
+
+// number of points is not scaled by uom nor derived for counters
+func (this queryAggregate) counted() bool {
+	return this.function == "count"
+}
+
+// isCounter reports dstypes whose values are derived to rates
+func isCounter(dstype string) bool {
+	return dstype == "COUNTER" || dstype == "DERIVE"
+}
+
+func (this queryAggregate) derived(dstype string) bool {
+	return isCounter(dstype) && !this.counted() && !this.rated(dstype)
+}
+
+// rated counters are derived point by point before the slot is aggregated
+func (this queryAggregate) rated(dstype string) bool {
+	if !isCounter(dstype) {
+		return false
+	}
+	switch this.function {
+	case "max", "min", "first", "median", "percentile":
+		return true
+	}
+
+	return false
+}
+
+// increase of a counter during the slot is difference of the last values
+func (this queryAggregate) selector(dstype string) string {
+	switch {
+	case this.function == "percentile":
+		return fmt.Sprintf("PERCENTILE(value, %d)", this.percentile)
+	case this.function == "sum" && this.derived(dstype):
+		return "LAST(value)"
+	}
+
+	return queryAggregateFunctions[this.function] + "(value)"
+}
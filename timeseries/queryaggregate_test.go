@@ -0,0 +1,119 @@
+package timeseries
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseQueryAggregate(t *testing.T) {
+	tests := []struct {
+		name, dstype, selector string
+	}{
+		{"mean", "GAUGE", "MEAN(value)"},
+		{"max", "GAUGE", "MAX(value)"},
+		{"sum", "GAUGE", "SUM(value)"},
+		{"sum", "COUNTER", "LAST(value)"},
+		{"sum", "DERIVE", "LAST(value)"},
+		{"count", "COUNTER", "COUNT(value)"},
+		{"median", "DERIVE", "MEDIAN(value)"},
+		{"percentile_95", "GAUGE", "PERCENTILE(value, 95)"},
+		{"max", "COUNTER", "MAX(value)"},
+	}
+	for _, test := range tests {
+		aggregate, err := parseQueryAggregate(test.name)
+		if err != nil {
+			t.Errorf("%s: %s", test.name, err)
+			continue
+		}
+		if aggregate.String() != test.name {
+			t.Errorf("%s: unexpected name %s", test.name, aggregate)
+		}
+		if s := aggregate.selector(test.dstype); s != test.selector {
+			t.Errorf("%s of %s: expected %s got %s", test.name, test.dstype, test.selector, s)
+		}
+	}
+
+	for name, rated := range map[string]bool{"max": true, "percentile_95": true, "first": true, "mean": false, "sum": false, "count": false} {
+		aggregate, _ := parseQueryAggregate(name)
+		if aggregate.rated("COUNTER") != rated || aggregate.rated("DERIVE") != rated || aggregate.rated("GAUGE") {
+			t.Errorf("%s: expected rated %v", name, rated)
+		}
+		if aggregate.derived("COUNTER") == (rated || name == "count") || aggregate.derived("DERIVE") != aggregate.derived("COUNTER") || aggregate.derived("GAUGE") {
+			t.Errorf("%s: unexpected derived", name)
+		}
+	}
+
+	for _, name := range []string{"", "avg", "percentile_", "percentile_0", "percentile_101", "percentile_x"} {
+		if _, err := parseQueryAggregate(name); err == nil {
+			t.Errorf("Expected error for %q", name)
+		}
+	}
+}
+
+func TestQueryHandlerAggregate(t *testing.T) {
+	tenant, cleanup := newTestTenant(t)
+	defer cleanup()
+
+	if err := tenant.updateMetadata([][5]string{
+		{"h1", "CPU", "load1", "GAUGE", ""},
+		{"h1", "Disk", "used", "GAUGE", "KB"},
+		{"h1", "Interface", "bytes", "COUNTER", ""},
+	}, time.Now().Unix()); err != nil {
+		t.Fatal(err)
+	}
+
+	fake := newFakeInfluxDB([][]interface{}{{1500000000, 10}, {1500000300, 40}})
+	defer fake.Close()
+	server := newTestQueryServer(tenant, fake.URL)
+
+	w := httptest.NewRecorder()
+	hsms := []string{"h1::CPU::load1", "h1::CPU::load1::percentile_95", "h1::Disk::used::count", "h1::Interface::bytes::sum",
+		"h1::Interface::bytes::max", "h1::Interface::bytes::percentile_95"}
+	server.QueryHandler(w, httptest.NewRequest("GET", "/query?start=1500000000&end=1500003600&aggregate=max&counter_metrics_mode=difference&hsm="+strings.Join(hsms, "&hsm="), nil), nil, tenant)
+	if w.Code != 200 {
+		t.Fatalf("Unexpected response %d: %s", w.Code, w.Body.String())
+	}
+
+	var results map[string]QueryResultData
+	if err := json.Unmarshal(w.Body.Bytes(), &results); err != nil {
+		t.Fatal(err)
+	}
+	for _, hsm := range hsms {
+		if _, ok := results[hsm]; !ok {
+			t.Errorf("Missing result of %s", hsm)
+		}
+	}
+	if r := results["h1::Disk::used::count"]; r.Uom != "" || r.Stats == nil || r.Stats.Max != 40.0 {
+		t.Errorf("Unexpected result of count: %+v %+v", r, r.Stats)
+	}
+	if r := results["h1::Interface::bytes::sum"]; len(r.Data) != 1 || r.Data[0][1] != 30.0 {
+		t.Errorf("Unexpected result of counter sum: %+v", r)
+	}
+	// slot aggregates of counter rates are not derived again
+	for _, hsm := range []string{"h1::Interface::bytes::max", "h1::Interface::bytes::percentile_95"} {
+		if r := results[hsm]; len(r.Data) != 2 || r.Data[0][1] != 10.0 || r.Data[1][1] != 40.0 {
+			t.Errorf("Unexpected result of %s: %+v", hsm, r)
+		}
+	}
+
+	requests := fake.Requests()
+	if len(requests) != 1 {
+		t.Fatalf("Expected one request, got %d", len(requests))
+	}
+	for _, selector := range []string{"MAX(value) * 1.000000", "PERCENTILE(value, 95) * 1.000000", "COUNT(value) * 1.000000", "LAST(value) * 1.000000",
+		`MAX(value) * 1.000000 FROM (SELECT NON_NEGATIVE_DIFFERENCE(value) AS value FROM "opsview"."autogen"."h1" WHERE ("service" = 'Interface' AND "metric" = 'bytes') AND time >= 1500000000s - `,
+		`PERCENTILE(value, 95) * 1.000000 FROM (SELECT NON_NEGATIVE_DIFFERENCE(value) AS value FROM`} {
+		if !strings.Contains(requests[0], selector) {
+			t.Errorf("Expected %s in %s", selector, requests[0])
+		}
+	}
+
+	w = httptest.NewRecorder()
+	server.QueryHandler(w, httptest.NewRequest("GET", "/query?start=1500000000&end=1500003600&aggregate=avg&hsm=h1::CPU::load1", nil), nil, tenant)
+	if w.Code != 400 {
+		t.Errorf("Expected error for unknown aggregate, got %d", w.Code)
+	}
+}
@@ -0,0 +1,694 @@
+package timeseries
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/ajgb/go-opsview/timeseries/influxql"
+	"github.com/influxdata/influxdb/client/v2"
+	"github.com/influxdata/influxdb/models"
+	"sync"
+	"time"
+)
+
+const (
+	// number of statement pairs sent to InfluxDB in one request, the query
+	// is passed in the URL so it can not grow without limits
+	QUERY_BATCH_SIZE = 25
+	// requests of one query sent to InfluxDB in parallel
+	QUERY_CONCURRENCY = 4
+)
+
+// segmentQuery is a part of the requested time range with the same dstype and
+// uom
+type segmentQuery struct {
+	hsm       QueryParamsHSM
+	aggregate queryAggregate
+	segment   metadataSegment
+	query     metadataSegment
+	shift     int64
+	cached    [][2]interface{}
+	result    *QueryResultData
+}
+
+type hsmQuery struct {
+	hsm       QueryParamsHSM
+	uom       string
+	tz_offset int
+	segments  []*segmentQuery
+}
+
+type queryGroupKey struct {
+	measurement, start, end, selector string
+	multiplier                        float64
+	// function deriving counters in subquery, see queryAggregate.rated
+	rate string
+	// the summary describes raw values, or rates of counters, of the whole
+	// segment, number of points is summarized from the slots
+	statsStart, statsEnd int64
+	statsRate            string
+	counted              bool
+	summaryOnly          bool
+}
+
+// queryGroup selects series of all HSMs of one measurement with the same time
+// range, slot aggregate and uom multiplier with one pair of statements grouped
+// by tags
+type queryGroup struct {
+	queryGroupKey
+	members   []*segmentQuery
+	attribute *attributeQuery
+}
+
+// attributeQuery selects series of all hosts with the attribute by its tag,
+// InfluxDB returns one series for each host and value of the attribute
+type attributeQuery struct {
+	hsm         QueryParamsHSM
+	name, value string
+	aggregate   queryAggregate
+	segment     metadataSegment
+	tz_offset   int
+	queries     []*hsmQuery
+	values      []string
+}
+
+// queryBatch sends statements of all HSMs of a request in requests of
+// batchSize groups, concurrency of them at a time
+type queryBatch struct {
+	server      *TimeseriesServer
+	tenant      *TimeseriesTenant
+	qsParams    *QueryParams
+	tz_offset   int
+	slot_time   string
+	slot        int64
+	cache       *QueryCache
+	batchSize   int
+	concurrency int
+	groups      map[queryGroupKey]*queryGroup
+	order       []*queryGroup
+	// series matched by patterns of the request so far
+	patternMatches int
+	// only summaries of series are queried, see Summarize
+	summaryOnly, last bool
+}
+
+// newQueryBatch aligns the requested range to slots if results are cached so
+// refreshed graphs reuse the same slots, qsParams of the caller are not
+// modified
+func (this *TimeseriesServer) newQueryBatch(tenant *TimeseriesTenant, qsParams *QueryParams, tz_offset int) *queryBatch {
+	batch := &queryBatch{
+		server:      this,
+		tenant:      tenant,
+		qsParams:    qsParams,
+		tz_offset:   tz_offset,
+		slot_time:   CalculateTimeSlotSize(qsParams.dataPoints, qsParams.startEpoch, qsParams.endEpoch, float64(qsParams.minTimeSlot), float64(qsParams.fixedTimeSlot)),
+		batchSize:   this.config.Server.Queries.BatchSize,
+		concurrency: this.config.Server.Queries.Concurrency,
+		groups:      make(map[queryGroupKey]*queryGroup),
+	}
+	if batch.batchSize < 1 {
+		batch.batchSize = QUERY_BATCH_SIZE
+	}
+	if batch.concurrency < 1 {
+		batch.concurrency = QUERY_CONCURRENCY
+	}
+	if batch.slot = TimeSlotSeconds(batch.slot_time); batch.slot > 0 && tenant.queryCache != nil {
+		batch.cache = tenant.queryCache
+		aligned := *qsParams
+		aligned.startEpoch = qsParams.startEpoch / batch.slot * batch.slot
+		aligned.endEpoch = qsParams.endEpoch / batch.slot * batch.slot
+		batch.qsParams = &aligned
+	}
+
+	return batch
+}
+
+// Summarize plans only summary statements, values of slots are queried only
+// for series with more segments. Results are not cached without values, last
+// adds the last value to the summary.
+func (this *queryBatch) Summarize(last bool) {
+	this.summaryOnly = true
+	this.last = last
+	this.cache = nil
+}
+
+func (this *queryBatch) Add(hsm QueryParamsHSM) (*hsmQuery, error) {
+	return this.AddRange(hsm, this.qsParams.startEpoch, this.qsParams.endEpoch)
+}
+
+// AddRange plans queries of the HSM in another time range with the same slots
+func (this *queryBatch) AddRange(hsm QueryParamsHSM, start, end int64) (*hsmQuery, error) {
+	this.server.log.Debug("Host(%s) Service(%s) Metric(%s) start(%d) end(%d)\n", hsm.Host, hsm.Service, hsm.Metric, start, end)
+
+	dstype, uom, err := this.tenant.GetHSMmetadata(hsm.Host, hsm.Service, hsm.Metric)
+	if err != nil {
+		return nil, errors.New(fmt.Sprintf("Failed to query metadata information: %s", err))
+	}
+	changes, err := this.tenant.metadataChanges(hsm.Host, hsm.Service, hsm.Metric, start, end)
+	if err != nil {
+		return nil, errors.New(fmt.Sprintf("Failed to query metadata history: %s", err))
+	}
+
+	aggregate := this.aggregate(hsm)
+	// number of points has no unit
+	if aggregate.counted() {
+		uom = ""
+	}
+
+	// each part of the range is scaled with the uom valid at that time
+	query := &hsmQuery{hsm: hsm, uom: uom, tz_offset: this.tz_offset}
+	segments := metadataSegments(start, end, dstype, uom, changes)
+	for _, segment := range segments {
+		if aggregate.counted() {
+			segment.uom = ""
+		}
+		member := &segmentQuery{hsm: hsm, aggregate: aggregate, segment: segment, query: segment, shift: this.qsParams.startEpoch - start}
+		query.segments = append(query.segments, member)
+
+		if this.cache != nil {
+			var cached *QueryResultData
+			cached, member.cached, member.query.start = this.cache.Lookup(this.cacheKey(member), segment.start, segment.end)
+			if cached != nil {
+				this.server.log.Debug("Cached HSM(%s) start(%d) end(%d)\n", hsm.HSM, segment.start, segment.end)
+				member.result = cached
+				continue
+			}
+			if member.query.start > segment.end {
+				member.result = this.complete(member, nil)
+				continue
+			}
+		}
+
+		key := this.groupKey(hsm.Host, aggregate, member.query, segment)
+		// values of the slots summarize series with more segments
+		key.summaryOnly = this.summaryOnly && len(segments) == 1 && !aggregate.counted()
+		group, ok := this.groups[key]
+		if !ok {
+			group = &queryGroup{queryGroupKey: key}
+			this.groups[key] = group
+			this.order = append(this.order, group)
+		}
+		group.members = append(group.members, member)
+	}
+
+	return query, nil
+}
+
+// AddAttribute plans query of series of the attribute selector, they are
+// scaled with the same uom so all hosts must have the same metadata
+func (this *queryBatch) AddAttribute(hsm QueryParamsHSM) (*attributeQuery, error) {
+	name, value := hsm.attributeSelector()
+	metadata, err := this.tenant.store.AttributeMetadata(name, value, hsm.Service, hsm.Metric)
+	if err != nil {
+		return nil, errors.New(fmt.Sprintf("Failed to query host attributes: %s", err))
+	}
+	if len(metadata) > 1 {
+		return nil, errors.New(fmt.Sprintf("Hosts with attribute %s have different dstype or uom of %s::%s", name, hsm.Service, hsm.Metric))
+	}
+	this.server.log.Debug("Attribute(%s) Value(%s) Service(%s) Metric(%s)\n", name, value, hsm.Service, hsm.Metric)
+
+	query := &attributeQuery{hsm: hsm, name: name, value: value, aggregate: this.aggregate(hsm), tz_offset: this.tz_offset}
+	if len(metadata) == 0 {
+		return query, nil
+	}
+
+	query.segment = metadataSegment{start: this.qsParams.startEpoch, end: this.qsParams.endEpoch, dstype: metadata[0][0], uom: metadata[0][1]}
+	if query.aggregate.counted() {
+		query.segment.uom = ""
+	}
+	this.order = append(this.order, &queryGroup{
+		queryGroupKey: this.groupKey("", query.aggregate, query.segment, query.segment),
+		attribute:     query,
+	})
+
+	return query, nil
+}
+
+func (this *queryBatch) aggregate(hsm QueryParamsHSM) queryAggregate {
+	if hsm.aggregate != nil {
+		return *hsm.aggregate
+	}
+
+	return this.qsParams.aggregate
+}
+
+func (this *queryBatch) cacheKey(member *segmentQuery) queryCacheKey {
+	return queryCacheKey{
+		host:        member.hsm.Host,
+		service:     member.hsm.Service,
+		metric:      member.hsm.Metric,
+		dstype:      member.segment.dstype,
+		uom:         member.segment.uom,
+		slot:        this.slot_time,
+		aggregate:   member.aggregate.String(),
+		fill:        this.qsParams.fillOption,
+		counterMode: this.qsParams.counterMetricsMode,
+		rp:          this.qsParams.retentionPolicy,
+		shift:       member.shift,
+	}
+}
+
+func (this *queryBatch) complete(member *segmentQuery, part *QueryResultData) *QueryResultData {
+	if this.cache == nil {
+		return part
+	}
+
+	result := part
+	if member.query.start != member.segment.start {
+		result = &QueryResultData{Data: member.cached}
+		result.Uom, _ = ConvertUom(member.segment.uom)
+		if part != nil {
+			result.Data = append(result.Data, part.Data...)
+		}
+		// summary of the part covers the whole segment
+		if part != nil && !member.aggregate.counted() {
+			result.Stats = part.Stats
+		} else {
+			result.Stats = calculateStats(result.Data)
+		}
+	}
+	this.cache.Store(this.cacheKey(member), member.segment.start, member.segment.end, this.completeUntil(member, result), result)
+
+	return result
+}
+
+// completeUntil returns start of the first slot of the result which may still
+// change. Slots after the last value may yet receive late points and values
+// filled by linear, previous or numeric fill cannot be told apart from
+// queried ones, so nothing is final with them.
+func (this *queryBatch) completeUntil(member *segmentQuery, result *QueryResultData) int64 {
+	if fill := this.qsParams.fillOption; fill != "null" && fill != "none" {
+		return member.segment.start
+	}
+
+	complete := completeSlot(time.Now(), this.slot)
+	for i := len(result.Data) - 1; i >= 0; i-- {
+		if result.Data[i][1] == nil {
+			continue
+		}
+		if next := result.Data[i][0].(int64) + this.slot; next < complete {
+			complete = next
+		}
+		return complete
+	}
+
+	return member.segment.start
+}
+
+// groupKey of the segment queried from the start of query, which is later
+// than start of the segment if its beginning is cached
+func (this *queryBatch) groupKey(host string, aggregate queryAggregate, query, segment metadataSegment) queryGroupKey {
+	key := queryGroupKey{
+		measurement: host,
+		selector:    aggregate.selector(query.dstype),
+		statsStart:  segment.start,
+		statsEnd:    segment.end,
+		counted:     aggregate.counted(),
+	}
+	_, key.multiplier = ConvertUom(query.uom)
+	if isCounter(query.dstype) && !key.counted {
+		key.statsRate = this.counterRate()
+	}
+
+	if aggregate.rated(query.dstype) {
+		key.rate = this.counterRate()
+		key.start = fmt.Sprintf("%ds", query.start)
+	} else if isCounter(query.dstype) {
+		// until influxdb fixes #7185 we calculate COUNTER/DERIVE manually
+		key.start = fmt.Sprintf("%ds - %s", query.start, this.slot_time)
+	} else { //case "GAUGE":
+		key.start = fmt.Sprintf("%ds", query.start)
+	}
+	key.end = fmt.Sprintf("%ds + %s", query.end, this.slot_time)
+
+	return key
+}
+
+func (this *queryBatch) counterRate() string {
+	if this.qsParams.counterMetricsMode == "per_second" {
+		return "NON_NEGATIVE_DERIVATIVE(value, 1s)"
+	}
+
+	return "NON_NEGATIVE_DIFFERENCE(value)"
+}
+
+// statements returns values of the slots and summary of the group, there is no
+// summary of counted slots and no values of summarized series
+func (this *queryBatch) statements(group *queryGroup) (values, summary influxql.Statement) {
+	var from, where string
+	groupBy := []string{"service", "metric"}
+
+	if attribute := group.attribute; attribute != nil {
+		from = influxql.AllMeasurements(this.tenant.config.InfluxDB.Database, this.qsParams.retentionPolicy)
+		selector := influxql.Ne(attribute.name, "")
+		if attribute.value != "" {
+			selector = influxql.Eq(attribute.name, attribute.value)
+		}
+		where = influxql.And(influxql.Eq("service", attribute.hsm.Service), influxql.Eq("metric", attribute.hsm.Metric), selector)
+		groupBy = append(groupBy, influxql.QuoteIdent(attribute.name))
+	} else {
+		// the same HSM may be requested more than once
+		seen := make(map[[2]string]bool, len(group.members))
+		conditions := make([]string, 0, len(group.members))
+		for _, member := range group.members {
+			k := [2]string{member.hsm.Service, member.hsm.Metric}
+			if seen[k] {
+				continue
+			}
+			seen[k] = true
+			conditions = append(conditions, influxql.And(influxql.Eq("service", k[0]), influxql.Eq("metric", k[1])))
+		}
+
+		from = influxql.Measurement(this.tenant.config.InfluxDB.Database, this.qsParams.retentionPolicy, group.measurement)
+		where = influxql.Or(conditions...)
+	}
+
+	m := group.multiplier
+	selector := influxql.Select(fmt.Sprintf("%s * %f", group.selector, m))
+	if group.rate == "" {
+		selector.From(from).Where(where)
+	} else {
+		// the first rate of the range is derived from the slot before
+		rates := influxql.Select(group.rate+" AS value").
+			From(from).
+			Where(where).
+			TimeRange(group.start+" - "+this.slot_time, group.end).
+			GroupBy(groupBy...)
+		selector.From("(" + rates.String() + ")")
+	}
+
+	if !group.summaryOnly {
+		values = selector.
+			TimeRange(group.start, group.end).
+			GroupByTime(this.slot_time).
+			GroupBy(groupBy...).
+			Fill(this.qsParams.fillOption)
+	}
+	if group.counted {
+		return values, nil
+	}
+
+	fields := []string{
+		fmt.Sprintf("MIN(value) * %f", m),
+		fmt.Sprintf("MAX(value) * %f", m),
+		fmt.Sprintf("MEAN(value) * %f", m),
+		fmt.Sprintf("STDDEV(value) * %f", m),
+		fmt.Sprintf("PERCENTILE(value, 95) * %f", m),
+	}
+	if this.last {
+		fields = append(fields, fmt.Sprintf("LAST(value) * %f", m))
+	}
+	stats := influxql.Select(fields...)
+	start, end := fmt.Sprintf("%ds", group.statsStart), fmt.Sprintf("%ds", group.statsEnd)
+	if group.statsRate == "" {
+		stats.From(from).Where(where)
+	} else {
+		rates := influxql.Select(group.statsRate+" AS value").
+			From(from).
+			Where(where).
+			TimeRange(start+" - "+this.slot_time, end).
+			GroupBy(groupBy...)
+		stats.From("(" + rates.String() + ")")
+	}
+	summary = stats.
+		TimeRange(start, end).
+		GroupBy(groupBy...)
+
+	return
+}
+
+func (this *queryBatch) Run(db client.Client) error {
+	chunks := make([][]*queryGroup, 0, len(this.order)/this.batchSize+1)
+	for first := 0; first < len(this.order); first += this.batchSize {
+		last := first + this.batchSize
+		if last > len(this.order) {
+			last = len(this.order)
+		}
+		chunks = append(chunks, this.order[first:last])
+	}
+
+	workers := this.concurrency
+	if workers > len(chunks) {
+		workers = len(chunks)
+	}
+
+	errs := make([]error, len(chunks))
+	jobs := make(chan int)
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			for n := range jobs {
+				errs[n] = this.query(db, chunks[n])
+			}
+		}()
+	}
+	for n := range chunks {
+		jobs <- n
+	}
+	close(jobs)
+	wg.Wait()
+
+	for _, err := range errs {
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (this *queryBatch) query(db client.Client, groups []*queryGroup) error {
+	// positions of results of values and summary of each group
+	statements := make([]influxql.Statement, 0, 2*len(groups))
+	positions := make([][2]int, len(groups))
+	for i, group := range groups {
+		values, summary := this.statements(group)
+		positions[i] = [2]int{-1, -1}
+		for j, statement := range []influxql.Statement{values, summary} {
+			if statement != nil {
+				positions[i][j] = len(statements)
+				statements = append(statements, statement)
+			}
+		}
+	}
+	sql := influxql.Join(statements...)
+	this.server.log.Debug("sql(%s)\n", sql)
+
+	q := client.Query{
+		Command:   sql,
+		Database:  this.tenant.config.InfluxDB.Database,
+		Precision: "s",
+	}
+	response, err := db.Query(q)
+	if err != nil {
+		return errors.New(fmt.Sprintf("Failed to query database: %s", err))
+	}
+	if resError := response.Error(); resError != nil {
+		return errors.New(fmt.Sprintf("Failed to query database: %s", resError))
+	}
+	if len(response.Results) != len(statements) {
+		return errors.New(fmt.Sprintf("Failed to query database: expected %d results, got %d", len(statements), len(response.Results)))
+	}
+	this.server.log.Debug("results(%+v)\n", response.Results)
+
+	for i, group := range groups {
+		var values, summary client.Result
+		if positions[i][0] >= 0 {
+			values = response.Results[positions[i][0]]
+		}
+		if positions[i][1] >= 0 {
+			summary = response.Results[positions[i][1]]
+		}
+		if group.attribute != nil {
+			group.attribute.collect(this, values, summary)
+			continue
+		}
+		for _, member := range group.members {
+			part := this.server.segmentResult(this.qsParams, member.aggregate, member.query, findSeries(values, member.hsm), findSeries(summary, member.hsm))
+			member.result = this.complete(member, part)
+		}
+	}
+
+	return nil
+}
+
+func findSeries(result client.Result, hsm QueryParamsHSM) *models.Row {
+	for i, series := range result.Series {
+		if series.Tags["service"] == hsm.Service && series.Tags["metric"] == hsm.Metric {
+			return &result.Series[i]
+		}
+	}
+
+	return nil
+}
+
+func (this *attributeQuery) collect(batch *queryBatch, values, summary client.Result) {
+	for i := range values.Series {
+		series := &values.Series[i]
+		value := series.Tags[this.name]
+
+		var stats *models.Row
+		for j, s := range summary.Series {
+			if s.Name == series.Name && s.Tags[this.name] == value {
+				stats = &summary.Series[j]
+				break
+			}
+		}
+
+		hsm := this.hsm
+		hsm.Host = series.Name
+		hsm.eHost = series.Name
+		hsm.HSM = this.hsm.hsmKey(series.Name, this.hsm.Service, this.hsm.Metric)
+		member := &segmentQuery{hsm: hsm, aggregate: this.aggregate, segment: this.segment, query: this.segment}
+		member.result = batch.server.segmentResult(batch.qsParams, this.aggregate, this.segment, series, stats)
+
+		this.queries = append(this.queries, &hsmQuery{hsm: hsm, uom: this.segment.uom, tz_offset: this.tz_offset, segments: []*segmentQuery{member}})
+		this.values = append(this.values, value)
+	}
+}
+
+func (this *hsmQuery) Result() *QueryResultData {
+	result := this.merge()
+	if this.tz_offset == 0 {
+		return result
+	}
+
+	shifted := *result
+	shifted.Data = make([][2]interface{}, len(result.Data))
+	for i, row := range result.Data {
+		shifted.Data[i] = [2]interface{}{row[0].(int64) + int64(this.tz_offset), row[1]}
+	}
+
+	return &shifted
+}
+
+func (this *hsmQuery) merge() *QueryResultData {
+	if len(this.segments) == 1 {
+		return this.segments[0].result
+	}
+
+	result := &QueryResultData{}
+	result.Uom, _ = ConvertUom(this.uom)
+	result.Data = make([][2]interface{}, 0)
+	for _, segment := range this.segments {
+		part := segment.result
+		// the slot starting before the change belongs to the newer segment
+		for len(result.Data) > 0 && len(part.Data) > 0 && result.Data[len(result.Data)-1][0].(int64) >= part.Data[0][0].(int64) {
+			result.Data = result.Data[:len(result.Data)-1]
+		}
+		result.Data = append(result.Data, part.Data...)
+	}
+	// summaries of segments scaled by different uoms can not be combined
+	result.Stats = calculateStats(result.Data)
+
+	return result
+}
+
+// summaryStats reads the summary statement, InfluxDB < 1.2 returns one row and
+// InfluxDB 1.2 a row for each column
+func summaryStats(summary *models.Row) *QueryResultDataStats {
+	stats := &QueryResultDataStats{}
+	if summary == nil || len(summary.Values) == 0 || len(summary.Values[0]) < 6 {
+		return stats
+	}
+
+	fields := []*interface{}{&stats.Min, &stats.Max, &stats.Avg, &stats.Stddev, &stats.P95, &stats.last}
+	for _, row := range summary.Values {
+		for j, field := range fields {
+			if j+1 < len(row) && row[j+1] != nil {
+				*field = row[j+1]
+			}
+		}
+	}
+
+	return stats
+}
+
+// rows are not modified as the series may be shared by more HSMs
+func (this *TimeseriesServer) segmentResult(qsParams *QueryParams, aggregate queryAggregate, segment metadataSegment, values, summary *models.Row) *QueryResultData {
+	dstype := segment.dstype
+	uomLabel, uomMultiplier := ConvertUom(segment.uom)
+	this.log.Debug("dstype(%s) uomLabel(%s) uomMultiplier(%f)\n", dstype, uomLabel, uomMultiplier)
+
+	result := &QueryResultData{
+		Uom: uomLabel,
+	}
+
+	if values != nil {
+		rowsCount := len(values.Values)
+		result.Data = make([][2]interface{}, 0, rowsCount)
+
+		var prev_val, prev_calc_val json.Number
+		var prev_ts int64
+		var skip_value bool
+
+		is_counter := aggregate.derived(dstype)
+		is_counter_mode_ps := qsParams.counterMetricsMode == "per_second"
+
+		for i, row := range values.Values {
+			ts, _ := row[0].(json.Number).Int64()
+			value := row[1]
+			skip_value = false
+
+			if ts > segment.end {
+				break
+			}
+
+			if is_counter {
+				if value == nil {
+					prev_val = json.Number("")
+					prev_calc_val = json.Number("")
+					skip_value = true
+				} else if prev_val != "" {
+					prev, _ := prev_val.Float64()
+					cur, _ := value.(json.Number).Float64()
+					diff := cur - prev
+
+					prev_val = value.(json.Number)
+
+					if is_counter && diff < 0 {
+						value = prev_calc_val
+					} else {
+						if is_counter_mode_ps {
+							value = json.Number(fmt.Sprintf("%f", diff/float64(ts-prev_ts)))
+						} else {
+							value = json.Number(fmt.Sprintf("%f", diff))
+						}
+
+						prev_calc_val = value.(json.Number)
+					}
+				} else {
+					prev_val = value.(json.Number)
+					skip_value = true
+				}
+				if i == 0 {
+					goto SKIP_DATAPOINT
+				}
+			}
+
+			if skip_value {
+				result.Data = append(result.Data, [2]interface{}{ts, nil})
+			} else {
+				result.Data = append(result.Data, [2]interface{}{ts, value})
+			}
+
+		SKIP_DATAPOINT:
+			prev_ts = ts
+
+		}
+	} else {
+		result.Data = make([][2]interface{}, 0)
+	}
+
+	// number of points describes the slots, not the metric
+	if aggregate.counted() {
+		result.Stats = calculateStats(result.Data)
+	} else {
+		result.Stats = summaryStats(summary)
+	}
+
+	return result
+}
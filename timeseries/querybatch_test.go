@@ -0,0 +1,337 @@
+package timeseries
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/influxdata/influxdb/client/v2"
+	"github.com/influxdata/influxdb/models"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+var testHSMCondition = regexp.MustCompile(`"service" = '((?:[^'\\]|\\.)*)' AND "metric" = '((?:[^'\\]|\\.)*)'`)
+
+var testStartCondition = regexp.MustCompile(`time >= ([0-9]+)s`)
+
+func unquoteTestString(s string) string {
+	return strings.NewReplacer(`\\`, `\`, `\'`, `'`).Replace(s)
+}
+
+// fakeInfluxDB answers every SELECT with series of all HSMs in its conditions,
+// values returns given rows and summary returns one row of stats, both can be
+// set per metric; rangeRows returns rows of the statement's start instead
+type fakeInfluxDB struct {
+	*httptest.Server
+	lock        sync.Mutex
+	requests    []string
+	rows        [][]interface{}
+	metricRows  map[string][][]interface{}
+	rangeRows   func(start int64) [][]interface{}
+	summaries   map[string][]interface{}
+	delay       time.Duration
+	inFlight    int
+	maxInFlight int
+}
+
+func newFakeInfluxDB(rows [][]interface{}) *fakeInfluxDB {
+	fake := &fakeInfluxDB{rows: rows}
+	fake.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		command := r.FormValue("q")
+		fake.lock.Lock()
+		fake.requests = append(fake.requests, command)
+		fake.inFlight++
+		if fake.inFlight > fake.maxInFlight {
+			fake.maxInFlight = fake.inFlight
+		}
+		fake.lock.Unlock()
+		defer func() {
+			fake.lock.Lock()
+			fake.inFlight--
+			fake.lock.Unlock()
+		}()
+		time.Sleep(fake.delay)
+
+		var response client.Response
+		for _, statement := range strings.Split(command, "; ") {
+			var result client.Result
+			for _, m := range testHSMCondition.FindAllStringSubmatch(statement, -1) {
+				metric := unquoteTestString(m[2])
+				row := models.Row{
+					Name:    "measurement",
+					Tags:    map[string]string{"service": unquoteTestString(m[1]), "metric": metric},
+					Columns: []string{"time", "value"},
+					Values:  fake.rows,
+				}
+				if fake.rangeRows != nil {
+					start, _ := strconv.ParseInt(testStartCondition.FindStringSubmatch(statement)[1], 10, 64)
+					row.Values = fake.rangeRows(start)
+				}
+				if rows, ok := fake.metricRows[metric]; ok {
+					// series without data are not returned at all
+					if len(rows) == 0 {
+						continue
+					}
+					row.Values = rows
+				}
+				if !strings.Contains(statement, "GROUP BY time(") {
+					row.Columns = []string{"time", "min", "max", "mean", "stddev", "percentile"}
+					row.Values = [][]interface{}{{0, 1, 2, 1.5, 0.5, 2}}
+					if summary, ok := fake.summaries[metric]; ok {
+						row.Values = [][]interface{}{summary}
+					}
+				}
+				result.Series = append(result.Series, row)
+			}
+			response.Results = append(response.Results, result)
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(response)
+	}))
+
+	return fake
+}
+
+func (this *fakeInfluxDB) Requests() []string {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	return append([]string{}, this.requests...)
+}
+
+func newTestQueryServer(tenant *TimeseriesTenant, influxdb string) *TimeseriesServer {
+	tenant.config.InfluxDB.Server = influxdb
+	tenant.config.InfluxDB.Database = "opsview"
+	tenant.config.InfluxDB.RetentionPolicy = "autogen"
+
+	return &TimeseriesServer{
+		config: &TimeseriesConfig{
+			Server: TimeseriesServerConfig{
+				Queries: TimeseriesServerQueriesConfig{
+					FillOption:         "null",
+					DataPoints:         500,
+					CounterMetricsMode: "per_second",
+					Aggregate:          "mean",
+				},
+			},
+		},
+		log: tenant.log,
+	}
+}
+
+func TestQueryBatch(t *testing.T) {
+	tenant, cleanup := newTestTenant(t)
+	defer cleanup()
+
+	if err := tenant.updateMetadata([][5]string{
+		{"h1", "CPU", "load1", "GAUGE", ""},
+		{"h1", "Disk 'C:'", "used", "GAUGE", ""},
+		{"h1", "Disk 'C:'", "size", "GAUGE", "MB"},
+		{"h2", "CPU", "load1", "GAUGE", ""},
+	}, time.Now().Unix()); err != nil {
+		t.Fatal(err)
+	}
+
+	fake := newFakeInfluxDB([][]interface{}{{1500000000, 1}, {1500000300, 2}})
+	defer fake.Close()
+	server := newTestQueryServer(tenant, fake.URL)
+
+	hsms := []string{"h1::CPU::load1", "h1::Disk%20'C:'::used", "h1::Disk%20'C:'::size", "h2::CPU::load1", "h1::CPU::load1"}
+	w := httptest.NewRecorder()
+	server.QueryHandler(w, httptest.NewRequest("GET", "/query?start=1500000000&end=1500003600&hsm="+strings.Join(hsms, "&hsm="), nil), nil, tenant)
+	if w.Code != 200 {
+		t.Fatalf("Unexpected response %d: %s", w.Code, w.Body.String())
+	}
+
+	var results map[string]QueryResultData
+	if err := json.Unmarshal(w.Body.Bytes(), &results); err != nil {
+		t.Fatal(err)
+	}
+	for _, hsm := range []string{"h1::CPU::load1", "h1::Disk 'C:'::used", "h1::Disk 'C:'::size", "h2::CPU::load1"} {
+		if r, ok := results[hsm]; !ok || len(r.Data) != 2 || r.Stats == nil || r.Stats.Max == nil {
+			t.Errorf("Unexpected result of %s: %+v", hsm, results[hsm])
+		}
+	}
+	if len(results) != 4 {
+		t.Errorf("Unexpected number of results: %d", len(results))
+	}
+
+	// one request, h1 with the same uom in one pair of statements
+	requests := fake.Requests()
+	if len(requests) != 1 {
+		t.Fatalf("Expected one request, got %d", len(requests))
+	}
+	if n := len(strings.Split(requests[0], "; ")); n != 6 {
+		t.Errorf("Expected 6 statements, got %d: %s", n, requests[0])
+	}
+	if n := strings.Count(requests[0], `"metric" = 'load1'`); n != 4 {
+		t.Errorf("Duplicated HSM queried more than once: %s", requests[0])
+	}
+}
+
+func TestQueryBatchStats(t *testing.T) {
+	tenant, cleanup := newTestTenant(t)
+	defer cleanup()
+
+	if err := tenant.updateMetadata([][5]string{
+		{"h1", "CPU", "load1", "GAUGE", ""},
+		{"h1", "Interface", "bytes", "COUNTER", ""},
+		{"h1", "Disk", "used", "GAUGE", "MB"},
+	}, 1400000000); err != nil {
+		t.Fatal(err)
+	}
+	if err := tenant.updateMetadata([][5]string{{"h1", "Disk", "used", "GAUGE", "B"}}, 1500001800); err != nil {
+		t.Fatal(err)
+	}
+
+	fake := newFakeInfluxDB([][]interface{}{{1500000000, 1}, {1500000300, 2}})
+	fake.summaries = map[string][]interface{}{
+		"load1": {0, 1, 50, 1.5, 0.5, 40},
+		"bytes": {0, 3, 30, 10, 5, 25},
+	}
+	defer fake.Close()
+	server := newTestQueryServer(tenant, fake.URL)
+
+	w := httptest.NewRecorder()
+	server.QueryHandler(w, httptest.NewRequest("GET", "/query?start=1500000000&end=1500003600&hsm=h1::CPU::load1&hsm=h1::Interface::bytes&hsm=h1::Disk::used", nil), nil, tenant)
+	if w.Code != 200 {
+		t.Fatalf("Unexpected response %d: %s", w.Code, w.Body.String())
+	}
+	var results map[string]QueryResultData
+	if err := json.Unmarshal(w.Body.Bytes(), &results); err != nil {
+		t.Fatal(err)
+	}
+
+	// peaks between slots are kept by summary of raw values
+	if r := results["h1::CPU::load1"]; r.Stats == nil || r.Stats.Max != 50.0 || r.Stats.P95 != 40.0 {
+		t.Errorf("Unexpected stats of gauge: %+v", r.Stats)
+	}
+	if r := results["h1::Interface::bytes"]; r.Stats == nil || r.Stats.Max != 30.0 {
+		t.Errorf("Unexpected stats of counter: %+v", r.Stats)
+	}
+	// segments with different uoms are summarized from the slots
+	if r := results["h1::Disk::used"]; r.Stats == nil || r.Stats.Max != 2.0 {
+		t.Errorf("Unexpected stats of changed series: %+v", r.Stats)
+	}
+
+	requests := fake.Requests()
+	if len(requests) != 1 || !strings.Contains(requests[0], "SELECT MIN(value) * 1.000000, MAX(value) * 1.000000, MEAN(value) * 1.000000, STDDEV(value) * 1.000000, PERCENTILE(value, 95) * 1.000000 FROM (SELECT NON_NEGATIVE_DERIVATIVE(value, 1s) AS value") {
+		t.Errorf("Counter not summarized by its rate: %v", requests)
+	}
+}
+
+func TestQueryBatchSize(t *testing.T) {
+	tenant, cleanup := newTestTenant(t)
+	defer cleanup()
+
+	fake := newFakeInfluxDB([][]interface{}{{1500000000, 1}})
+	defer fake.Close()
+	server := newTestQueryServer(tenant, fake.URL)
+
+	qsParams := &QueryParams{
+		startEpoch: 1500000000, endEpoch: 1500003600, dataPoints: 500,
+		fillOption: "null", retentionPolicy: "autogen",
+	}
+	hsms := make([]QueryParamsHSM, QUERY_BATCH_SIZE+1)
+	data := make([][5]string, len(hsms))
+	for i := range hsms {
+		hsms[i] = QueryParamsHSM{Host: fmt.Sprintf("h%d", i), Service: "CPU", Metric: "load1"}
+		data[i] = [5]string{hsms[i].Host, "CPU", "load1", "GAUGE", ""}
+	}
+	if err := tenant.updateMetadata(data, time.Now().Unix()); err != nil {
+		t.Fatal(err)
+	}
+
+	batch := server.newQueryBatch(tenant, qsParams, 0)
+	queries := make([]*hsmQuery, 0)
+	for _, hsm := range hsms {
+		query, err := batch.Add(hsm)
+		if err != nil {
+			t.Fatal(err)
+		}
+		queries = append(queries, query)
+	}
+
+	db, err := tenant.NewInfluxDBClient()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if err := batch.Run(db); err != nil {
+		t.Fatal(err)
+	}
+
+	if n := len(fake.Requests()); n != 2 {
+		t.Errorf("Expected 2 requests, got %d", n)
+	}
+	for i, query := range queries {
+		if r := query.Result(); len(r.Data) != 1 {
+			t.Errorf("Unexpected result of query #%d: %+v", i, r)
+		}
+	}
+}
+
+func TestQueryBatchConcurrency(t *testing.T) {
+	tenant, cleanup := newTestTenant(t)
+	defer cleanup()
+
+	fake := newFakeInfluxDB([][]interface{}{{1500000000, 1}})
+	fake.delay = 50 * time.Millisecond
+	defer fake.Close()
+	server := newTestQueryServer(tenant, fake.URL)
+	server.config.Server.Queries.BatchSize = 1
+	server.config.Server.Queries.Concurrency = 3
+
+	data := make([][5]string, 10)
+	for i := range data {
+		data[i] = [5]string{fmt.Sprintf("h%d", i), "CPU", "load1", "GAUGE", ""}
+	}
+	if err := tenant.updateMetadata(data, time.Now().Unix()); err != nil {
+		t.Fatal(err)
+	}
+
+	qsParams := &QueryParams{
+		startEpoch: 1500000000, endEpoch: 1500003600, dataPoints: 500,
+		fillOption: "null", retentionPolicy: "autogen",
+	}
+	batch := server.newQueryBatch(tenant, qsParams, 0)
+	queries := make([]*hsmQuery, len(data))
+	for i, d := range data {
+		var err error
+		if queries[i], err = batch.Add(QueryParamsHSM{Host: d[0], Service: d[1], Metric: d[2]}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	db, err := tenant.InfluxDBClient()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := batch.Run(db); err != nil {
+		t.Fatal(err)
+	}
+
+	if n := len(fake.Requests()); n != len(data) {
+		t.Errorf("Expected %d requests, got %d", len(data), n)
+	}
+	fake.lock.Lock()
+	maxInFlight := fake.maxInFlight
+	fake.lock.Unlock()
+	if maxInFlight < 2 || maxInFlight > 3 {
+		t.Errorf("Expected at most 3 parallel requests, got %d", maxInFlight)
+	}
+	for i, query := range queries {
+		if r := query.Result(); len(r.Data) != 1 {
+			t.Errorf("Unexpected result of query #%d: %+v", i, r)
+		}
+	}
+
+	if shared, _ := tenant.InfluxDBClient(); shared != db {
+		t.Errorf("InfluxDB client not reused")
+	}
+}
@@ -0,0 +1,177 @@
+package timeseries
+
+import (
+	"container/list"
+	"sync"
+	"time"
+)
+
+type queryCacheKey struct {
+	host, service, metric, dstype, uom string
+	slot, fill, counterMode, rp        string
+	aggregate                          string
+	// ranges shifted to previous periods are cached apart from the current
+	shift int64
+}
+
+type queryCacheEntry struct {
+	key        queryCacheKey
+	start, end int64
+	// slots starting before are complete and will not change
+	complete int64
+	result   *QueryResultData
+	updated  time.Time
+	element  *list.Element
+}
+
+// QueryCache keeps results of queried segments. The same range is served from
+// the cache for ttl, complete slots are reused for overlapping ranges until
+// the entry is evicted to keep number of cached points within maxPoints.
+type QueryCache struct {
+	ttl       time.Duration
+	maxPoints int
+
+	lock    sync.Mutex
+	points  int
+	entries map[queryCacheKey]*queryCacheEntry
+	lru     *list.List
+}
+
+func NewQueryCache(ttl time.Duration, maxPoints int) *QueryCache {
+	return &QueryCache{
+		ttl:       ttl,
+		maxPoints: maxPoints,
+		entries:   make(map[queryCacheKey]*queryCacheEntry),
+		lru:       list.New(),
+	}
+}
+
+// completeSlot returns start of the first slot which may still receive data,
+// the slot before the current one is included as points arrive late
+func completeSlot(now time.Time, slot int64) int64 {
+	return now.Unix()/slot*slot - slot
+}
+
+func copyData(data [][2]interface{}) [][2]interface{} {
+	return append(make([][2]interface{}, 0, len(data)), data...)
+}
+
+// Lookup returns cached result of the range if it is fresh, otherwise
+// complete slots at the beginning of the range and time from which the rest
+// has to be queried, past end if there is nothing to query
+func (this *QueryCache) Lookup(key queryCacheKey, start, end int64) (*QueryResultData, [][2]interface{}, int64) {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	entry, ok := this.entries[key]
+	if !ok || entry.start > start {
+		return nil, nil, start
+	}
+	this.lru.MoveToFront(entry.element)
+
+	if entry.start == start && entry.end == end && time.Since(entry.updated) < this.ttl {
+		result := *entry.result
+		result.Data = copyData(entry.result.Data)
+		return &result, nil, end + 1
+	}
+
+	from := entry.complete
+	if from > entry.end+1 {
+		from = entry.end + 1
+	}
+	if from <= start {
+		return nil, nil, start
+	}
+	if from > end+1 {
+		from = end + 1
+	}
+
+	slots := make([][2]interface{}, 0)
+	for _, row := range entry.result.Data {
+		ts := row[0].(int64)
+		if ts >= start && ts < from {
+			slots = append(slots, row)
+		}
+	}
+
+	return nil, slots, from
+}
+
+func (this *QueryCache) Store(key queryCacheKey, start, end, complete int64, result *QueryResultData) {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	if entry, ok := this.entries[key]; ok {
+		this.remove(entry)
+	}
+	if len(result.Data) > this.maxPoints {
+		return
+	}
+
+	stored := *result
+	stored.Data = copyData(result.Data)
+	entry := &queryCacheEntry{
+		key:      key,
+		start:    start,
+		end:      end,
+		complete: complete,
+		result:   &stored,
+		updated:  time.Now(),
+	}
+	entry.element = this.lru.PushFront(entry)
+	this.entries[key] = entry
+	this.points += len(result.Data)
+
+	for this.points > this.maxPoints {
+		this.remove(this.lru.Back().Value.(*queryCacheEntry))
+	}
+}
+
+func (this *QueryCache) remove(entry *queryCacheEntry) {
+	this.lru.Remove(entry.element)
+	delete(this.entries, entry.key)
+	this.points -= len(entry.result.Data)
+}
+
+func (this *QueryCache) Invalidate(changes []MetadataChange) {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	changed := make(map[metadataKey]bool, len(changes))
+	for _, c := range changes {
+		changed[metadataKey{c.Host, c.Service, c.Metric}] = true
+	}
+	for key, entry := range this.entries {
+		if changed[metadataKey{key.host, key.service, key.metric}] {
+			this.remove(entry)
+		}
+	}
+}
+
+// empty service or metric matches any
+func (this *QueryCache) Forget(host, service, metric string) {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	for key, entry := range this.entries {
+		if key.host == host && (service == "" || key.service == service) && (metric == "" || key.metric == metric) {
+			this.remove(entry)
+		}
+	}
+}
+
+func (this *TimeseriesTenant) forgetQueryResults(requests ...AdminRequest) {
+	if this.queryCache == nil {
+		return
+	}
+	for _, req := range requests {
+		this.queryCache.Forget(req.Host, req.Service, req.Metric)
+	}
+}
+
+func (this *QueryCache) Len() (entries, points int) {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	return len(this.entries), this.points
+}
@@ -0,0 +1,156 @@
+package timeseries
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func testSlots(start, end, slot int64) [][2]interface{} {
+	data := make([][2]interface{}, 0)
+	for ts := start; ts <= end; ts += slot {
+		data = append(data, [2]interface{}{ts, json.Number("1")})
+	}
+
+	return data
+}
+
+func TestQueryCache(t *testing.T) {
+	cache := NewQueryCache(time.Minute, 100)
+	key := queryCacheKey{host: "h1", service: "CPU", metric: "load1", slot: "10s"}
+
+	if result, _, from := cache.Lookup(key, 1000, 1200); result != nil || from != 1000 {
+		t.Errorf("Unexpected lookup in empty cache: %v %d", result, from)
+	}
+
+	cache.Store(key, 1000, 1200, 1100, &QueryResultData{Data: testSlots(1000, 1200, 10)})
+
+	// the same range is served from the cache
+	result, _, from := cache.Lookup(key, 1000, 1200)
+	if result == nil || len(result.Data) != 21 || from != 1201 {
+		t.Errorf("Expected cached result, got %v from %d", result, from)
+	}
+	result.Data[0][1] = nil
+	if again, _, _ := cache.Lookup(key, 1000, 1200); again.Data[0][1] == nil {
+		t.Errorf("Cached data modified through returned result")
+	}
+
+	// complete slots are reused for overlapping range
+	result, slots, from := cache.Lookup(key, 1050, 1300)
+	if result != nil || from != 1100 || len(slots) != 5 || slots[0][0].(int64) != 1050 {
+		t.Errorf("Unexpected partial lookup: %v %v from %d", result, slots, from)
+	}
+	result, slots, from = cache.Lookup(key, 1000, 1050)
+	if result != nil || from != 1051 || len(slots) != 6 {
+		t.Errorf("Unexpected lookup of complete range: %v %v from %d", result, slots, from)
+	}
+	if result, _, from := cache.Lookup(key, 990, 1200); result != nil || from != 990 {
+		t.Errorf("Range starting before cached one reused: %v from %d", result, from)
+	}
+
+	// least recently used entries are evicted
+	other := key
+	other.host = "h2"
+	cache.Store(other, 1000, 1800, 1100, &QueryResultData{Data: testSlots(1000, 1800, 10)})
+	if entries, points := cache.Len(); entries != 1 || points != 81 {
+		t.Errorf("Expected one entry with 81 points, got %d %d", entries, points)
+	}
+	if _, _, from := cache.Lookup(key, 1000, 1200); from != 1000 {
+		t.Errorf("Evicted entry found")
+	}
+
+	cache.Store(key, 1000, 1200, 1100, &QueryResultData{Data: testSlots(1000, 1200, 10)})
+	cache.Invalidate([]MetadataChange{{Type: METADATA_CHANGED, Host: "h1", Service: "CPU", Metric: "load1"}})
+	cache.Forget("h2", "", "")
+	if entries, points := cache.Len(); entries != 0 || points != 0 {
+		t.Errorf("Expected empty cache, got %d entries %d points", entries, points)
+	}
+}
+
+func TestQueryHandlerCache(t *testing.T) {
+	tenant, cleanup := newTestTenant(t)
+	defer cleanup()
+
+	if err := tenant.updateMetadata([][5]string{
+		{"h1", "CPU", "load1", "GAUGE", ""},
+		{"h1", "CPU", "load5", "GAUGE", ""},
+	}, time.Now().Unix()); err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Now().Unix() / 60 * 60
+	rows := func(start, end int64) [][]interface{} {
+		values := make([][]interface{}, 0)
+		for ts := start / 60 * 60; ts <= end; ts += 60 {
+			values = append(values, []interface{}{ts, 1})
+		}
+		return values
+	}
+	fake := newFakeInfluxDB(nil)
+	defer fake.Close()
+	fake.rangeRows = func(start int64) [][]interface{} {
+		return rows(start, now)
+	}
+	// load5 stopped reporting an hour ago
+	fake.metricRows = map[string][][]interface{}{"load5": rows(now-DAY, now-HOUR)}
+	server := newTestQueryServer(tenant, fake.URL)
+	tenant.queryCache = NewQueryCache(time.Minute, 10000)
+
+	query := func(start, end int64, params string) string {
+		w := httptest.NewRecorder()
+		server.QueryHandler(w, httptest.NewRequest("GET", fmt.Sprintf("/query?start=%d&end=%d&fixed_time_slot=60%s", start, end, params), nil), nil, tenant)
+		if w.Code != 200 {
+			t.Fatalf("Unexpected response %d: %s", w.Code, w.Body.String())
+		}
+		requests := fake.Requests()
+		return requests[len(requests)-1]
+	}
+
+	query(now-DAY, now, "&hsm=h1::CPU::load1")
+	query(now-DAY+10, now, "&hsm=h1::CPU::load1")
+	if n := len(fake.Requests()); n != 1 {
+		t.Errorf("Expected one request for the same aligned range, got %d", n)
+	}
+
+	// only slots which were not complete are queried again
+	request := query(now-DAY+HOUR, now+HOUR, "&hsm=h1::CPU::load1")
+	if n := len(fake.Requests()); n != 2 {
+		t.Fatalf("Expected 2 requests, got %d", n)
+	}
+	complete := completeSlot(time.Unix(now, 0), 60)
+	if !strings.Contains(request, fmt.Sprintf("time >= %ds ", complete)) && !strings.Contains(request, fmt.Sprintf("time >= %ds ", complete+60)) {
+		t.Errorf("Expected query of incomplete slots from %d: %s", complete, request)
+	}
+
+	// slots after the last value may still receive late points
+	query(now-DAY, now, "&hsm=h1::CPU::load5")
+	if request := query(now-DAY+HOUR, now+HOUR, "&hsm=h1::CPU::load5"); !strings.Contains(request, fmt.Sprintf("time >= %ds ", now-HOUR+60)) {
+		t.Errorf("Expected query of slots after the last value from %d: %s", now-HOUR+60, request)
+	}
+
+	// filled values are not final
+	query(now-DAY, now, "&hsm=h1::CPU::load1&fill_option=linear")
+	if request := query(now-DAY+HOUR, now+HOUR, "&hsm=h1::CPU::load1&fill_option=linear"); !strings.Contains(request, fmt.Sprintf("time >= %ds ", now-DAY+HOUR)) {
+		t.Errorf("Expected query of the whole range with linear fill: %s", request)
+	}
+}
+
+func TestQueryBatchAlign(t *testing.T) {
+	tenant, cleanup := newTestTenant(t)
+	defer cleanup()
+
+	server := newTestQueryServer(tenant, "")
+	tenant.queryCache = NewQueryCache(time.Minute, 1000)
+
+	qsParams := &QueryParams{startEpoch: 1500000010, endEpoch: 1500003610, fixedTimeSlot: 60, fillOption: "null"}
+	batch := server.newQueryBatch(tenant, qsParams, 0)
+	if batch.qsParams.startEpoch != 1500000000 || batch.qsParams.endEpoch != 1500003600 {
+		t.Errorf("Unexpected aligned range %d-%d", batch.qsParams.startEpoch, batch.qsParams.endEpoch)
+	}
+	if qsParams.startEpoch != 1500000010 || qsParams.endEpoch != 1500003610 {
+		t.Errorf("Requested range modified to %d-%d", qsParams.startEpoch, qsParams.endEpoch)
+	}
+}
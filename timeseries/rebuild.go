@@ -0,0 +1,196 @@
+package timeseries
+
+import (
+	"errors"
+	"fmt"
+	"github.com/ajgb/go-opsview/timeseries/influxql"
+	"github.com/influxdata/influxdb/client/v2"
+	"regexp"
+	"strings"
+	"time"
+)
+
+const (
+	REBUILD_DEFAULT_DSTYPE = "GAUGE"
+	REBUILD_DEFAULT_UOM    = ""
+)
+
+type metadataRule struct {
+	service *regexp.Regexp
+	metric  *regexp.Regexp
+	value   metadataValue
+}
+
+type RebuildReport struct {
+	Series    int         `json:"series"`
+	Existing  int         `json:"existing"`
+	Added     int         `json:"added"`
+	Unmatched int         `json:"unmatched"`
+	Entries   [][5]string `json:"entries"`
+}
+
+func compileMetadataRules(rules []TimeseriesMetadataRule) ([]metadataRule, error) {
+	compiled := make([]metadataRule, 0, len(rules))
+	for i, rule := range rules {
+		if !ValidDstype(rule.Dstype) {
+			return nil, errors.New(fmt.Sprintf("Rule #%d: invalid dstype: %s", i+1, rule.Dstype))
+		}
+
+		// empty pattern matches anything
+		r := metadataRule{value: metadataValue{rule.Dstype, rule.Uom}}
+		var err error
+		if rule.Service != "" {
+			if r.service, err = globToRegexp(rule.Service, false); err != nil {
+				return nil, errors.New(fmt.Sprintf("Rule #%d: invalid service: %s", i+1, err))
+			}
+		}
+		if rule.Metric != "" {
+			if r.metric, err = globToRegexp(rule.Metric, false); err != nil {
+				return nil, errors.New(fmt.Sprintf("Rule #%d: invalid metric: %s", i+1, err))
+			}
+		}
+		compiled = append(compiled, r)
+	}
+
+	return compiled, nil
+}
+
+func matchMetadataRule(rules []metadataRule, service, metric string) (metadataValue, bool) {
+	for _, rule := range rules {
+		if rule.service != nil && !rule.service.MatchString(service) {
+			continue
+		}
+		if rule.metric != nil && !rule.metric.MatchString(metric) {
+			continue
+		}
+		return rule.value, true
+	}
+
+	return metadataValue{REBUILD_DEFAULT_DSTYPE, REBUILD_DEFAULT_UOM}, false
+}
+
+func tagValues(result client.Result) []string {
+	values := make([]string, 0)
+	for _, series := range result.Series {
+		for _, row := range series.Values {
+			if len(row) == 2 {
+				if v, ok := row[1].(string); ok {
+					values = append(values, v)
+				}
+			}
+		}
+	}
+
+	return values
+}
+
+func (this *TimeseriesTenant) influxSeries(db client.Client) ([]metadataKey, error) {
+	database := this.config.InfluxDB.Database
+
+	results, err := influxQuery(db, database, "SHOW MEASUREMENTS")
+	if err != nil {
+		return nil, err
+	}
+	hosts := make([]string, 0)
+	for _, result := range results {
+		for _, series := range result.Series {
+			for _, row := range series.Values {
+				if name, ok := row[0].(string); ok {
+					hosts = append(hosts, name)
+				}
+			}
+		}
+	}
+
+	keys := make([]metadataKey, 0)
+	for _, host := range hosts {
+		results, err := influxQuery(db, database, "SHOW TAG VALUES FROM "+influxql.QuoteIdent(host)+" WITH KEY = \"service\"")
+		if err != nil {
+			return nil, err
+		}
+		if len(results) == 0 {
+			continue
+		}
+		services := tagValues(results[0])
+		if len(services) == 0 {
+			continue
+		}
+
+		// metrics of all services of the host in one request
+		statements := make([]string, len(services))
+		for i, service := range services {
+			statements[i] = fmt.Sprintf("SHOW TAG VALUES FROM %s WITH KEY = \"metric\" WHERE %s",
+				influxql.QuoteIdent(host), influxql.Eq("service", service))
+		}
+		results, err = influxQuery(db, database, strings.Join(statements, "; "))
+		if err != nil {
+			return nil, err
+		}
+		if len(results) != len(services) {
+			return nil, errors.New(fmt.Sprintf("Unexpected number of results for host %s: %d", host, len(results)))
+		}
+		for i, service := range services {
+			for _, metric := range tagValues(results[i]) {
+				keys = append(keys, metadataKey{host, service, metric})
+			}
+		}
+	}
+
+	return keys, nil
+}
+
+// existing rows are left untouched
+func (this *TimeseriesTenant) RebuildMetadata(rules []TimeseriesMetadataRule, dryRun bool) (*RebuildReport, error) {
+	compiled, err := compileMetadataRules(rules)
+	if err != nil {
+		return nil, err
+	}
+
+	db, err := this.NewInfluxDBClient()
+	if err != nil {
+		return nil, err
+	}
+	defer db.Close()
+
+	keys, err := this.influxSeries(db)
+	if err != nil {
+		return nil, errors.New(fmt.Sprintf("Failed to list series: %s", err))
+	}
+
+	existing, err := this.store.ListMetadataLastSeen()
+	if err != nil {
+		return nil, err
+	}
+
+	report := &RebuildReport{
+		Series:  len(keys),
+		Entries: make([][5]string, 0),
+	}
+	for _, key := range keys {
+		if _, ok := existing[key]; ok {
+			report.Existing++
+			continue
+		}
+
+		value, matched := matchMetadataRule(compiled, key.service, key.metric)
+		if !matched {
+			report.Unmatched++
+		}
+		report.Entries = append(report.Entries, [5]string{key.host, key.service, key.metric, value.dstype, value.uom})
+	}
+	report.Added = len(report.Entries)
+
+	if dryRun || len(report.Entries) == 0 {
+		return report, nil
+	}
+
+	if err := this.updateMetadata(report.Entries, time.Now().Unix()); err != nil {
+		return nil, err
+	}
+
+	return report, nil
+}
+
+func (this *TimeseriesServer) MetadataRebuildRules() []TimeseriesMetadataRule {
+	return this.config.Metadata.RebuildRules
+}
@@ -0,0 +1,38 @@
+package timeseries
+
+import (
+	"testing"
+)
+
+func TestMatchMetadataRule(t *testing.T) {
+	rules, err := compileMetadataRules([]TimeseriesMetadataRule{
+		{Service: "Disk*", Metric: "/*", Dstype: "GAUGE", Uom: "MB"},
+		{Service: "Interface*", Dstype: "COUNTER", Uom: "B"},
+		{Metric: "*time", Dstype: "GAUGE", Uom: "s"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		service, metric string
+		expected        metadataValue
+		matched         bool
+	}{
+		{"Disk: /", "/var", metadataValue{"GAUGE", "MB"}, true},
+		{"Disk: /", "inodes", metadataValue{REBUILD_DEFAULT_DSTYPE, REBUILD_DEFAULT_UOM}, false},
+		{"Interface eth0", "in", metadataValue{"COUNTER", "B"}, true},
+		{"HTTP", "response_time", metadataValue{"GAUGE", "s"}, true},
+		{"HTTP", "size", metadataValue{REBUILD_DEFAULT_DSTYPE, REBUILD_DEFAULT_UOM}, false},
+	}
+	for _, test := range tests {
+		value, matched := matchMetadataRule(rules, test.service, test.metric)
+		if matched != test.matched || value != test.expected {
+			t.Errorf("%s::%s expected %+v (%v) got %+v (%v)", test.service, test.metric, test.expected, test.matched, value, matched)
+		}
+	}
+
+	if _, err := compileMetadataRules([]TimeseriesMetadataRule{{Dstype: "BOGUS"}}); err == nil {
+		t.Errorf("Expected error for invalid dstype")
+	}
+}
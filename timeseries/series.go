@@ -0,0 +1,142 @@
+package timeseries
+
+import (
+	"encoding/json"
+	"math"
+	"sort"
+)
+
+var seriesAggregateFunctions = map[string]bool{
+	"mean": true,
+	"min":  true,
+	"max":  true,
+	"sum":  true,
+}
+
+func seriesValue(v interface{}) (float64, bool) {
+	switch x := v.(type) {
+	case json.Number:
+		f, err := x.Float64()
+		return f, err == nil
+	case float64:
+		return x, true
+	case int64:
+		return float64(x), true
+	case int:
+		return float64(x), true
+	}
+
+	return 0, false
+}
+
+// percentile mimics InfluxDB PERCENTILE(), values have to be sorted
+func percentile(values []float64, n float64) float64 {
+	i := int(math.Floor(float64(len(values))*n/100.0+0.5)) - 1
+	if i < 0 {
+		i = 0
+	}
+	if i >= len(values) {
+		i = len(values) - 1
+	}
+
+	return values[i]
+}
+
+func calculateStats(data [][2]interface{}) *QueryResultDataStats {
+	values := make([]float64, 0, len(data))
+	for _, row := range data {
+		if v, ok := seriesValue(row[1]); ok {
+			values = append(values, v)
+		}
+	}
+
+	stats := &QueryResultDataStats{}
+	if len(values) == 0 {
+		return stats
+	}
+	stats.last = values[len(values)-1]
+
+	var sum float64
+	for _, v := range values {
+		sum += v
+	}
+	mean := sum / float64(len(values))
+
+	sort.Float64s(values)
+	stats.Min = values[0]
+	stats.Max = values[len(values)-1]
+	stats.Avg = mean
+	stats.P95 = percentile(values, 95)
+
+	if len(values) > 1 {
+		var variance float64
+		for _, v := range values {
+			variance += (v - mean) * (v - mean)
+		}
+		stats.Stddev = math.Sqrt(variance / float64(len(values)-1))
+	}
+
+	return stats
+}
+
+func aggregateSeries(function string, series []*QueryResultData) *QueryResultData {
+	result := &QueryResultData{
+		Data: make([][2]interface{}, 0),
+	}
+	if len(series) == 0 {
+		result.Stats = calculateStats(result.Data)
+		return result
+	}
+	result.Uom = series[0].Uom
+
+	slots := make(map[int64][]float64)
+	timestamps := make([]int64, 0)
+	for _, s := range series {
+		for _, row := range s.Data {
+			ts, ok := row[0].(int64)
+			if !ok {
+				continue
+			}
+			values, seen := slots[ts]
+			if !seen {
+				timestamps = append(timestamps, ts)
+			}
+			if v, ok := seriesValue(row[1]); ok {
+				values = append(values, v)
+			}
+			slots[ts] = values
+		}
+	}
+	sort.Slice(timestamps, func(i, j int) bool { return timestamps[i] < timestamps[j] })
+
+	for _, ts := range timestamps {
+		values := slots[ts]
+		if len(values) == 0 {
+			result.Data = append(result.Data, [2]interface{}{ts, nil})
+			continue
+		}
+
+		value := values[0]
+		switch function {
+		case "min":
+			for _, v := range values[1:] {
+				value = math.Min(value, v)
+			}
+		case "max":
+			for _, v := range values[1:] {
+				value = math.Max(value, v)
+			}
+		case "sum", "mean":
+			for _, v := range values[1:] {
+				value += v
+			}
+			if function == "mean" {
+				value /= float64(len(values))
+			}
+		}
+		result.Data = append(result.Data, [2]interface{}{ts, value})
+	}
+	result.Stats = calculateStats(result.Data)
+
+	return result
+}
@@ -0,0 +1,66 @@
+package timeseries
+
+import (
+	"encoding/json"
+	"strconv"
+	"testing"
+)
+
+func TestAggregateSeries(t *testing.T) {
+	series := []*QueryResultData{
+		&QueryResultData{
+			Uom:  "percent",
+			Data: [][2]interface{}{{int64(100), json.Number("1")}, {int64(200), json.Number("4")}, {int64(300), nil}},
+		},
+		&QueryResultData{
+			Uom:  "percent",
+			Data: [][2]interface{}{{int64(100), json.Number("3")}, {int64(200), nil}, {int64(300), nil}},
+		},
+	}
+
+	tests := []struct {
+		function string
+		expected []interface{}
+	}{
+		{"mean", []interface{}{2.0, 4.0, nil}},
+		{"min", []interface{}{1.0, 4.0, nil}},
+		{"max", []interface{}{3.0, 4.0, nil}},
+		{"sum", []interface{}{4.0, 4.0, nil}},
+	}
+
+	for _, test := range tests {
+		result := aggregateSeries(test.function, series)
+		if result.Uom != "percent" {
+			t.Errorf("%s: expected uom percent got %s", test.function, result.Uom)
+		}
+		if len(result.Data) != len(test.expected) {
+			t.Fatalf("%s: expected %d values got %d", test.function, len(test.expected), len(result.Data))
+		}
+		for i, row := range result.Data {
+			if row[0] != int64(100*(i+1)) || row[1] != test.expected[i] {
+				t.Errorf("%s: expected %v got %v", test.function, test.expected[i], row)
+			}
+		}
+	}
+}
+
+func TestCalculateStats(t *testing.T) {
+	data := make([][2]interface{}, 0, 21)
+	for i := 20; i >= 1; i-- {
+		data = append(data, [2]interface{}{int64(i), json.Number(strconv.Itoa(i % 10))})
+	}
+	data = append(data, [2]interface{}{int64(0), nil})
+
+	stats := calculateStats(data)
+	if stats.Min != 0.0 || stats.Max != 9.0 || stats.Avg != 4.5 || stats.P95 != 9.0 {
+		t.Errorf("Unexpected stats %+v", stats)
+	}
+	if sd, _ := stats.Stddev.(float64); sd < 2.94 || sd > 2.95 {
+		t.Errorf("Unexpected stddev %v", stats.Stddev)
+	}
+
+	stats = calculateStats(nil)
+	if stats.Min != nil || stats.Avg != nil {
+		t.Errorf("Expected empty stats got %+v", stats)
+	}
+}
@@ -0,0 +1,221 @@
+package timeseries
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+const (
+	METADATA_SQLITE   = "sqlite3"
+	METADATA_POSTGRES = "postgres"
+	METADATA_MYSQL    = "mysql"
+)
+
+// sqlDialect hides differences between SQL databases supported as metadata
+// store, queries are written with ? placeholders and SQLite syntax where
+// there is no common one
+type sqlDialect struct {
+	name string
+	// $1, $2... placeholders instead of ?
+	numbered bool
+	// column type of unix timestamps
+	timestamp string
+	// appended to CREATE TABLE
+	tableOptions string
+	// query returning number changed on each modification made by other
+	// connections, metadata_version bumped by transactions changing uoms
+	// is used if empty
+	dataVersion string
+}
+
+var (
+	uomsKeys           = []string{"host", "service", "metric"}
+	hostAttributesKeys = []string{"host", "name", "value"}
+)
+
+var sqlDialects = map[string]*sqlDialect{
+	METADATA_SQLITE: &sqlDialect{
+		name:        METADATA_SQLITE,
+		timestamp:   "INTEGER",
+		dataVersion: "PRAGMA data_version",
+	},
+	METADATA_POSTGRES: &sqlDialect{
+		name:      METADATA_POSTGRES,
+		numbered:  true,
+		timestamp: "BIGINT",
+	},
+	METADATA_MYSQL: &sqlDialect{
+		name:         METADATA_MYSQL,
+		timestamp:    "BIGINT",
+		tableOptions: " DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_bin",
+	},
+}
+
+func getSQLDialect(driver string) (*sqlDialect, error) {
+	dialect, ok := sqlDialects[driver]
+	if !ok {
+		return nil, errors.New(fmt.Sprintf("Unsupported metadata driver: %s", driver))
+	}
+
+	return dialect, nil
+}
+
+func (this *sqlDialect) rebind(query string) string {
+	if !this.numbered || !strings.Contains(query, "?") {
+		return query
+	}
+
+	var b strings.Builder
+	n := 0
+	// ? in quoted literals and identifiers is not a placeholder, doubled
+	// quotes end and start the quoted part again
+	var quote rune
+	for _, c := range query {
+		switch {
+		case quote != 0:
+			if c == quote {
+				quote = 0
+			}
+		case c == '\'' || c == '"':
+			quote = c
+		case c == '?':
+			n++
+			b.WriteString("$" + strconv.Itoa(n))
+			continue
+		}
+		b.WriteRune(c)
+	}
+
+	return b.String()
+}
+
+// excluded refers to the value which failed to be inserted in conflict clause
+func (this *sqlDialect) excluded(column string) string {
+	if this.name == METADATA_MYSQL {
+		return "VALUES(" + column + ")"
+	}
+
+	return "excluded." + column
+}
+
+func (this *sqlDialect) conflict(keys []string, assignments ...string) string {
+	if this.name == METADATA_MYSQL {
+		return "ON DUPLICATE KEY UPDATE " + strings.Join(assignments, ", ")
+	}
+
+	return fmt.Sprintf("ON CONFLICT (%s) DO UPDATE SET %s", strings.Join(keys, ", "), strings.Join(assignments, ", "))
+}
+
+// replace returns statement inserting rows from source (VALUES or SELECT)
+// and replacing existing rows with the same keys
+func (this *sqlDialect) replace(table string, columns, keys []string, source string) string {
+	switch this.name {
+	case METADATA_SQLITE:
+		return fmt.Sprintf("INSERT OR REPLACE INTO %s (%s) %s", table, strings.Join(columns, ", "), source)
+	case METADATA_MYSQL:
+		return fmt.Sprintf("REPLACE INTO %s (%s) %s", table, strings.Join(columns, ", "), source)
+	}
+
+	isKey := make(map[string]bool, len(keys))
+	for _, key := range keys {
+		isKey[key] = true
+	}
+	assignments := make([]string, 0, len(columns))
+	for _, column := range columns {
+		if !isKey[column] {
+			assignments = append(assignments, column+" = "+this.excluded(column))
+		}
+	}
+	if len(assignments) == 0 {
+		return fmt.Sprintf("INSERT INTO %s (%s) %s ON CONFLICT (%s) DO NOTHING", table, strings.Join(columns, ", "), source, strings.Join(keys, ", "))
+	}
+
+	return fmt.Sprintf("INSERT INTO %s (%s) %s %s", table, strings.Join(columns, ", "), source, this.conflict(keys, assignments...))
+}
+
+type metadataDB struct {
+	*sql.DB
+	dialect *sqlDialect
+}
+
+func (this *metadataDB) Exec(query string, args ...interface{}) (sql.Result, error) {
+	return this.DB.Exec(this.dialect.rebind(query), args...)
+}
+
+func (this *metadataDB) Query(query string, args ...interface{}) (*sql.Rows, error) {
+	return this.DB.Query(this.dialect.rebind(query), args...)
+}
+
+func (this *metadataDB) QueryRow(query string, args ...interface{}) *sql.Row {
+	return this.DB.QueryRow(this.dialect.rebind(query), args...)
+}
+
+func (this *metadataDB) Prepare(query string) (*sql.Stmt, error) {
+	return this.DB.Prepare(this.dialect.rebind(query))
+}
+
+func (this *metadataDB) Begin() (*metadataTx, error) {
+	tx, err := this.DB.Begin()
+	if err != nil {
+		return nil, err
+	}
+
+	return &metadataTx{tx, this.dialect}, nil
+}
+
+type metadataTx struct {
+	*sql.Tx
+	dialect *sqlDialect
+}
+
+func (this *metadataTx) Exec(query string, args ...interface{}) (sql.Result, error) {
+	return this.Tx.Exec(this.dialect.rebind(query), args...)
+}
+
+func (this *metadataTx) Query(query string, args ...interface{}) (*sql.Rows, error) {
+	return this.Tx.Query(this.dialect.rebind(query), args...)
+}
+
+func (this *metadataTx) QueryRow(query string, args ...interface{}) *sql.Row {
+	return this.Tx.QueryRow(this.dialect.rebind(query), args...)
+}
+
+func (this *metadataTx) Prepare(query string) (*sql.Stmt, error) {
+	return this.Tx.Prepare(this.dialect.rebind(query))
+}
+
+// bumpVersion tells metadata caches of all servers that uoms changed
+func (this *metadataTx) bumpVersion() error {
+	_, err := this.Exec("UPDATE metadata_version SET version = version + 1 WHERE id = 1")
+	return err
+}
+
+// UpdateOrReplace sets column to value in rows matching where, existing rows
+// which would conflict with the updated ones on keys are removed first
+func (this *metadataTx) UpdateOrReplace(table string, keys []string, column, value, where string, args ...interface{}) error {
+	updateArgs := append([]interface{}{value}, args...)
+	if this.dialect.name == METADATA_SQLITE {
+		_, err := this.Exec(fmt.Sprintf("UPDATE OR REPLACE %s SET %s = ? WHERE %s", table, column, where), updateArgs...)
+		return err
+	}
+
+	others := make([]string, 0, len(keys))
+	for _, key := range keys {
+		if key != column {
+			others = append(others, key)
+		}
+	}
+	// DISTINCT makes MySQL materialize the derived table, it does not allow
+	// selecting from the table being deleted from otherwise
+	_, err := this.Exec(fmt.Sprintf("DELETE FROM %s WHERE %s = ? AND (%s) IN (SELECT %[3]s FROM (SELECT DISTINCT %[3]s FROM %[1]s WHERE %[4]s) src)",
+		table, column, strings.Join(others, ", "), where), updateArgs...)
+	if err != nil {
+		return err
+	}
+	_, err = this.Exec(fmt.Sprintf("UPDATE %s SET %s = ? WHERE %s", table, column, where), updateArgs...)
+
+	return err
+}
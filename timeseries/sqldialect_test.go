@@ -0,0 +1,88 @@
+package timeseries
+
+import (
+	"testing"
+)
+
+func TestSQLDialectRebind(t *testing.T) {
+	query := "SELECT uom FROM uoms WHERE host = ? AND service = ? AND metric = ?"
+
+	if got := sqlDialects[METADATA_SQLITE].rebind(query); got != query {
+		t.Errorf("Expected query unchanged got %s", got)
+	}
+	expected := "SELECT uom FROM uoms WHERE host = $1 AND service = $2 AND metric = $3"
+	if got := sqlDialects[METADATA_POSTGRES].rebind(query); got != expected {
+		t.Errorf("Expected %s got %s", expected, got)
+	}
+
+	query = `SELECT "a?" FROM uoms WHERE host = ? AND service LIKE '%?%' AND metric = 'it''s ?' AND uom = ?`
+	expected = `SELECT "a?" FROM uoms WHERE host = $1 AND service LIKE '%?%' AND metric = 'it''s ?' AND uom = $2`
+	if got := sqlDialects[METADATA_POSTGRES].rebind(query); got != expected {
+		t.Errorf("Expected %s got %s", expected, got)
+	}
+}
+
+func TestSQLDialectReplace(t *testing.T) {
+	columns := []string{"host", "name", "value", "updated"}
+	keys := []string{"host", "name", "value"}
+	expected := map[string]string{
+		METADATA_SQLITE:   "INSERT OR REPLACE INTO t (host, name, value, updated) VALUES (?,?,?,?)",
+		METADATA_MYSQL:    "REPLACE INTO t (host, name, value, updated) VALUES (?,?,?,?)",
+		METADATA_POSTGRES: "INSERT INTO t (host, name, value, updated) VALUES (?,?,?,?) ON CONFLICT (host, name, value) DO UPDATE SET updated = excluded.updated",
+	}
+	for name, query := range expected {
+		if got := sqlDialects[name].replace("t", columns, keys, "VALUES (?,?,?,?)"); got != query {
+			t.Errorf("%s: expected %s got %s", name, query, got)
+		}
+	}
+
+	expectedNothing := "INSERT INTO t (host, name, value) VALUES (?,?,?) ON CONFLICT (host, name, value) DO NOTHING"
+	if got := sqlDialects[METADATA_POSTGRES].replace("t", keys, keys, "VALUES (?,?,?)"); got != expectedNothing {
+		t.Errorf("Expected %s got %s", expectedNothing, got)
+	}
+}
+
+func TestUpdateOrReplace(t *testing.T) {
+	tenant, cleanup := newTestTenant(t)
+	defer cleanup()
+
+	// generic statements used for PostgreSQL and MySQL run on SQLite as well
+	for _, dialect := range []*sqlDialect{sqlDialects[METADATA_SQLITE], &sqlDialect{name: METADATA_MYSQL}} {
+		if _, err := testMetadataDB(tenant).Exec("DELETE FROM uoms"); err != nil {
+			t.Fatal(err)
+		}
+		if err := tenant.updateMetadata([][5]string{
+			{"h1", "Disk", "/", "GAUGE", "B"},
+			{"h1", "Disk", "/var", "GAUGE", "B"},
+			{"h2", "Disk", "/", "GAUGE", "MB"},
+		}, 100); err != nil {
+			t.Fatal(err)
+		}
+
+		db := &metadataDB{testMetadataDB(tenant).DB, dialect}
+		tx, err := db.Begin()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := tx.UpdateOrReplace("uoms", uomsKeys, "host", "h2", "host = ?", "h1"); err != nil {
+			tx.Rollback()
+			t.Fatalf("%s: %s", dialect.name, err)
+		}
+		if err := tx.Commit(); err != nil {
+			t.Fatal(err)
+		}
+
+		data, err := tenant.ListMetadata()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(data) != 2 {
+			t.Fatalf("%s: expected 2 rows got %+v", dialect.name, data)
+		}
+		for _, i := range data {
+			if i[0] != "h2" || i[4] != "B" {
+				t.Errorf("%s: unexpected row %+v", dialect.name, i)
+			}
+		}
+	}
+}
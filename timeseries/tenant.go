@@ -0,0 +1,144 @@
+package timeseries
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/influxdata/influxdb/client/v2"
+	"github.com/julienschmidt/httprouter"
+	"net/http"
+	"sync"
+)
+
+type TimeseriesTenant struct {
+	config       *TimeseriesTenantConfig
+	store        MetadataStore
+	metadata     *MetadataWriter
+	cache        *MetadataCache
+	events       *MetadataEvents
+	queryCache   *QueryCache
+	jobs         *JobManager
+	log          *TimeseriesLogger
+	hostTags     map[string]map[string]string
+	hostTagsLock sync.RWMutex
+	influxdb     client.Client
+	influxdbLock sync.Mutex
+	stop         chan struct{}
+	stopOnce     sync.Once
+	workers      sync.WaitGroup
+}
+
+type tenantHandle func(http.ResponseWriter, *http.Request, httprouter.Params, *TimeseriesTenant)
+
+func NewTenant(config *TimeseriesTenantConfig, logger *TimeseriesLogger) *TimeseriesTenant {
+	tenant := &TimeseriesTenant{
+		config: config,
+		log:    logger,
+		stop:   make(chan struct{}),
+	}
+	tenant.jobs = NewJobManager(logger, tenant.goRun)
+
+	return tenant
+}
+
+// goRun starts background task of the tenant, run must return once stop is
+// closed
+func (this *TimeseriesTenant) goRun(run func(stop <-chan struct{})) {
+	this.workers.Add(1)
+	go func() {
+		defer this.workers.Done()
+		run(this.stop)
+	}()
+}
+
+func (this *TimeseriesTenant) stopWorkers(ctx context.Context) error {
+	this.stopOnce.Do(func() {
+		close(this.stop)
+	})
+
+	done := make(chan struct{})
+	go func() {
+		this.workers.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (this *TimeseriesTenant) Name() string {
+	return this.config.Name
+}
+
+func (this *TimeseriesTenant) NewInfluxDBClient() (client.Client, error) {
+	clientConfig := client.HTTPConfig{
+		Addr: this.config.InfluxDB.Server,
+	}
+	if this.config.InfluxDB.User != "" {
+		clientConfig.Username = this.config.InfluxDB.User
+		clientConfig.Password = this.config.InfluxDB.Password
+	}
+
+	return client.NewHTTPClient(clientConfig)
+}
+
+// InfluxDBClient returns client shared by all requests of the tenant so
+// connections to InfluxDB are reused, it must not be closed by the caller
+func (this *TimeseriesTenant) InfluxDBClient() (client.Client, error) {
+	this.influxdbLock.Lock()
+	defer this.influxdbLock.Unlock()
+
+	if this.influxdb == nil {
+		db, err := this.NewInfluxDBClient()
+		if err != nil {
+			return nil, err
+		}
+		this.influxdb = db
+	}
+
+	return this.influxdb, nil
+}
+
+func (this *TimeseriesTenant) Close() {
+	this.influxdbLock.Lock()
+	if this.influxdb != nil {
+		this.influxdb.Close()
+		this.influxdb = nil
+	}
+	this.influxdbLock.Unlock()
+
+	this.CloseMetadataDB()
+}
+
+// OpenTenant initializes metadata database of the tenant for command line
+// tools, name can be omitted if there is only one tenant configured
+func (this *TimeseriesServer) OpenTenant(name, logName string) (*TimeseriesTenant, error) {
+	if this.log == nil {
+		this.log = NewLogger(this.config.Server.Updates.LogFacility, this.config.Server.Updates.LogLevel, logName)
+	}
+
+	var config *TimeseriesTenantConfig
+	for i := range this.config.Tenants {
+		if this.config.Tenants[i].Name == name || (name == "" && len(this.config.Tenants) == 1) {
+			config = &this.config.Tenants[i]
+			break
+		}
+	}
+	if config == nil {
+		if name == "" {
+			return nil, errors.New("Tenant name is required")
+		}
+		return nil, errors.New(fmt.Sprintf("Unknown tenant: %s", name))
+	}
+
+	tenant := NewTenant(config, this.log)
+	if err := tenant.InitMetadataDB(); err != nil {
+		return nil, err
+	}
+
+	return tenant, nil
+}
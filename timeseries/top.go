@@ -0,0 +1,140 @@
+package timeseries
+
+import (
+	"github.com/julienschmidt/httprouter"
+	"net/http"
+	"sort"
+	"strconv"
+)
+
+const (
+	TOP_LIMIT     = 10
+	TOP_MAX_LIMIT = 1000
+)
+
+type TopItem struct {
+	Host    string                `json:"host"`
+	Service string                `json:"service"`
+	Metric  string                `json:"metric"`
+	Value   float64               `json:"value"`
+	Uom     string                `json:"uom"`
+	Stats   *QueryResultDataStats `json:"stats"`
+}
+
+type TopResult struct {
+	Total int       `json:"total"`
+	Items []TopItem `json:"items"`
+}
+
+// topValues select the ranked value from summary of a series
+var topValues = map[string]func(stats *QueryResultDataStats) interface{}{
+	"mean": func(stats *QueryResultDataStats) interface{} { return stats.Avg },
+	"max":  func(stats *QueryResultDataStats) interface{} { return stats.Max },
+	"p95":  func(stats *QueryResultDataStats) interface{} { return stats.P95 },
+	"last": func(stats *QueryResultDataStats) interface{} { return stats.last },
+}
+
+// TopHandler ranks series matching the metadata filter by summary of the
+// requested time range, series without data are left out. Results are not
+// cached as only the summary is queried.
+func (this *TimeseriesServer) TopHandler(w http.ResponseWriter, r *http.Request, ps httprouter.Params, tenant *TimeseriesTenant) {
+	if err := r.ParseForm(); err != nil {
+		this.sendHTTPError(w, http.StatusBadRequest, "Failed to parse query: %s", err)
+		return
+	}
+	filter, err := ParseMetadataFilter(r.Form)
+	if err != nil {
+		this.sendHTTPError(w, http.StatusBadRequest, "Failed to parse query: %s", err)
+		return
+	}
+	qsParams, err := this.parseQueryParams(r.Form, tenant)
+	if err != nil {
+		this.sendHTTPError(w, http.StatusBadRequest, "Failed to parse query: %s", err)
+		return
+	}
+
+	by := r.Form.Get("by")
+	if by == "" {
+		by = "mean"
+	}
+	value, ok := topValues[by]
+	if !ok {
+		this.sendHTTPError(w, http.StatusBadRequest, "Failed to parse query: Invalid parameter: by")
+		return
+	}
+
+	order := r.Form.Get("order")
+	if order != "" && order != "asc" && order != "desc" {
+		this.sendHTTPError(w, http.StatusBadRequest, "Failed to parse query: Invalid parameter: order")
+		return
+	}
+
+	limit := TOP_LIMIT
+	if v := r.Form.Get("limit"); v != "" {
+		if limit, err = strconv.Atoi(v); err != nil || limit < 1 || limit > TOP_MAX_LIMIT {
+			this.sendHTTPError(w, http.StatusBadRequest, "Failed to parse query: Invalid parameter: limit")
+			return
+		}
+	}
+
+	candidates, err := searchHSMs(tenant, filter, this.config.Server.Queries.TopMaxCandidates)
+	if err != nil {
+		this.sendHTTPError(w, http.StatusBadRequest, "Failed to search metadata information: %s", err)
+		return
+	}
+
+	db, err := tenant.InfluxDBClient()
+	if err != nil {
+		this.sendHTTPError(w, http.StatusInternalServerError, "Failed to connect to InfluxDB: %s", err)
+		return
+	}
+
+	// series are summarized the same way as in queries
+	batch := this.newQueryBatch(tenant, qsParams, 0)
+	batch.Summarize(by == "last")
+	queries := make([]*hsmQuery, len(candidates))
+	for i, hsm := range candidates {
+		if queries[i], err = batch.Add(hsm); err != nil {
+			this.sendHTTPError(w, http.StatusInternalServerError, "%s", err)
+			return
+		}
+	}
+	if err := batch.Run(db); err != nil {
+		this.sendHTTPError(w, http.StatusInternalServerError, "%s", err)
+		return
+	}
+
+	items := make([]TopItem, 0, len(candidates))
+	for _, query := range queries {
+		result := query.Result()
+		if result.Stats == nil {
+			continue
+		}
+		v, ok := seriesValue(value(result.Stats))
+		if !ok {
+			continue
+		}
+		items = append(items, TopItem{
+			Host:    query.hsm.Host,
+			Service: query.hsm.Service,
+			Metric:  query.hsm.Metric,
+			Value:   v,
+			Uom:     result.Uom,
+			Stats:   result.Stats,
+		})
+	}
+	sort.SliceStable(items, func(i, j int) bool {
+		if order == "asc" {
+			return items[i].Value < items[j].Value
+		}
+		return items[i].Value > items[j].Value
+	})
+	if len(items) > limit {
+		items = items[:limit]
+	}
+
+	this.sendJSON(w, TopResult{
+		Total: len(candidates),
+		Items: items,
+	})
+}
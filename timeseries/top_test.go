@@ -0,0 +1,127 @@
+package timeseries
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestTopHandler(t *testing.T) {
+	tenant, cleanup := newTestTenant(t)
+	defer cleanup()
+
+	if err := tenant.updateMetadata([][5]string{
+		{"h1", "Interface eth0", "in", "GAUGE", ""},
+		{"h1", "Interface eth0", "out", "GAUGE", ""},
+		{"h2", "Interface eth0", "peak", "GAUGE", ""},
+		{"h2", "Interface eth1", "bytes", "COUNTER", ""},
+		{"h2", "Interface eth1", "empty", "GAUGE", ""},
+		{"h2", "CPU", "load1", "GAUGE", ""},
+	}, time.Now().Unix()); err != nil {
+		t.Fatal(err)
+	}
+
+	fake := newFakeInfluxDB(nil)
+	fake.metricRows = map[string][][]interface{}{
+		"empty": {},
+	}
+	// summary of the counter is of its per second rate
+	fake.summaries = map[string][]interface{}{
+		"in":    {0, 1, 10, 5, 1, 9, 7},
+		"out":   {0, 2, 4, 3, 1, 4, 2},
+		"peak":  {0, 0, 50, 1, 5, 2, 0},
+		"bytes": {0, 2, 3, 2.5, 0.5, 3, 3},
+		"load1": {0, 100, 100, 100, 0, 100, 100},
+	}
+	defer fake.Close()
+	server := newTestQueryServer(tenant, fake.URL)
+	tenant.queryCache = NewQueryCache(time.Minute, 1000)
+
+	top := func(params string) (int, TopResult) {
+		w := httptest.NewRecorder()
+		server.TopHandler(w, httptest.NewRequest("GET", "/top?start=1500000000&end=1500003600&service=Interface&"+params, nil), nil, tenant)
+
+		var result TopResult
+		if w.Code == 200 {
+			if err := json.Unmarshal(w.Body.Bytes(), &result); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return w.Code, result
+	}
+
+	tests := []struct {
+		params   string
+		expected []string
+		first    float64
+	}{
+		{"", []string{"in", "out", "bytes", "peak"}, 5},
+		{"by=max&limit=2", []string{"peak", "in"}, 50},
+		{"by=p95&order=asc&limit=3", []string{"peak", "bytes", "out"}, 2},
+		{"by=last&metric=out", []string{"out"}, 2},
+	}
+	for _, test := range tests {
+		code, result := top(test.params)
+		if code != 200 {
+			t.Errorf("%s: unexpected response %d", test.params, code)
+			continue
+		}
+		metrics := make([]string, len(result.Items))
+		for i, item := range result.Items {
+			metrics[i] = item.Metric
+		}
+		if len(metrics) != len(test.expected) || result.Items[0].Value != test.first {
+			t.Errorf("%s: expected %v got %+v", test.params, test.expected, result.Items)
+			continue
+		}
+		for i := range metrics {
+			if metrics[i] != test.expected[i] {
+				t.Errorf("%s: expected %v got %v", test.params, test.expected, metrics)
+				break
+			}
+		}
+	}
+	if _, result := top(""); result.Total != 5 {
+		t.Errorf("Expected 5 candidates, got %d", result.Total)
+	}
+
+	// only summaries are queried, each request again
+	requests := fake.Requests()
+	if len(requests) != len(tests)+1 {
+		t.Fatalf("Expected %d requests, got %d", len(tests)+1, len(requests))
+	}
+	for i, request := range requests {
+		if strings.Contains(request, "GROUP BY time(") || strings.Contains(request, "LAST(value)") != (i == 3) {
+			t.Errorf("Unexpected statements: %s", request)
+		}
+	}
+	// the range is aligned to slots of cached queries
+	if !strings.Contains(requests[0], `FROM (SELECT NON_NEGATIVE_DERIVATIVE(value, 1s) AS value FROM "opsview"."autogen"."h2" WHERE ("service" = 'Interface eth1' AND "metric" = 'bytes') AND time >= 1499999998s - 7s AND time <= 1500003596s GROUP BY service, metric) WHERE time >= 1499999998s AND time <= 1500003596s GROUP BY service, metric`) {
+		t.Errorf("Expected rate of the counter: %s", requests[0])
+	}
+
+	// stats are the same as of the query
+	_, result := top("metric=bytes")
+	w := httptest.NewRecorder()
+	server.QueryHandler(w, httptest.NewRequest("GET", "/query?start=1500000000&end=1500003600&hsm=h2::Interface%20eth1::bytes", nil), nil, tenant)
+	var results map[string]QueryResultData
+	if err := json.Unmarshal(w.Body.Bytes(), &results); err != nil {
+		t.Fatal(err)
+	}
+	if len(result.Items) != 1 || !reflect.DeepEqual(*result.Items[0].Stats, *results["h2::Interface eth1::bytes"].Stats) {
+		t.Errorf("Expected stats of the query %+v, got %+v", results["h2::Interface eth1::bytes"].Stats, result.Items)
+	}
+
+	for _, params := range []string{"by=min", "order=up", "limit=0", "match=regex&host=("} {
+		if code, _ := top(params); code != 400 {
+			t.Errorf("%s: expected error, got %d", params, code)
+		}
+	}
+	server.config.Server.Queries.TopMaxCandidates = 2
+	if code, _ := top(""); code != 400 {
+		t.Errorf("Expected error when too many series match, got %d", code)
+	}
+}
@@ -1,13 +1,14 @@
 package timeseries
 
 import (
+	"encoding/json"
 	"github.com/influxdata/influxdb/client/v2"
 	//"github.com/influxdata/influxdb/models"
 	"github.com/julienschmidt/httprouter"
 	"net/http"
 )
 
-func (this *TimeseriesServer) WriteHandler(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+func (this *TimeseriesServer) WriteHandler(w http.ResponseWriter, r *http.Request, ps httprouter.Params, tenant *TimeseriesTenant) {
 	ts, err := this.DecodeCbor(r.Body)
 	defer r.Body.Close()
 	if err != nil {
@@ -16,14 +17,7 @@ func (this *TimeseriesServer) WriteHandler(w http.ResponseWriter, r *http.Reques
 	}
 	r.Close = true
 
-	clientConfig := client.HTTPConfig{
-		Addr: this.config.InfluxDB.Server,
-	}
-	if this.config.InfluxDB.User != "" {
-		clientConfig.Username = this.config.InfluxDB.User
-		clientConfig.Password = this.config.InfluxDB.Password
-	}
-	db, err := client.NewHTTPClient(clientConfig)
+	db, err := tenant.NewInfluxDBClient()
 
 	if err != nil {
 		this.sendHTTPError(w, http.StatusInternalServerError, "Failed to connect to InfluxDB: %s", err)
@@ -32,8 +26,8 @@ func (this *TimeseriesServer) WriteHandler(w http.ResponseWriter, r *http.Reques
 	defer db.Close()
 
 	bp, err := client.NewBatchPoints(client.BatchPointsConfig{
-		Database:        this.config.InfluxDB.Database,
-		RetentionPolicy: this.config.InfluxDB.RetentionPolicy,
+		Database:        tenant.config.InfluxDB.Database,
+		RetentionPolicy: tenant.config.InfluxDB.RetentionPolicy,
 		Precision:       "s",
 	})
 
@@ -45,11 +39,15 @@ func (this *TimeseriesServer) WriteHandler(w http.ResponseWriter, r *http.Reques
 	metadata := make([][5]string, 0, len(ts)*this.config.Server.Updates.ExpectedResultsCount)
 
 	for _, hs := range ts {
+		hostTags := tenant.HostTags(hs.Host)
 		for _, data := range hs.Data {
-			tags := map[string]string{
-				"service": hs.Service,
-				"metric":  data.Metric,
+			tags := make(map[string]string, len(hostTags)+2)
+			for name, value := range hostTags {
+				tags[name] = value
 			}
+			tags["service"] = hs.Service
+			tags["metric"] = data.Metric
+
 			fields := map[string]interface{}{"value": data.Value}
 
 			metadata = append(metadata,
@@ -75,6 +73,25 @@ func (this *TimeseriesServer) WriteHandler(w http.ResponseWriter, r *http.Reques
 		this.sendHTTPError(w, http.StatusInternalServerError, "Failed to write metrics to InfluxDB: %s", err)
 		return
 	}
-	this.queue <- metadata
+	tenant.metadata.Add(metadata)
 	w.Write([]byte("{\"status\":0}"))
 }
+
+type TimeseriesUpdatesStatus struct {
+	Tenant   string              `json:"tenant"`
+	Metadata MetadataWriterStats `json:"metadata"`
+}
+
+func (this *TimeseriesServer) StatusHandler(w http.ResponseWriter, r *http.Request, ps httprouter.Params, tenant *TimeseriesTenant) {
+	status := TimeseriesUpdatesStatus{
+		Tenant:   tenant.Name(),
+		Metadata: tenant.metadata.Stats(),
+	}
+	json, err := json.Marshal(status)
+
+	if err != nil {
+		this.sendHTTPError(w, http.StatusInternalServerError, "Failed to encode JSON response: %s", err)
+		return
+	}
+	w.Write(json)
+}
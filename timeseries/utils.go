@@ -3,6 +3,7 @@ package timeseries
 import (
 	"fmt"
 	"math"
+	"strconv"
 )
 
 const (
@@ -20,6 +21,13 @@ type uomConversion struct {
 var uom_conversion map[string]uomConversion
 var uom_mapping map[string]string
 
+var dstypes = map[string]bool{
+	"GAUGE":    true,
+	"COUNTER":  true,
+	"DERIVE":   true,
+	"ABSOLUTE": true,
+}
+
 func init() {
 	uom_conversion = map[string]uomConversion{
 		"B": uomConversion{
@@ -88,6 +96,10 @@ func ConvertUom(uom string) (new_uom string, multiplier float64) {
 	return
 }
 
+func ValidDstype(dstype string) bool {
+	return dstypes[dstype]
+}
+
 func CalculateTimeSlotSize(datapoints int64, startEpoch int64, endEpoch int64, minSlotSize float64, fixedSlotSize float64) string {
 	var slotSizeSec float64
 	timeDiff := endEpoch - startEpoch
@@ -127,3 +139,29 @@ func CalculateTimeSlotSize(datapoints int64, startEpoch int64, endEpoch int64, m
 		return fmt.Sprintf("%dw", int(math.Ceil(slotSizeSec/WEEK)))
 	}
 }
+
+// TimeSlotSeconds returns length of slot returned by CalculateTimeSlotSize
+func TimeSlotSeconds(slot string) int64 {
+	if slot == "" {
+		return 0
+	}
+	n, err := strconv.ParseInt(slot[:len(slot)-1], 10, 64)
+	if err != nil {
+		return 0
+	}
+
+	switch slot[len(slot)-1] {
+	case 's':
+		return n
+	case 'm':
+		return n * MINUTE
+	case 'h':
+		return n * HOUR
+	case 'd':
+		return n * DAY
+	case 'w':
+		return n * WEEK
+	}
+
+	return 0
+}
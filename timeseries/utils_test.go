@@ -4,6 +4,26 @@ import (
 	"testing"
 )
 
+func TestTimeSlotSeconds(t *testing.T) {
+	tests := map[string]int64{
+		"15s":   15,
+		"1567s": 1567,
+		"6m":    360,
+		"2h":    7200,
+		"1d":    DAY,
+		"2w":    2 * WEEK,
+		"":      0,
+		"5x":    0,
+		"m":     0,
+	}
+
+	for slot, expected := range tests {
+		if got := TimeSlotSeconds(slot); got != expected {
+			t.Errorf("TimeSlotSeconds(%q) = %d, expected %d", slot, got, expected)
+		}
+	}
+}
+
 func TestCalculateTimeSlotSize(t *testing.T) {
 	tests := []struct {
 		datapoints    int64